@@ -21,6 +21,7 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"slices"
 	"sync"
 	"syscall"
 	"time"
@@ -30,11 +31,16 @@ const shutdownTimeout = 10 * time.Second
 
 //nolint:gochecknoglobals // Shutdown state
 var (
-	shutdownHandlers []func()
+	shutdownHandlers []*handlerEntry
 	shutdownMu       sync.Mutex
 	shutdownOnce     sync.Once
 )
 
+// handlerEntry wraps a handler, so that it can be told apart for removal.
+type handlerEntry struct {
+	handler func()
+}
+
 // SetDefaults registers signal handlers, exit with timeout.
 func SetDefaults(parent context.Context) context.Context {
 	ctx, cancel := context.WithCancel(parent)
@@ -79,11 +85,28 @@ func SetDefaults(parent context.Context) context.Context {
 
 // Register adds a handler to be run on shutdown.
 func Register(handler func()) {
+	RegisterRemovable(handler)
+}
+
+// RegisterRemovable adds a handler to be run on shutdown, and returns a function removing it, for handlers tied to
+// resources that can be released before the application exits.
+func RegisterRemovable(handler func()) func() {
+	entry := &handlerEntry{handler: handler}
+
 	shutdownMu.Lock()
 
-	shutdownHandlers = append(shutdownHandlers, handler)
+	shutdownHandlers = append(shutdownHandlers, entry)
 
 	shutdownMu.Unlock()
+
+	return func() {
+		shutdownMu.Lock()
+		defer shutdownMu.Unlock()
+
+		if index := slices.Index(shutdownHandlers, entry); index >= 0 {
+			shutdownHandlers = slices.Delete(shutdownHandlers, index, index+1)
+		}
+	}
 }
 
 // Shutdown executes handlers in reverse order, exactly once.
@@ -91,12 +114,11 @@ func Shutdown() {
 	shutdownOnce.Do(func() {
 		shutdownMu.Lock()
 
-		handlers := make([]func(), len(shutdownHandlers))
-		copy(handlers, shutdownHandlers)
+		handlers := slices.Clone(shutdownHandlers)
 		shutdownMu.Unlock()
 
 		for i := len(handlers) - 1; i >= 0; i-- {
-			handlers[i]()
+			handlers[i].handler()
 		}
 	})
 }
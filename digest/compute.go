@@ -0,0 +1,152 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package digest
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/mycophonic/primordium/fault"
+)
+
+// FromBytes computes the digest of data using the given algorithm.
+// Panics if the algorithm is not available, like Algorithm.Hash.
+func FromBytes(alg Algorithm, data []byte) Digest {
+	hasher := alg.Hash()
+	_, _ = hasher.Write(data)
+
+	return fromHash(alg, hasher)
+}
+
+// FromReader computes the digest of everything read from reader until EOF using the given algorithm.
+func FromReader(alg Algorithm, reader io.Reader) (Digest, error) {
+	if !alg.Available() {
+		return Digest{}, fmt.Errorf("%w: unknown algorithm %s", fault.ErrInvalidArgument, alg)
+	}
+
+	hasher := alg.Hash()
+
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return Digest{}, fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+	}
+
+	return fromHash(alg, hasher), nil
+}
+
+// Digester hashes everything written through it, optionally forwarding the data to an underlying io.Writer.
+type Digester struct {
+	algorithm Algorithm
+	hash      hash.Hash
+	writer    io.Writer
+}
+
+// NewDigester returns a Digester computing alg over the data written to it.
+// If writer is not nil, data is also written to it, and the digest only accounts for what the writer accepted.
+// Panics if the algorithm is not available, like Algorithm.Hash.
+func NewDigester(alg Algorithm, writer io.Writer) *Digester {
+	return &Digester{
+		algorithm: alg,
+		hash:      alg.Hash(),
+		writer:    writer,
+	}
+}
+
+// Write implements io.Writer.
+//
+//nolint:wrapcheck // I/O wrapper must return unwrapped errors
+func (d *Digester) Write(p []byte) (int, error) {
+	if d.writer == nil {
+		return d.hash.Write(p)
+	}
+
+	n, err := d.writer.Write(p)
+	_, _ = d.hash.Write(p[:n])
+
+	return n, err
+}
+
+// Digest returns the digest of the data written so far.
+func (d *Digester) Digest() Digest {
+	return fromHash(d.algorithm, d.hash)
+}
+
+// Verifier wraps an io.Reader, hashing content as it streams through.
+// Once the underlying reader reaches EOF, the computed digest is compared against the expected one, and Read returns
+// an error wrapping fault.ErrHashMismatch instead of io.EOF if they disagree.
+type Verifier struct {
+	expected Digest
+	hash     hash.Hash
+	reader   io.Reader
+	verified bool
+}
+
+// NewVerifier returns a Verifier checking the content of reader against expected.
+// Algorithms that are not cryptographically secure are refused.
+func NewVerifier(expected Digest, reader io.Reader) (*Verifier, error) {
+	if expected.IsZero() {
+		return nil, fmt.Errorf("%w: empty expected digest", fault.ErrInvalidArgument)
+	}
+
+	if !expected.Algorithm().Available() {
+		return nil, fmt.Errorf("%w: unknown algorithm %s", fault.ErrInvalidArgument, expected.Algorithm())
+	}
+
+	if !expected.Algorithm().Secure() {
+		return nil, fmt.Errorf("%w: algorithm %s cannot be used to verify content", fault.ErrInvalidArgument,
+			expected.Algorithm())
+	}
+
+	return &Verifier{
+		expected: expected,
+		hash:     expected.Algorithm().Hash(),
+		reader:   reader,
+	}, nil
+}
+
+// Read implements io.Reader.
+//
+//nolint:wrapcheck // I/O wrapper must return unwrapped errors (io.EOF, etc.)
+func (v *Verifier) Read(p []byte) (int, error) {
+	n, err := v.reader.Read(p)
+	_, _ = v.hash.Write(p[:n])
+
+	if errors.Is(err, io.EOF) {
+		actual := fromHash(v.expected.Algorithm(), v.hash)
+		if !actual.Equal(v.expected) {
+			return n, fmt.Errorf("%w: expected %s, got %s", fault.ErrHashMismatch, v.expected, actual)
+		}
+
+		v.verified = true
+	}
+
+	return n, err
+}
+
+// Verified reports whether the content has been read to EOF and matched the expected digest.
+func (v *Verifier) Verified() bool {
+	return v.verified
+}
+
+func fromHash(alg Algorithm, hasher hash.Hash) Digest {
+	return Digest{
+		algorithm: alg,
+		encoded:   hex.EncodeToString(hasher.Sum(nil)),
+	}
+}
@@ -0,0 +1,141 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package digest_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/mycophonic/primordium/digest"
+	"github.com/mycophonic/primordium/fault"
+)
+
+const (
+	helloSHA256 = "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	emptySHA256 = "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+func TestFromBytes(t *testing.T) {
+	t.Parallel()
+
+	if got := digest.FromBytes(digest.SHA256, []byte("hello")).String(); got != helloSHA256 {
+		t.Errorf("FromBytes(hello) = %q, want %q", got, helloSHA256)
+	}
+
+	if got := digest.FromBytes(digest.SHA256, nil).String(); got != emptySHA256 {
+		t.Errorf("FromBytes(nil) = %q, want %q", got, emptySHA256)
+	}
+}
+
+func TestFromReader(t *testing.T) {
+	t.Parallel()
+
+	dgst, err := digest.FromReader(digest.SHA256, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("FromReader returned error: %v", err)
+	}
+
+	if dgst.String() != helloSHA256 {
+		t.Errorf("FromReader(hello) = %q, want %q", dgst.String(), helloSHA256)
+	}
+}
+
+func TestFromReader_UnknownAlgorithm(t *testing.T) {
+	t.Parallel()
+
+	_, err := digest.FromReader("md5", strings.NewReader("hello"))
+	if !errors.Is(err, fault.ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got: %v", err)
+	}
+}
+
+func TestDigester_ForwardsAndHashes(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+
+	digester := digest.NewDigester(digest.SHA256, &buf)
+
+	if _, err := io.WriteString(digester, "hel"); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	if _, err := io.WriteString(digester, "lo"); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	if buf.String() != "hello" {
+		t.Errorf("forwarded data = %q, want %q", buf.String(), "hello")
+	}
+
+	if got := digester.Digest().String(); got != helloSHA256 {
+		t.Errorf("Digest() = %q, want %q", got, helloSHA256)
+	}
+}
+
+func TestVerifier_Match(t *testing.T) {
+	t.Parallel()
+
+	expected, err := digest.FromString(helloSHA256)
+	if err != nil {
+		t.Fatalf("FromString failed: %v", err)
+	}
+
+	verifier, err := digest.NewVerifier(expected, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("NewVerifier failed: %v", err)
+	}
+
+	data, err := io.ReadAll(verifier)
+	if err != nil {
+		t.Fatalf("ReadAll returned error: %v", err)
+	}
+
+	if string(data) != "hello" {
+		t.Errorf("data = %q, want %q", data, "hello")
+	}
+
+	if !verifier.Verified() {
+		t.Error("Verified() = false, want true")
+	}
+}
+
+func TestVerifier_Mismatch(t *testing.T) {
+	t.Parallel()
+
+	expected, err := digest.FromString(helloSHA256)
+	if err != nil {
+		t.Fatalf("FromString failed: %v", err)
+	}
+
+	verifier, err := digest.NewVerifier(expected, strings.NewReader("tampered"))
+	if err != nil {
+		t.Fatalf("NewVerifier failed: %v", err)
+	}
+
+	_, err = io.ReadAll(verifier)
+	if !errors.Is(err, fault.ErrHashMismatch) {
+		t.Errorf("expected ErrHashMismatch, got: %v", err)
+	}
+
+	if verifier.Verified() {
+		t.Error("Verified() = true, want false")
+	}
+}
@@ -17,17 +17,10 @@
 package digest
 
 import (
-	"crypto"
-	_ "crypto/sha1" //nolint:gosec // SHA1 needed for legacy git compatibility
-	_ "crypto/sha256"
-	_ "crypto/sha512"
 	"fmt"
 	"hash"
-	"regexp"
 	"strings"
 
-	"golang.org/x/crypto/blake2b"
-
 	"github.com/mycophonic/primordium/fault"
 )
 
@@ -37,74 +30,50 @@ const (
 	SHA256     Algorithm = "sha256"
 	SHA384     Algorithm = "sha384"
 	SHA512     Algorithm = "sha512"
+	SHA3_256   Algorithm = "sha3-256"
+	SHA3_512   Algorithm = "sha3-512"
 	BLAKE2b256 Algorithm = "blake2b-256"
 	BLAKE2b512 Algorithm = "blake2b-512"
-)
+	BLAKE2s256 Algorithm = "blake2s-256"
 
-//nolint:gochecknoglobals // Package-level registry is appropriate here
-var (
-	// hashConstructors maps algorithms to their hash constructor functions.
-	hashConstructors = map[Algorithm]func() hash.Hash{
-		SHA1:       crypto.SHA1.New,
-		SHA256:     crypto.SHA256.New,
-		SHA384:     crypto.SHA384.New,
-		SHA512:     crypto.SHA512.New,
-		BLAKE2b256: newBLAKE2b256,
-		BLAKE2b512: newBLAKE2b512,
-	}
-
-	// anchoredEncodedRegexps contains anchored regular expressions for hex-encoded digests.
-	// Note that /A-F/ disallowed.
-	anchoredEncodedRegexps = map[Algorithm]*regexp.Regexp{
-		SHA1:       regexp.MustCompile("^[a-f0-9]{40}$"),
-		SHA256:     regexp.MustCompile(`^[a-f0-9]{64}$`),
-		SHA384:     regexp.MustCompile(`^[a-f0-9]{96}$`),
-		SHA512:     regexp.MustCompile(`^[a-f0-9]{128}$`),
-		BLAKE2b256: regexp.MustCompile(`^[a-f0-9]{64}$`),
-		BLAKE2b512: regexp.MustCompile(`^[a-f0-9]{128}$`),
-	}
+	// XXH64 is a fast, non-cryptographic hash. It is suitable for deduplication and cache keys, but is rejected
+	// wherever content is verified for integrity.
+	XXH64 Algorithm = "xxh64"
 )
 
-func newBLAKE2b256() hash.Hash {
-	h, err := blake2b.New256(nil)
-	if err != nil {
-		panic(err)
-	}
-
-	return h
-}
-
-func newBLAKE2b512() hash.Hash {
-	h, err := blake2b.New512(nil)
-	if err != nil {
-		panic(err)
-	}
-
-	return h
-}
-
 // Algorithm represents a digest algorithm identifier.
 type Algorithm string
 
 // Hash returns a new hash as used by the algorithm. If not available, the
 // method will panic.
 func (a Algorithm) Hash() hash.Hash {
-	constructor, ok := hashConstructors[a]
+	registration, ok := lookup(a)
 	if !ok {
 		panic(fmt.Sprintf("unknown algorithm: %s", a))
 	}
 
-	return constructor()
+	return registration.constructor()
 }
 
-// Digest represents a content digest with an algorithm and encoded hash.
-type Digest interface {
-	Algorithm() Algorithm
-	Encoded() string
-	String() string
+// Available reports whether the algorithm is supported.
+func (a Algorithm) Available() bool {
+	_, ok := lookup(a)
+
+	return ok
 }
 
-type digest struct {
+// Secure reports whether the algorithm is registered as cryptographically secure, and can be trusted to verify
+// content integrity.
+func (a Algorithm) Secure() bool {
+	registration, ok := lookup(a)
+
+	return ok && registration.secure
+}
+
+// Digest represents a content digest with an algorithm and encoded hash.
+// Digest is a comparable value type: it can be compared with == and used as a map key. The zero value represents the
+// absence of a digest.
+type Digest struct {
 	algorithm Algorithm
 	encoded   string
 }
@@ -114,33 +83,64 @@ func FromString(dgst string) (Digest, error) {
 	before, after, ok := strings.Cut(dgst, ":")
 
 	if !ok {
-		return nil, fmt.Errorf("%w: digest %s has no colon", fault.ErrInvalidArgument, dgst)
+		return Digest{}, fmt.Errorf("%w: digest %s has no colon", fault.ErrInvalidArgument, dgst)
 	}
 
 	alg := Algorithm(before)
-	if _, ok := hashConstructors[alg]; !ok {
-		return nil, fmt.Errorf("%w: digest %s has unknown algorithm", fault.ErrInvalidArgument, dgst)
+
+	registration, ok := lookup(alg)
+	if !ok {
+		return Digest{}, fmt.Errorf("%w: digest %s has unknown algorithm", fault.ErrInvalidArgument, dgst)
 	}
 
 	encoded := after
-	if !anchoredEncodedRegexps[alg].MatchString(encoded) {
-		return nil, fmt.Errorf("%w: digest %s has invalid encoded hash for algorithm", fault.ErrInvalidArgument, dgst)
+	if !registration.anchoredEncodedRegexp.MatchString(encoded) {
+		return Digest{}, fmt.Errorf("%w: digest %s has invalid encoded hash for algorithm", fault.ErrInvalidArgument,
+			dgst)
 	}
 
-	return &digest{
+	return Digest{
 		algorithm: alg,
 		encoded:   encoded,
 	}, nil
 }
 
-func (d *digest) Algorithm() Algorithm {
+// MustParse is like FromString but panics if the digest cannot be parsed.
+// It is meant for tests and package-level variables.
+func MustParse(dgst string) Digest {
+	parsed, err := FromString(dgst)
+	if err != nil {
+		panic(err)
+	}
+
+	return parsed
+}
+
+// Algorithm returns the algorithm of the digest.
+func (d Digest) Algorithm() Algorithm {
 	return d.algorithm
 }
 
-func (d *digest) Encoded() string {
+// Encoded returns the hex-encoded hash of the digest.
+func (d Digest) Encoded() string {
 	return d.encoded
 }
 
-func (d *digest) String() string {
+// String returns the digest in the format "algorithm:encoded", or an empty string for the zero value.
+func (d Digest) String() string {
+	if d.IsZero() {
+		return ""
+	}
+
 	return string(d.algorithm) + ":" + d.encoded
 }
+
+// IsZero reports whether d is the zero value.
+func (d Digest) IsZero() bool {
+	return d == Digest{}
+}
+
+// Equal reports whether d and other have the same algorithm and encoded hash.
+func (d Digest) Equal(other Digest) bool {
+	return d == other
+}
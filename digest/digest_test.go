@@ -193,6 +193,10 @@ func TestAlgorithm_Hash(t *testing.T) {
 		{digest.SHA512, 64},
 		{digest.BLAKE2b256, 32},
 		{digest.BLAKE2b512, 64},
+		{digest.SHA3_256, 32},
+		{digest.SHA3_512, 64},
+		{digest.BLAKE2s256, 32},
+		{digest.XXH64, 8},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,399 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package digest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/mycophonic/primordium/fault"
+)
+
+// ManifestFormat identifies a checksum manifest line format.
+type ManifestFormat int
+
+const (
+	// FormatGNU is the GNU coreutils format, as output by sha256sum: "<encoded>  <path>".
+	FormatGNU ManifestFormat = iota
+	// FormatBSD is the BSD tag format, as output by sha256sum --tag: "SHA256 (<path>) = <encoded>".
+	FormatBSD
+)
+
+//nolint:gochecknoglobals // Package-level registry is appropriate here
+var (
+	// bsdTags maps algorithms to the tag used by coreutils and BSD tools in tagged manifests.
+	bsdTags = map[Algorithm]string{
+		SHA1:       "SHA1",
+		SHA256:     "SHA256",
+		SHA384:     "SHA384",
+		SHA512:     "SHA512",
+		SHA3_256:   "SHA3-256",
+		SHA3_512:   "SHA3-512",
+		BLAKE2b256: "BLAKE2b-256",
+		BLAKE2b512: "BLAKE2b",
+	}
+
+	// gnuLengths maps hex encoded lengths to the algorithm assumed for untagged GNU lines.
+	gnuLengths = map[int]Algorithm{
+		40:  SHA1,
+		64:  SHA256,
+		96:  SHA384,
+		128: SHA512,
+	}
+
+	// sriAlgorithms lists the algorithms allowed by the Subresource Integrity specification.
+	sriAlgorithms = []Algorithm{SHA256, SHA384, SHA512}
+)
+
+// ManifestEntry associates a slash-separated relative path with its digest.
+type ManifestEntry struct {
+	Path   string
+	Digest Digest
+}
+
+// Manifest is a list of files and their digests, as found in SHA256SUMS-style files.
+type Manifest struct {
+	Entries []ManifestEntry
+}
+
+// ParseManifest parses a checksum manifest in either GNU or BSD tag format, which may be mixed.
+// GNU lines do not name their algorithm: alg is used if provided, otherwise the algorithm is inferred from the length
+// of the encoded hash among the SHA family.
+func ParseManifest(reader io.Reader, alg Algorithm) (*Manifest, error) {
+	manifest := &Manifest{}
+	scanner := bufio.NewScanner(reader)
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entry, err := parseManifestLine(line, alg)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+	}
+
+	return manifest, nil
+}
+
+// Encode writes the manifest to writer in the requested format.
+func (m *Manifest) Encode(writer io.Writer, format ManifestFormat) error {
+	buffered := bufio.NewWriter(writer)
+
+	for _, entry := range m.Entries {
+		escaped, name := escapeManifestPath(entry.Path)
+
+		switch format {
+		case FormatGNU:
+			_, _ = fmt.Fprintf(buffered, "%s%s  %s\n", escaped, entry.Digest.Encoded(), name)
+		case FormatBSD:
+			tag, ok := bsdTags[entry.Digest.Algorithm()]
+			if !ok {
+				return fmt.Errorf("%w: no BSD tag for algorithm %s", fault.ErrInvalidArgument, entry.Digest.Algorithm())
+			}
+
+			_, _ = fmt.Fprintf(buffered, "%s%s (%s) = %s\n", escaped, tag, name, entry.Digest.Encoded())
+		default:
+			return fmt.Errorf("%w: unknown manifest format %d", fault.ErrInvalidArgument, format)
+		}
+	}
+
+	if err := buffered.Flush(); err != nil {
+		return fmt.Errorf("%w: %w", fault.ErrWriteFailure, err)
+	}
+
+	return nil
+}
+
+// Get returns the digest recorded for path, if any.
+func (m *Manifest) Get(path string) (Digest, bool) {
+	for _, entry := range m.Entries {
+		if entry.Path == cleanManifestPath(path) {
+			return entry.Digest, true
+		}
+	}
+
+	return Digest{}, false
+}
+
+// FromSRI parses a single Subresource Integrity hash expression ("sha256-<base64>"), ignoring any option suffix.
+func FromSRI(expression string) (Digest, error) {
+	expression, _, _ = strings.Cut(strings.TrimSpace(expression), "?")
+
+	before, after, ok := strings.Cut(expression, "-")
+	if !ok {
+		return Digest{}, fmt.Errorf("%w: integrity %q has no dash", fault.ErrInvalidArgument, expression)
+	}
+
+	alg := Algorithm(before)
+	if !slices.Contains(sriAlgorithms, alg) {
+		return Digest{}, fmt.Errorf("%w: integrity %q has unsupported algorithm", fault.ErrInvalidArgument, expression)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(after)
+	if err != nil {
+		return Digest{}, fmt.Errorf("%w: integrity %q is not valid base64: %w", fault.ErrInvalidArgument, expression, err)
+	}
+
+	return FromString(string(alg) + ":" + hex.EncodeToString(raw))
+}
+
+// ParseSRI parses Subresource Integrity metadata, a whitespace separated list of hash expressions.
+// As mandated by the specification, expressions using unsupported algorithms are ignored.
+func ParseSRI(metadata string) (Set, error) {
+	var digests []Digest
+
+	for expression := range strings.FieldsSeq(metadata) {
+		dgst, err := FromSRI(expression)
+		if err != nil {
+			continue
+		}
+
+		digests = append(digests, dgst)
+	}
+
+	if len(digests) == 0 {
+		return Set{}, fmt.Errorf("%w: no supported hash in integrity %q", fault.ErrInvalidArgument, metadata)
+	}
+
+	return NewSet(digests...)
+}
+
+// ToSRI returns the Subresource Integrity expression for dgst.
+func ToSRI(dgst Digest) (string, error) {
+	if !slices.Contains(sriAlgorithms, dgst.Algorithm()) {
+		return "", fmt.Errorf("%w: algorithm %s is not allowed in integrity", fault.ErrInvalidArgument, dgst.Algorithm())
+	}
+
+	raw, err := hex.DecodeString(dgst.Encoded())
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", fault.ErrInvalidArgument, err)
+	}
+
+	return string(dgst.Algorithm()) + "-" + base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// TreeReport lists the discrepancies between a directory and a manifest. Paths are slash-separated and relative.
+type TreeReport struct {
+	// Missing lists files present in the manifest but not on disk.
+	Missing []string
+	// Extra lists files present on disk but not in the manifest.
+	Extra []string
+	// Mismatched lists files whose content disagrees with the manifest.
+	Mismatched []string
+}
+
+// Err returns an error wrapping fault.ErrHashMismatch if files mismatched, and fault.ErrNotFound if files are missing.
+// Extra files are not considered an error.
+func (r *TreeReport) Err() error {
+	var errs []error
+
+	if len(r.Mismatched) > 0 {
+		errs = append(errs, fmt.Errorf("%w: %s", fault.ErrHashMismatch, strings.Join(r.Mismatched, ", ")))
+	}
+
+	if len(r.Missing) > 0 {
+		errs = append(errs, fmt.Errorf("%w: %s", fault.ErrNotFound, strings.Join(r.Missing, ", ")))
+	}
+
+	return errors.Join(errs...)
+}
+
+// VerifyTree walks root and checks every regular file against manifest.
+// The returned error only reports failures to walk or read the tree, or a manifest relying on algorithms that are not
+// cryptographically secure: discrepancies are listed in the report, see TreeReport.Err.
+func VerifyTree(root string, manifest *Manifest) (*TreeReport, error) {
+	for _, entry := range manifest.Entries {
+		if !entry.Digest.Algorithm().Secure() {
+			return nil, fmt.Errorf("%w: algorithm %s cannot be used to verify %s",
+				fault.ErrInvalidArgument, entry.Digest.Algorithm(), entry.Path)
+		}
+	}
+
+	report := &TreeReport{}
+	onDisk := map[string]bool{}
+
+	err := filepath.WalkDir(root, func(current string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, current)
+		if err != nil {
+			return err
+		}
+
+		onDisk[filepath.ToSlash(rel)] = true
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	listed := map[string]bool{}
+
+	for _, entry := range manifest.Entries {
+		listed[entry.Path] = true
+
+		if !onDisk[entry.Path] {
+			report.Missing = append(report.Missing, entry.Path)
+
+			continue
+		}
+
+		matches, err := fileMatches(filepath.Join(root, filepath.FromSlash(entry.Path)), entry.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		if !matches {
+			report.Mismatched = append(report.Mismatched, entry.Path)
+		}
+	}
+
+	for name := range onDisk {
+		if !listed[name] {
+			report.Extra = append(report.Extra, name)
+		}
+	}
+
+	slices.Sort(report.Extra)
+
+	return report, nil
+}
+
+func parseManifestLine(line string, alg Algorithm) (ManifestEntry, error) {
+	escaped := strings.HasPrefix(line, "\\")
+	if escaped {
+		line = line[1:]
+	}
+
+	var (
+		name     string
+		encoded  string
+		resolved Algorithm
+	)
+
+	if tag, rest, ok := strings.Cut(line, " ("); ok && !strings.Contains(tag, " ") {
+		// BSD tag: "TAG (path) = encoded"
+		index := strings.LastIndex(rest, ") = ")
+		if index < 0 {
+			return ManifestEntry{}, fmt.Errorf("%w: malformed tagged line %q", fault.ErrInvalidArgument, line)
+		}
+
+		name, encoded = rest[:index], rest[index+len(") = "):]
+
+		for candidate, candidateTag := range bsdTags {
+			if candidateTag == tag {
+				resolved = candidate
+			}
+		}
+
+		if resolved == "" {
+			return ManifestEntry{}, fmt.Errorf("%w: unknown tag %q", fault.ErrInvalidArgument, tag)
+		}
+	} else {
+		// GNU: "encoded  path" (text mode) or "encoded *path" (binary mode)
+		var found bool
+
+		encoded, name, found = strings.Cut(line, " ")
+		if !found || name == "" || (name[0] != ' ' && name[0] != '*') {
+			return ManifestEntry{}, fmt.Errorf("%w: malformed line %q", fault.ErrInvalidArgument, line)
+		}
+
+		name = name[1:]
+
+		resolved = alg
+		if resolved == "" {
+			resolved = gnuLengths[len(encoded)]
+		}
+
+		if resolved == "" {
+			return ManifestEntry{}, fmt.Errorf("%w: cannot infer algorithm for %q", fault.ErrInvalidArgument, line)
+		}
+	}
+
+	if escaped {
+		name = unescapeManifestPath(name)
+	}
+
+	dgst, err := FromString(string(resolved) + ":" + strings.ToLower(encoded))
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+
+	return ManifestEntry{Path: cleanManifestPath(name), Digest: dgst}, nil
+}
+
+// escapeManifestPath follows coreutils: names containing a backslash or a newline are escaped, and the line is then
+// prefixed with a backslash.
+func escapeManifestPath(name string) (prefix, escaped string) {
+	if !strings.ContainsAny(name, "\\\n") {
+		return "", name
+	}
+
+	return "\\", strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+}
+
+func unescapeManifestPath(name string) string {
+	return strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(name)
+}
+
+func cleanManifestPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+func fileMatches(name string, expected Digest) (bool, error) {
+	file, err := os.Open(name) //nolint:gosec // Path is derived from the manifest, relative to the verified root
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	actual, err := FromReader(expected.Algorithm(), file)
+	if err != nil {
+		return false, err
+	}
+
+	return actual.Equal(expected), nil
+}
@@ -0,0 +1,212 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package digest_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mycophonic/primordium/digest"
+	"github.com/mycophonic/primordium/fault"
+)
+
+const helloEncoded = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+func TestParseManifest_Formats(t *testing.T) {
+	t.Parallel()
+
+	input := strings.Join([]string{
+		"# comment",
+		helloEncoded + "  text.txt",
+		helloEncoded + " *bin/binary.wav",
+		"SHA256 (./tagged.flac) = " + helloEncoded,
+		"\\" + helloEncoded + "  back\\\\slash",
+		"",
+	}, "\n")
+
+	manifest, err := digest.ParseManifest(strings.NewReader(input), "")
+	if err != nil {
+		t.Fatalf("ParseManifest returned error: %v", err)
+	}
+
+	wantPaths := []string{"text.txt", "bin/binary.wav", "tagged.flac", "back\\slash"}
+	if len(manifest.Entries) != len(wantPaths) {
+		t.Fatalf("got %d entries, want %d", len(manifest.Entries), len(wantPaths))
+	}
+
+	for i, entry := range manifest.Entries {
+		if entry.Path != wantPaths[i] {
+			t.Errorf("entry %d path = %q, want %q", i, entry.Path, wantPaths[i])
+		}
+
+		if entry.Digest.String() != helloSHA256 {
+			t.Errorf("entry %d digest = %q, want %q", i, entry.Digest, helloSHA256)
+		}
+	}
+}
+
+func TestParseManifest_Invalid(t *testing.T) {
+	t.Parallel()
+
+	for _, input := range []string{
+		"nonsense",
+		"MD5 (file) = d41d8cd98f00b204e9800998ecf8427e",
+		"abcdef  too-short-to-infer",
+	} {
+		if _, err := digest.ParseManifest(strings.NewReader(input), ""); !errors.Is(err, fault.ErrInvalidArgument) {
+			t.Errorf("ParseManifest(%q): expected ErrInvalidArgument, got: %v", input, err)
+		}
+	}
+}
+
+func TestManifest_EncodeGNU(t *testing.T) {
+	t.Parallel()
+
+	manifest := &digest.Manifest{Entries: []digest.ManifestEntry{
+		{Path: "a.txt", Digest: digest.FromBytes(digest.SHA256, []byte("hello"))},
+		{Path: "new\nline", Digest: digest.FromBytes(digest.SHA256, []byte("hello"))},
+	}}
+
+	var buf bytes.Buffer
+
+	if err := manifest.Encode(&buf, digest.FormatGNU); err != nil {
+		t.Fatalf("Encode returned error: %v", err)
+	}
+
+	want := helloEncoded + "  a.txt\n" + "\\" + helloEncoded + "  new\\nline\n"
+	if buf.String() != want {
+		t.Errorf("Encode = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestManifest_EncodeBSDRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	manifest := &digest.Manifest{Entries: []digest.ManifestEntry{
+		{Path: "a.txt", Digest: digest.FromBytes(digest.SHA256, []byte("hello"))},
+		{Path: "dir/b.txt", Digest: digest.FromBytes(digest.BLAKE2b512, []byte("hello"))},
+	}}
+
+	var buf bytes.Buffer
+
+	if err := manifest.Encode(&buf, digest.FormatBSD); err != nil {
+		t.Fatalf("Encode returned error: %v", err)
+	}
+
+	parsed, err := digest.ParseManifest(&buf, "")
+	if err != nil {
+		t.Fatalf("ParseManifest returned error: %v", err)
+	}
+
+	if len(parsed.Entries) != len(manifest.Entries) {
+		t.Fatalf("got %d entries, want %d", len(parsed.Entries), len(manifest.Entries))
+	}
+
+	for i, entry := range parsed.Entries {
+		want := manifest.Entries[i]
+		if entry.Path != want.Path || entry.Digest.String() != want.Digest.String() {
+			t.Errorf("entry %d = %v, want %v", i, entry, want)
+		}
+	}
+}
+
+func TestSRI(t *testing.T) {
+	t.Parallel()
+
+	const integrity = "sha256-LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="
+
+	dgst, err := digest.FromSRI(integrity)
+	if err != nil {
+		t.Fatalf("FromSRI returned error: %v", err)
+	}
+
+	if dgst.String() != helloSHA256 {
+		t.Errorf("FromSRI = %q, want %q", dgst, helloSHA256)
+	}
+
+	back, err := digest.ToSRI(dgst)
+	if err != nil || back != integrity {
+		t.Errorf("ToSRI = %q, %v, want %q", back, err, integrity)
+	}
+
+	set, err := digest.ParseSRI("md5-ignored " + integrity + "?ct=audio/flac")
+	if err != nil {
+		t.Fatalf("ParseSRI returned error: %v", err)
+	}
+
+	if set.Len() != 1 {
+		t.Errorf("ParseSRI kept %d digests, want 1", set.Len())
+	}
+
+	if _, err = digest.ToSRI(digest.FromBytes(digest.SHA1, nil)); !errors.Is(err, fault.ErrInvalidArgument) {
+		t.Errorf("ToSRI(sha1): expected ErrInvalidArgument, got: %v", err)
+	}
+}
+
+func TestVerifyTree(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range map[string]string{
+		"good.txt":     "hello",
+		"sub/bad.txt":  "tampered",
+		"unlisted.txt": "extra",
+	} {
+		if err := os.WriteFile(filepath.Join(root, filepath.FromSlash(name)), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest, err := digest.ParseManifest(strings.NewReader(strings.Join([]string{
+		helloEncoded + "  good.txt",
+		helloEncoded + "  sub/bad.txt",
+		helloEncoded + "  missing.txt",
+	}, "\n")), digest.SHA256)
+	if err != nil {
+		t.Fatalf("ParseManifest returned error: %v", err)
+	}
+
+	report, err := digest.VerifyTree(root, manifest)
+	if err != nil {
+		t.Fatalf("VerifyTree returned error: %v", err)
+	}
+
+	if strings.Join(report.Mismatched, ",") != "sub/bad.txt" {
+		t.Errorf("Mismatched = %v", report.Mismatched)
+	}
+
+	if strings.Join(report.Missing, ",") != "missing.txt" {
+		t.Errorf("Missing = %v", report.Missing)
+	}
+
+	if strings.Join(report.Extra, ",") != "unlisted.txt" {
+		t.Errorf("Extra = %v", report.Extra)
+	}
+
+	if err = report.Err(); !errors.Is(err, fault.ErrHashMismatch) || !errors.Is(err, fault.ErrNotFound) {
+		t.Errorf("Err() = %v, want ErrHashMismatch and ErrNotFound", err)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package digest
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+
+	"github.com/mycophonic/primordium/fault"
+)
+
+// MarshalText implements encoding.TextMarshaler. The zero value marshals to an empty text.
+func (d Digest) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. An empty text unmarshals to the zero value.
+func (d *Digest) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*d = Digest{}
+
+		return nil
+	}
+
+	parsed, err := FromString(string(text))
+	if err != nil {
+		return err
+	}
+
+	*d = parsed
+
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, encoding the digest as a JSON string.
+func (d Digest) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(d.String())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrInvalidJSON, err)
+	}
+
+	return data, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Both null and an empty string unmarshal to the zero value.
+func (d *Digest) UnmarshalJSON(data []byte) error {
+	var text *string
+
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("%w: %w", fault.ErrInvalidJSON, err)
+	}
+
+	if text == nil {
+		*d = Digest{}
+
+		return nil
+	}
+
+	return d.UnmarshalText([]byte(*text))
+}
+
+// Value implements driver.Valuer. The zero value is stored as NULL.
+func (d Digest) Value() (driver.Value, error) {
+	if d.IsZero() {
+		return nil, nil //nolint:nilnil // NULL is the expected representation of the zero value
+	}
+
+	return d.String(), nil
+}
+
+// Scan implements sql.Scanner, accepting strings, byte slices and NULL.
+func (d *Digest) Scan(src any) error {
+	switch value := src.(type) {
+	case nil:
+		*d = Digest{}
+
+		return nil
+	case string:
+		return d.UnmarshalText([]byte(value))
+	case []byte:
+		return d.UnmarshalText(value)
+	default:
+		return fmt.Errorf("%w: cannot scan %T into a digest", fault.ErrInvalidArgument, src)
+	}
+}
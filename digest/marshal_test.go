@@ -0,0 +1,141 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package digest_test
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/mycophonic/primordium/digest"
+	"github.com/mycophonic/primordium/fault"
+)
+
+//nolint:gochecknoglobals // Interface compliance checks
+var (
+	_ encoding.TextMarshaler   = digest.Digest{}
+	_ encoding.TextUnmarshaler = (*digest.Digest)(nil)
+	_ json.Marshaler           = digest.Digest{}
+	_ json.Unmarshaler         = (*digest.Digest)(nil)
+)
+
+func TestDigest_Comparable(t *testing.T) {
+	t.Parallel()
+
+	a := digest.MustParse(helloSHA256)
+	b := digest.FromBytes(digest.SHA256, []byte("hello"))
+
+	if a != b || !a.Equal(b) {
+		t.Errorf("digests of the same content should be equal: %v, %v", a, b)
+	}
+
+	seen := map[digest.Digest]bool{a: true}
+	if !seen[b] {
+		t.Error("digest should be usable as a map key")
+	}
+
+	if a.Equal(digest.MustParse(emptySHA256)) {
+		t.Error("digests of different content should differ")
+	}
+
+	if !(digest.Digest{}).IsZero() || a.IsZero() {
+		t.Error("IsZero() mismatch")
+	}
+}
+
+func TestMustParse_Panics(t *testing.T) {
+	t.Parallel()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("MustParse should panic on invalid input")
+		}
+	}()
+
+	digest.MustParse("sha256:invalid")
+}
+
+func TestDigest_JSON(t *testing.T) {
+	t.Parallel()
+
+	type config struct {
+		Artifact digest.Digest `json:"artifact"`
+		Optional digest.Digest `json:"optional"`
+	}
+
+	original := config{Artifact: digest.MustParse(helloSHA256)}
+
+	data, err := json.Marshal(original)
+	if err != nil {
+		t.Fatalf("Marshal returned error: %v", err)
+	}
+
+	want := `{"artifact":"` + helloSHA256 + `","optional":""}`
+	if string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+
+	var decoded config
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal returned error: %v", err)
+	}
+
+	if decoded != original {
+		t.Errorf("round-trip = %+v, want %+v", decoded, original)
+	}
+
+	if err = json.Unmarshal([]byte(`{"artifact":null}`), &decoded); err != nil || !decoded.Artifact.IsZero() {
+		t.Errorf("null should unmarshal to the zero digest, got %v, %v", decoded.Artifact, err)
+	}
+
+	err = json.Unmarshal([]byte(`{"artifact":"md5:abc"}`), &decoded)
+	if !errors.Is(err, fault.ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got: %v", err)
+	}
+}
+
+func TestDigest_SQL(t *testing.T) {
+	t.Parallel()
+
+	original := digest.MustParse(helloSHA256)
+
+	value, err := original.Value()
+	if err != nil || value != helloSHA256 {
+		t.Fatalf("Value() = %v, %v", value, err)
+	}
+
+	var scanned digest.Digest
+
+	for _, src := range []any{helloSHA256, []byte(helloSHA256)} {
+		if err = scanned.Scan(src); err != nil || scanned != original {
+			t.Errorf("Scan(%T) = %v, %v", src, scanned, err)
+		}
+	}
+
+	if err = scanned.Scan(nil); err != nil || !scanned.IsZero() {
+		t.Errorf("Scan(nil) = %v, %v", scanned, err)
+	}
+
+	if value, err = scanned.Value(); err != nil || value != nil {
+		t.Errorf("zero Value() = %v, %v, want nil", value, err)
+	}
+
+	if err = scanned.Scan(42); !errors.Is(err, fault.ErrInvalidArgument) {
+		t.Errorf("Scan(int): expected ErrInvalidArgument, got: %v", err)
+	}
+}
@@ -0,0 +1,344 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package digest
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"runtime"
+	"sync"
+
+	"github.com/mycophonic/primordium/fault"
+)
+
+// The tree follows RFC 6962 (section 2.1): leaves and interior nodes are hashed with distinct prefixes, so that a
+// leaf can never be passed off as a node.
+const (
+	merkleLeafPrefix byte = 0x00
+	merkleNodePrefix byte = 0x01
+)
+
+// MerkleTree holds the chunk hashes of some content, allowing verification chunk by chunk.
+//
+// The root is a Digest labelled with the hashing algorithm, but it is NOT the digest of the content itself: it can
+// only be compared with another Merkle root computed with the same algorithm and chunk size.
+type MerkleTree struct {
+	algorithm Algorithm
+	chunkSize int64
+	size      int64
+	leaves    [][]byte
+	root      []byte
+}
+
+// MerkleProof is the audit path proving that a chunk belongs to a tree with a given root.
+type MerkleProof struct {
+	Algorithm Algorithm
+	// Index is the position of the chunk in the tree.
+	Index int
+	// Leaves is the total number of chunks in the tree.
+	Leaves int
+	// Path holds the sibling hashes, from the leaf level up to the root.
+	Path [][]byte
+}
+
+// ComputeMerkle reads reader sequentially, hashing it in chunks of chunkSize bytes.
+func ComputeMerkle(reader io.Reader, alg Algorithm, chunkSize int64) (*MerkleTree, error) {
+	if err := validateMerkle(alg, chunkSize); err != nil {
+		return nil, err
+	}
+
+	tree := &MerkleTree{algorithm: alg, chunkSize: chunkSize}
+	buf := make([]byte, chunkSize)
+
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			tree.leaves = append(tree.leaves, tree.hashLeaf(buf[:n]))
+			tree.size += int64(n)
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+		}
+	}
+
+	tree.root = tree.subtree(0, len(tree.leaves))
+
+	return tree, nil
+}
+
+// ComputeMerkleAt hashes the first size bytes of reader in chunks of chunkSize bytes, using up to workers goroutines.
+// If workers is zero or negative, GOMAXPROCS is used.
+func ComputeMerkleAt(
+	ctx context.Context,
+	reader io.ReaderAt,
+	size int64,
+	alg Algorithm,
+	chunkSize int64,
+	workers int,
+) (*MerkleTree, error) {
+	if err := validateMerkle(alg, chunkSize); err != nil {
+		return nil, err
+	}
+
+	if size < 0 {
+		return nil, fmt.Errorf("%w: negative size %d", fault.ErrInvalidArgument, size)
+	}
+
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	tree := &MerkleTree{algorithm: alg, chunkSize: chunkSize, size: size}
+	tree.leaves = make([][]byte, (size+chunkSize-1)/chunkSize)
+	indexes := make(chan int)
+
+	var (
+		waitGroup sync.WaitGroup
+		errOnce   sync.Once
+		firstErr  error
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for range min(workers, len(tree.leaves)) {
+		waitGroup.Go(func() {
+			buf := make([]byte, chunkSize)
+
+			for index := range indexes {
+				offset := int64(index) * chunkSize
+				chunk := buf[:min(chunkSize, size-offset)]
+
+				n, err := reader.ReadAt(chunk, offset)
+				if n == len(chunk) && errors.Is(err, io.EOF) {
+					err = nil
+				} else if err == nil && n < len(chunk) {
+					err = io.ErrUnexpectedEOF
+				}
+
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = fmt.Errorf("%w: chunk %d: %w", fault.ErrReadFailure, index, err)
+					})
+					cancel()
+
+					continue
+				}
+
+				tree.leaves[index] = tree.hashLeaf(chunk)
+			}
+		})
+	}
+
+feed:
+	for index := range tree.leaves {
+		select {
+		case indexes <- index:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+
+	close(indexes)
+	waitGroup.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrCancelled, err)
+	}
+
+	tree.root = tree.subtree(0, len(tree.leaves))
+
+	return tree, nil
+}
+
+// Root returns the Merkle root of the tree.
+func (t *MerkleTree) Root() Digest {
+	return Digest{algorithm: t.algorithm, encoded: hex.EncodeToString(t.root)}
+}
+
+// Algorithm returns the algorithm used to build the tree.
+func (t *MerkleTree) Algorithm() Algorithm {
+	return t.algorithm
+}
+
+// ChunkSize returns the size of the chunks. The last chunk may be shorter.
+func (t *MerkleTree) ChunkSize() int64 {
+	return t.chunkSize
+}
+
+// Size returns the total size of the hashed content.
+func (t *MerkleTree) Size() int64 {
+	return t.size
+}
+
+// Leaves returns the number of chunks.
+func (t *MerkleTree) Leaves() int {
+	return len(t.leaves)
+}
+
+// Proof returns the audit path for the chunk at index.
+func (t *MerkleTree) Proof(index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(t.leaves) {
+		return nil, fmt.Errorf("%w: chunk %d out of range [0, %d)", fault.ErrInvalidArgument, index, len(t.leaves))
+	}
+
+	return &MerkleProof{
+		Algorithm: t.algorithm,
+		Index:     index,
+		Leaves:    len(t.leaves),
+		Path:      t.path(index, 0, len(t.leaves)),
+	}, nil
+}
+
+// VerifyChunk checks chunk against the recorded hash of the chunk at index. This is meant to validate partial content,
+// for example before resuming a download.
+func (t *MerkleTree) VerifyChunk(index int, chunk []byte) error {
+	if index < 0 || index >= len(t.leaves) {
+		return fmt.Errorf("%w: chunk %d out of range [0, %d)", fault.ErrInvalidArgument, index, len(t.leaves))
+	}
+
+	if !t.algorithm.Secure() {
+		return fmt.Errorf("%w: algorithm %s cannot be used to verify content", fault.ErrInvalidArgument, t.algorithm)
+	}
+
+	if !bytes.Equal(t.hashLeaf(chunk), t.leaves[index]) {
+		return fmt.Errorf("%w: chunk %d", fault.ErrHashMismatch, index)
+	}
+
+	return nil
+}
+
+// Verify checks that chunk belongs to a tree with the given root, at the position described by the proof.
+// Returns an error wrapping fault.ErrHashMismatch if it does not.
+func (p *MerkleProof) Verify(root Digest, chunk []byte) error {
+	if p.Algorithm != root.Algorithm() || !p.Algorithm.Secure() {
+		return fmt.Errorf("%w: algorithm %s cannot be used to verify a %s root",
+			fault.ErrInvalidArgument, p.Algorithm, root.Algorithm())
+	}
+
+	if p.Index < 0 || p.Index >= p.Leaves {
+		return fmt.Errorf("%w: chunk %d out of range [0, %d)", fault.ErrInvalidArgument, p.Index, p.Leaves)
+	}
+
+	tree := &MerkleTree{algorithm: p.Algorithm}
+	computed := tree.hashLeaf(chunk)
+
+	// RFC 9162, section 2.1.3.2.
+	index, last := p.Index, p.Leaves-1
+
+	for _, sibling := range p.Path {
+		if last == 0 {
+			return fmt.Errorf("%w: proof for chunk %d is too long", fault.ErrHashMismatch, p.Index)
+		}
+
+		if index&1 == 1 || index == last {
+			computed = tree.hashNode(sibling, computed)
+
+			for index&1 == 0 && index != 0 {
+				index >>= 1
+				last >>= 1
+			}
+		} else {
+			computed = tree.hashNode(computed, sibling)
+		}
+
+		index >>= 1
+		last >>= 1
+	}
+
+	if last != 0 || hex.EncodeToString(computed) != root.Encoded() {
+		return fmt.Errorf("%w: chunk %d does not belong to root %s", fault.ErrHashMismatch, p.Index, root)
+	}
+
+	return nil
+}
+
+// subtree returns the hash of the leaves in [start, end), as defined by RFC 6962.
+func (t *MerkleTree) subtree(start, end int) []byte {
+	switch end - start {
+	case 0:
+		return t.algorithm.Hash().Sum(nil)
+	case 1:
+		return t.leaves[start]
+	default:
+		split := start + splitPoint(end-start)
+
+		return t.hashNode(t.subtree(start, split), t.subtree(split, end))
+	}
+}
+
+// path returns the audit path for leaf index within the leaves in [start, end), as defined by RFC 6962.
+func (t *MerkleTree) path(index, start, end int) [][]byte {
+	if end-start <= 1 {
+		return nil
+	}
+
+	split := start + splitPoint(end-start)
+	if index < split {
+		return append(t.path(index, start, split), t.subtree(split, end))
+	}
+
+	return append(t.path(index, split, end), t.subtree(start, split))
+}
+
+func (t *MerkleTree) hashLeaf(chunk []byte) []byte {
+	hasher := t.algorithm.Hash()
+	_, _ = hasher.Write([]byte{merkleLeafPrefix})
+	_, _ = hasher.Write(chunk)
+
+	return hasher.Sum(nil)
+}
+
+func (t *MerkleTree) hashNode(left, right []byte) []byte {
+	hasher := t.algorithm.Hash()
+	_, _ = hasher.Write([]byte{merkleNodePrefix})
+	_, _ = hasher.Write(left)
+	_, _ = hasher.Write(right)
+
+	return hasher.Sum(nil)
+}
+
+// splitPoint returns the largest power of two strictly smaller than count.
+func splitPoint(count int) int {
+	return 1 << (bits.Len(uint(count-1)) - 1)
+}
+
+func validateMerkle(alg Algorithm, chunkSize int64) error {
+	if !alg.Available() {
+		return fmt.Errorf("%w: unknown algorithm %s", fault.ErrInvalidArgument, alg)
+	}
+
+	if chunkSize <= 0 {
+		return fmt.Errorf("%w: chunk size must be positive, got %d", fault.ErrInvalidArgument, chunkSize)
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package digest_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/mycophonic/primordium/digest"
+	"github.com/mycophonic/primordium/fault"
+)
+
+func TestComputeMerkle_TwoChunks(t *testing.T) {
+	t.Parallel()
+
+	tree, err := digest.ComputeMerkle(bytes.NewReader([]byte("abcdef")), digest.SHA256, 4)
+	if err != nil {
+		t.Fatalf("ComputeMerkle returned error: %v", err)
+	}
+
+	left := sha256.Sum256([]byte("\x00abcd"))
+	right := sha256.Sum256([]byte("\x00ef"))
+	root := sha256.Sum256(append(append([]byte{0x01}, left[:]...), right[:]...))
+
+	if want := "sha256:" + hex.EncodeToString(root[:]); tree.Root().String() != want {
+		t.Errorf("Root() = %q, want %q", tree.Root(), want)
+	}
+
+	if tree.Leaves() != 2 || tree.Size() != 6 || tree.ChunkSize() != 4 {
+		t.Errorf("Leaves() = %d, Size() = %d, ChunkSize() = %d", tree.Leaves(), tree.Size(), tree.ChunkSize())
+	}
+}
+
+func TestComputeMerkleAt_MatchesSequential(t *testing.T) {
+	t.Parallel()
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+
+	for _, chunkSize := range []int64{1024, 1000, 7, int64(len(content)), int64(len(content)) * 2} {
+		sequential, err := digest.ComputeMerkle(bytes.NewReader(content), digest.SHA256, chunkSize)
+		if err != nil {
+			t.Fatalf("ComputeMerkle returned error: %v", err)
+		}
+
+		parallel, err := digest.ComputeMerkleAt(
+			context.Background(), bytes.NewReader(content), int64(len(content)), digest.SHA256, chunkSize, 4)
+		if err != nil {
+			t.Fatalf("ComputeMerkleAt returned error: %v", err)
+		}
+
+		if sequential.Root() != parallel.Root() {
+			t.Errorf("chunk size %d: parallel root %q, sequential root %q", chunkSize, parallel.Root(), sequential.Root())
+		}
+	}
+}
+
+func TestComputeMerkleAt_ShortReader(t *testing.T) {
+	t.Parallel()
+
+	_, err := digest.ComputeMerkleAt(context.Background(), bytes.NewReader([]byte("short")), 100, digest.SHA256, 4, 2)
+	if !errors.Is(err, fault.ErrReadFailure) {
+		t.Errorf("expected ErrReadFailure, got: %v", err)
+	}
+}
+
+func TestMerkleProof_AllLeaves(t *testing.T) {
+	t.Parallel()
+
+	for leaves := 1; leaves <= 17; leaves++ {
+		content := bytes.Repeat([]byte{byte(leaves)}, leaves*3)
+
+		tree, err := digest.ComputeMerkle(bytes.NewReader(content), digest.SHA256, 3)
+		if err != nil {
+			t.Fatalf("ComputeMerkle returned error: %v", err)
+		}
+
+		for index := range leaves {
+			proof, err := tree.Proof(index)
+			if err != nil {
+				t.Fatalf("Proof(%d) returned error: %v", index, err)
+			}
+
+			chunk := content[index*3 : index*3+3]
+
+			if err = proof.Verify(tree.Root(), chunk); err != nil {
+				t.Errorf("%d leaves: proof for chunk %d failed: %v", leaves, index, err)
+			}
+
+			if err = proof.Verify(tree.Root(), []byte("bad")); !errors.Is(err, fault.ErrHashMismatch) {
+				t.Errorf("%d leaves: tampered chunk %d: expected ErrHashMismatch, got: %v", leaves, index, err)
+			}
+
+			if err = tree.VerifyChunk(index, chunk); err != nil {
+				t.Errorf("VerifyChunk(%d) returned error: %v", index, err)
+			}
+		}
+	}
+}
+
+func TestMerkleTree_VerifyChunkMismatch(t *testing.T) {
+	t.Parallel()
+
+	tree, err := digest.ComputeMerkle(bytes.NewReader([]byte("abcdefgh")), digest.SHA256, 4)
+	if err != nil {
+		t.Fatalf("ComputeMerkle returned error: %v", err)
+	}
+
+	if err = tree.VerifyChunk(1, []byte("abcd")); !errors.Is(err, fault.ErrHashMismatch) {
+		t.Errorf("expected ErrHashMismatch, got: %v", err)
+	}
+
+	if err = tree.VerifyChunk(2, []byte("abcd")); !errors.Is(err, fault.ErrInvalidArgument) {
+		t.Errorf("out of range: expected ErrInvalidArgument, got: %v", err)
+	}
+}
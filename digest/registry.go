@@ -0,0 +1,156 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package digest
+
+import (
+	"crypto"
+	_ "crypto/sha1" //nolint:gosec // SHA1 needed for legacy git compatibility
+	_ "crypto/sha256"
+	"crypto/sha3"
+	_ "crypto/sha512"
+	"fmt"
+	"hash"
+	"regexp"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/blake2s"
+
+	"github.com/mycophonic/primordium/fault"
+)
+
+//nolint:gochecknoglobals // Package-level registry is appropriate here
+var (
+	// registry maps algorithms to their constructor and encoded form.
+	registry = map[Algorithm]registration{
+		SHA1:       newRegistration(crypto.SHA1.New, 40, false),
+		SHA256:     newRegistration(crypto.SHA256.New, 64, true),
+		SHA384:     newRegistration(crypto.SHA384.New, 96, true),
+		SHA512:     newRegistration(crypto.SHA512.New, 128, true),
+		SHA3_256:   newRegistration(newSHA3256, 64, true),
+		SHA3_512:   newRegistration(newSHA3512, 128, true),
+		BLAKE2b256: newRegistration(newBLAKE2b256, 64, true),
+		BLAKE2b512: newRegistration(newBLAKE2b512, 128, true),
+		BLAKE2s256: newRegistration(newBLAKE2s256, 64, true),
+		XXH64:      newRegistration(newXXH64, 16, false),
+	}
+	registryMu sync.RWMutex
+
+	// algorithmNameRegexp restricts algorithm names, so that they are safe to use in "algorithm:encoded" strings and
+	// as path components.
+	algorithmNameRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*$`)
+)
+
+type registration struct {
+	constructor func() hash.Hash
+	// anchoredEncodedRegexp matches the hex-encoded digest.
+	// Note that /A-F/ disallowed.
+	anchoredEncodedRegexp *regexp.Regexp
+	secure                bool
+}
+
+// Register makes a cryptographically secure algorithm available to the package.
+// encodedLength is the length of the hex-encoded digest, and must match the size of the hashes built by constructor.
+// Registering an algorithm that already exists is an error.
+func Register(alg Algorithm, constructor func() hash.Hash, encodedLength int) error {
+	return register(alg, constructor, encodedLength, true)
+}
+
+// RegisterNonCryptographic makes a non-cryptographic algorithm available to the package.
+// Such algorithms can compute and parse digests, but are refused wherever content is verified, so that they never
+// stand in for an integrity check.
+func RegisterNonCryptographic(alg Algorithm, constructor func() hash.Hash, encodedLength int) error {
+	return register(alg, constructor, encodedLength, false)
+}
+
+func register(alg Algorithm, constructor func() hash.Hash, encodedLength int, secure bool) error {
+	if !algorithmNameRegexp.MatchString(string(alg)) {
+		return fmt.Errorf("%w: invalid algorithm name %q", fault.ErrInvalidArgument, alg)
+	}
+
+	if constructor == nil {
+		return fmt.Errorf("%w: nil constructor for algorithm %s", fault.ErrInvalidArgument, alg)
+	}
+
+	if size := constructor().Size(); encodedLength != size*2 {
+		return fmt.Errorf("%w: encoded length %d does not match hash size %d for algorithm %s",
+			fault.ErrInvalidArgument, encodedLength, size, alg)
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := registry[alg]; ok {
+		return fmt.Errorf("%w: algorithm %s is already registered", fault.ErrInvalidArgument, alg)
+	}
+
+	registry[alg] = newRegistration(constructor, encodedLength, secure)
+
+	return nil
+}
+
+func lookup(alg Algorithm) (registration, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	reg, ok := registry[alg]
+
+	return reg, ok
+}
+
+func newRegistration(constructor func() hash.Hash, encodedLength int, secure bool) registration {
+	return registration{
+		constructor:           constructor,
+		anchoredEncodedRegexp: regexp.MustCompile(fmt.Sprintf("^[a-f0-9]{%d}$", encodedLength)),
+		secure:                secure,
+	}
+}
+
+func newSHA3256() hash.Hash {
+	return sha3.New256()
+}
+
+func newSHA3512() hash.Hash {
+	return sha3.New512()
+}
+
+func newBLAKE2b256() hash.Hash {
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		panic(err)
+	}
+
+	return h
+}
+
+func newBLAKE2b512() hash.Hash {
+	h, err := blake2b.New512(nil)
+	if err != nil {
+		panic(err)
+	}
+
+	return h
+}
+
+func newBLAKE2s256() hash.Hash {
+	h, err := blake2s.New256(nil)
+	if err != nil {
+		panic(err)
+	}
+
+	return h
+}
@@ -0,0 +1,136 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package digest_test
+
+import (
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mycophonic/primordium/digest"
+	"github.com/mycophonic/primordium/fault"
+)
+
+func TestRegister(t *testing.T) {
+	t.Parallel()
+
+	const alg digest.Algorithm = "test-register-sha256"
+
+	if err := digest.Register(alg, crypto.SHA256.New, 64); err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+
+	if !alg.Available() || !alg.Secure() {
+		t.Errorf("registered algorithm: Available() = %v, Secure() = %v", alg.Available(), alg.Secure())
+	}
+
+	dgst, err := digest.FromString(string(alg) + ":" + helloEncoded)
+	if err != nil {
+		t.Fatalf("FromString returned error: %v", err)
+	}
+
+	if got := digest.FromBytes(alg, []byte("hello")); got.Encoded() != dgst.Encoded() {
+		t.Errorf("FromBytes = %q, want %q", got.Encoded(), dgst.Encoded())
+	}
+
+	if err = digest.Register(alg, crypto.SHA256.New, 64); !errors.Is(err, fault.ErrInvalidArgument) {
+		t.Errorf("duplicate Register: expected ErrInvalidArgument, got: %v", err)
+	}
+}
+
+func TestRegister_Invalid(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		alg    digest.Algorithm
+		length int
+	}{
+		{"uppercase name", "SHA256-custom", 64},
+		{"colon in name", "sha:custom", 64},
+		{"empty name", "", 64},
+		{"wrong length", "test-register-wrong-length", 32},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if err := digest.Register(tt.alg, crypto.SHA256.New, tt.length); !errors.Is(err, fault.ErrInvalidArgument) {
+				t.Errorf("expected ErrInvalidArgument, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestXXH64_Vectors(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"":    "ef46db3751d8e999",
+		"abc": "44bc2cf5ad770999",
+		"The quick brown fox jumps over the lazy dog, twice: the quick brown fox jumps over the lazy dog": "a0a857380552a8e5",
+	}
+
+	for input, want := range tests {
+		got := digest.FromBytes(digest.XXH64, []byte(input)).Encoded()
+		if got != want {
+			t.Errorf("xxh64(%q) = %q, want %q", input, got, want)
+		}
+
+		// Streaming byte by byte must agree with one-shot hashing.
+		hasher := digest.XXH64.Hash()
+		for i := range len(input) {
+			if _, err := hasher.Write([]byte{input[i]}); err != nil {
+				t.Fatalf("Write returned error: %v", err)
+			}
+		}
+
+		if streamed := hex.EncodeToString(hasher.Sum(nil)); streamed != want {
+			t.Errorf("streamed xxh64(%q) = %q, want %q", input, streamed, want)
+		}
+	}
+}
+
+func TestNonCryptographic_RefusedForVerification(t *testing.T) {
+	t.Parallel()
+
+	if digest.XXH64.Secure() {
+		t.Fatal("xxh64 must not be flagged as secure")
+	}
+
+	if digest.SHA1.Secure() {
+		t.Fatal("sha1 must not be flagged as secure")
+	}
+
+	dgst := digest.FromBytes(digest.XXH64, []byte("hello"))
+
+	if _, err := digest.NewVerifier(dgst, strings.NewReader("hello")); !errors.Is(err, fault.ErrInvalidArgument) {
+		t.Errorf("NewVerifier(xxh64): expected ErrInvalidArgument, got: %v", err)
+	}
+
+	set, err := digest.NewSet(dgst)
+	if err != nil {
+		t.Fatalf("NewSet returned error: %v", err)
+	}
+
+	if err = set.Verify(strings.NewReader("hello")); !errors.Is(err, fault.ErrInvalidArgument) {
+		t.Errorf("Set.Verify(xxh64 only): expected ErrInvalidArgument, got: %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package digest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/mycophonic/primordium/fault"
+)
+
+// strength ranks algorithms from weakest to strongest, for display purposes.
+// Algorithms absent from this list rank below all of those present.
+//
+//nolint:gochecknoglobals // Package-level registry is appropriate here
+var strength = []Algorithm{
+	SHA1,
+	SHA256,
+	BLAKE2s256,
+	BLAKE2b256,
+	SHA3_256,
+	SHA384,
+	SHA512,
+	BLAKE2b512,
+	SHA3_512,
+}
+
+// MismatchError reports that the digest computed for a given algorithm disagrees with the expected one.
+// It wraps fault.ErrHashMismatch.
+type MismatchError struct {
+	Expected Digest
+	Actual   Digest
+}
+
+// Error implements error.
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("%s: %s expected %s, got %s",
+		fault.ErrHashMismatch, e.Expected.Algorithm(), e.Expected.Encoded(), e.Actual.Encoded())
+}
+
+// Unwrap returns fault.ErrHashMismatch.
+func (*MismatchError) Unwrap() error {
+	return fault.ErrHashMismatch
+}
+
+// Set holds at most one digest per algorithm for the same content.
+type Set struct {
+	digests map[Algorithm]Digest
+}
+
+// NewSet returns a Set holding the provided digests.
+// Providing two different digests for the same algorithm is an error.
+func NewSet(digests ...Digest) (Set, error) {
+	set := Set{digests: make(map[Algorithm]Digest, len(digests))}
+
+	for _, dgst := range digests {
+		if err := set.add(dgst); err != nil {
+			return Set{}, err
+		}
+	}
+
+	return set, nil
+}
+
+// ComputeSet reads reader once and computes the digest for each of the requested algorithms.
+func ComputeSet(reader io.Reader, algs ...Algorithm) (Set, error) {
+	if len(algs) == 0 {
+		return Set{}, fmt.Errorf("%w: no algorithm requested", fault.ErrInvalidArgument)
+	}
+
+	hashers := make(map[Algorithm]hash.Hash, len(algs))
+	writers := make([]io.Writer, 0, len(algs))
+
+	for _, alg := range algs {
+		if !alg.Available() {
+			return Set{}, fmt.Errorf("%w: unknown algorithm %s", fault.ErrInvalidArgument, alg)
+		}
+
+		if _, ok := hashers[alg]; ok {
+			continue
+		}
+
+		hashers[alg] = alg.Hash()
+		writers = append(writers, hashers[alg])
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), reader); err != nil {
+		return Set{}, fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+	}
+
+	set := Set{digests: make(map[Algorithm]Digest, len(hashers))}
+	for alg, hasher := range hashers {
+		set.digests[alg] = fromHash(alg, hasher)
+	}
+
+	return set, nil
+}
+
+// ParseSet parses a manifest holding one "algorithm:encoded" digest per line.
+// Empty lines and lines starting with # are ignored.
+func ParseSet(manifest string) (Set, error) {
+	set := Set{digests: map[Algorithm]Digest{}}
+	scanner := bufio.NewScanner(strings.NewReader(manifest))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		dgst, err := FromString(line)
+		if err != nil {
+			return Set{}, err
+		}
+
+		if err = set.add(dgst); err != nil {
+			return Set{}, err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return Set{}, fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+	}
+
+	return set, nil
+}
+
+// Len returns the number of digests in the set.
+func (s Set) Len() int {
+	return len(s.digests)
+}
+
+// Get returns the digest for alg, if present.
+func (s Set) Get(alg Algorithm) (Digest, bool) {
+	dgst, ok := s.digests[alg]
+
+	return dgst, ok
+}
+
+// Digests returns the digests in the set, strongest first.
+func (s Set) Digests() []Digest {
+	digests := make([]Digest, 0, len(s.digests))
+	for _, dgst := range s.digests {
+		digests = append(digests, dgst)
+	}
+
+	slices.SortFunc(digests, func(a, b Digest) int {
+		if c := strengthOf(b.Algorithm()) - strengthOf(a.Algorithm()); c != 0 {
+			return c
+		}
+
+		return strings.Compare(string(a.Algorithm()), string(b.Algorithm()))
+	})
+
+	return digests
+}
+
+// Strongest returns the strongest digest of the set, to be used for display. Returns the zero Digest on an empty
+// set.
+func (s Set) Strongest() Digest {
+	digests := s.Digests()
+	if len(digests) == 0 {
+		return Digest{}
+	}
+
+	return digests[0]
+}
+
+// Verify reads reader once, computing every algorithm of the set, and checks all digests.
+// On mismatch, the returned error joins a *MismatchError for every algorithm that disagreed.
+func (s Set) Verify(reader io.Reader) error {
+	if len(s.digests) == 0 {
+		return fmt.Errorf("%w: empty digest set", fault.ErrInvalidArgument)
+	}
+
+	algs := make([]Algorithm, 0, len(s.digests))
+	for alg := range s.digests {
+		algs = append(algs, alg)
+	}
+
+	actual, err := ComputeSet(reader, algs...)
+	if err != nil {
+		return err
+	}
+
+	return s.Compare(actual)
+}
+
+// Compare checks every digest of the set against the digest for the same algorithm in other.
+// Algorithms missing from other and algorithms that are not cryptographically secure are ignored, but at least one
+// secure algorithm must be shared.
+// On mismatch, the returned error joins a *MismatchError for every algorithm that disagreed.
+func (s Set) Compare(other Set) error {
+	var (
+		errs   []error
+		shared int
+	)
+
+	for _, expected := range s.Digests() {
+		actual, ok := other.digests[expected.Algorithm()]
+		if !ok || !expected.Algorithm().Secure() {
+			continue
+		}
+
+		shared++
+
+		if !actual.Equal(expected) {
+			errs = append(errs, &MismatchError{Expected: expected, Actual: actual})
+		}
+	}
+
+	if shared == 0 {
+		return fmt.Errorf("%w: no secure algorithm in common", fault.ErrInvalidArgument)
+	}
+
+	return errors.Join(errs...)
+}
+
+// String serializes the set as a manifest, one digest per line, strongest first.
+func (s Set) String() string {
+	var builder strings.Builder
+
+	for _, dgst := range s.Digests() {
+		builder.WriteString(dgst.String())
+		builder.WriteString("\n")
+	}
+
+	return builder.String()
+}
+
+func (s Set) add(dgst Digest) error {
+	if dgst.IsZero() {
+		return fmt.Errorf("%w: empty digest", fault.ErrInvalidArgument)
+	}
+
+	if existing, ok := s.digests[dgst.Algorithm()]; ok && !existing.Equal(dgst) {
+		return fmt.Errorf("%w: conflicting digests %s and %s", fault.ErrInvalidArgument, existing, dgst)
+	}
+
+	s.digests[dgst.Algorithm()] = dgst
+
+	return nil
+}
+
+func strengthOf(alg Algorithm) int {
+	return slices.Index(strength, alg)
+}
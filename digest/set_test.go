@@ -0,0 +1,133 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package digest_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mycophonic/primordium/digest"
+	"github.com/mycophonic/primordium/fault"
+)
+
+func TestComputeSet(t *testing.T) {
+	t.Parallel()
+
+	set, err := digest.ComputeSet(strings.NewReader("hello"), digest.SHA256, digest.BLAKE2b512)
+	if err != nil {
+		t.Fatalf("ComputeSet returned error: %v", err)
+	}
+
+	if set.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", set.Len())
+	}
+
+	sha, ok := set.Get(digest.SHA256)
+	if !ok || sha.String() != helloSHA256 {
+		t.Errorf("Get(sha256) = %v, want %q", sha, helloSHA256)
+	}
+
+	blake := digest.FromBytes(digest.BLAKE2b512, []byte("hello"))
+	if got := set.Strongest(); got.String() != blake.String() {
+		t.Errorf("Strongest() = %q, want %q", got, blake)
+	}
+}
+
+func TestSet_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	set, err := digest.ComputeSet(strings.NewReader("hello"), digest.SHA256, digest.BLAKE2b512, digest.SHA1)
+	if err != nil {
+		t.Fatalf("ComputeSet returned error: %v", err)
+	}
+
+	manifest := "# release checksums\n\n" + set.String()
+
+	parsed, err := digest.ParseSet(manifest)
+	if err != nil {
+		t.Fatalf("ParseSet returned error: %v", err)
+	}
+
+	if parsed.String() != set.String() {
+		t.Errorf("round-trip = %q, want %q", parsed.String(), set.String())
+	}
+
+	lines := strings.Split(strings.TrimSpace(set.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "blake2b-512:") || !strings.HasPrefix(lines[2], "sha1:") {
+		t.Errorf("manifest not ordered by strength: %q", lines)
+	}
+}
+
+func TestSet_Verify(t *testing.T) {
+	t.Parallel()
+
+	set, err := digest.ComputeSet(strings.NewReader("hello"), digest.SHA256, digest.BLAKE2b512)
+	if err != nil {
+		t.Fatalf("ComputeSet returned error: %v", err)
+	}
+
+	if err = set.Verify(strings.NewReader("hello")); err != nil {
+		t.Errorf("Verify(matching content) returned error: %v", err)
+	}
+
+	err = set.Verify(strings.NewReader("tampered"))
+	if !errors.Is(err, fault.ErrHashMismatch) {
+		t.Fatalf("expected ErrHashMismatch, got: %v", err)
+	}
+
+	var mismatch *digest.MismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected a *MismatchError, got: %T", err)
+	}
+}
+
+func TestSet_ReportsMismatchedAlgorithm(t *testing.T) {
+	t.Parallel()
+
+	// The sha256 is right, the blake2b-512 is for different content.
+	set, err := digest.NewSet(
+		digest.FromBytes(digest.SHA256, []byte("hello")),
+		digest.FromBytes(digest.BLAKE2b512, []byte("other")),
+	)
+	if err != nil {
+		t.Fatalf("NewSet returned error: %v", err)
+	}
+
+	err = set.Verify(strings.NewReader("hello"))
+
+	var mismatch *digest.MismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected a *MismatchError, got: %v", err)
+	}
+
+	if mismatch.Expected.Algorithm() != digest.BLAKE2b512 {
+		t.Errorf("mismatched algorithm = %q, want %q", mismatch.Expected.Algorithm(), digest.BLAKE2b512)
+	}
+}
+
+func TestNewSet_Conflict(t *testing.T) {
+	t.Parallel()
+
+	_, err := digest.NewSet(
+		digest.FromBytes(digest.SHA256, []byte("a")),
+		digest.FromBytes(digest.SHA256, []byte("b")),
+	)
+	if !errors.Is(err, fault.ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument, got: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package digest
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// XXH64 implementation, following the reference specification:
+// https://github.com/Cyan4973/xxHash/blob/dev/doc/xxhash_spec.md
+
+const (
+	xxhPrime1 uint64 = 11400714785074694791
+	xxhPrime2 uint64 = 14029467366897019727
+	xxhPrime3 uint64 = 1609587929392839161
+	xxhPrime4 uint64 = 9650029242287828579
+	xxhPrime5 uint64 = 2870177450012600261
+
+	xxhStripeSize = 32
+	xxhSize       = 8
+)
+
+// xxh64 is a streaming, unseeded XXH64 hash.
+type xxh64 struct {
+	acc   [4]uint64
+	total uint64
+	buf   [xxhStripeSize]byte
+	used  int
+}
+
+func newXXH64() hash.Hash {
+	h := &xxh64{}
+	h.Reset()
+
+	return h
+}
+
+func (h *xxh64) Reset() {
+	// Constants wrap around on purpose, as the specification relies on unsigned overflow.
+	prime1, prime2 := xxhPrime1, xxhPrime2
+	h.acc = [4]uint64{prime1 + prime2, prime2, 0, -prime1}
+	h.total = 0
+	h.used = 0
+}
+
+func (*xxh64) Size() int {
+	return xxhSize
+}
+
+func (*xxh64) BlockSize() int {
+	return xxhStripeSize
+}
+
+func (h *xxh64) Write(p []byte) (int, error) {
+	written := len(p)
+	h.total += uint64(written)
+
+	if h.used > 0 {
+		filled := copy(h.buf[h.used:], p)
+		h.used += filled
+		p = p[filled:]
+
+		if h.used < xxhStripeSize {
+			return written, nil
+		}
+
+		h.stripe(h.buf[:])
+		h.used = 0
+	}
+
+	for ; len(p) >= xxhStripeSize; p = p[xxhStripeSize:] {
+		h.stripe(p)
+	}
+
+	h.used = copy(h.buf[:], p)
+
+	return written, nil
+}
+
+func (h *xxh64) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, h.Sum64())
+}
+
+func (h *xxh64) Sum64() uint64 {
+	var acc uint64
+
+	if h.total >= xxhStripeSize {
+		acc = bits.RotateLeft64(h.acc[0], 1) + bits.RotateLeft64(h.acc[1], 7) +
+			bits.RotateLeft64(h.acc[2], 12) + bits.RotateLeft64(h.acc[3], 18)
+
+		for _, lane := range h.acc {
+			acc = (acc^xxhRound(0, lane))*xxhPrime1 + xxhPrime4
+		}
+	} else {
+		acc = xxhPrime5
+	}
+
+	acc += h.total
+
+	tail := h.buf[:h.used]
+
+	for ; len(tail) >= 8; tail = tail[8:] {
+		acc ^= xxhRound(0, binary.LittleEndian.Uint64(tail))
+		acc = bits.RotateLeft64(acc, 27)*xxhPrime1 + xxhPrime4
+	}
+
+	if len(tail) >= 4 {
+		acc ^= uint64(binary.LittleEndian.Uint32(tail)) * xxhPrime1
+		acc = bits.RotateLeft64(acc, 23)*xxhPrime2 + xxhPrime3
+		tail = tail[4:]
+	}
+
+	for _, b := range tail {
+		acc ^= uint64(b) * xxhPrime5
+		acc = bits.RotateLeft64(acc, 11) * xxhPrime1
+	}
+
+	acc ^= acc >> 33
+	acc *= xxhPrime2
+	acc ^= acc >> 29
+	acc *= xxhPrime3
+	acc ^= acc >> 32
+
+	return acc
+}
+
+func (h *xxh64) stripe(p []byte) {
+	h.acc[0] = xxhRound(h.acc[0], binary.LittleEndian.Uint64(p[0:8]))
+	h.acc[1] = xxhRound(h.acc[1], binary.LittleEndian.Uint64(p[8:16]))
+	h.acc[2] = xxhRound(h.acc[2], binary.LittleEndian.Uint64(p[16:24]))
+	h.acc[3] = xxhRound(h.acc[3], binary.LittleEndian.Uint64(p[24:32]))
+}
+
+func xxhRound(acc, lane uint64) uint64 {
+	return bits.RotateLeft64(acc+lane*xxhPrime2, 31) * xxhPrime1
+}
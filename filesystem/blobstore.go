@@ -0,0 +1,379 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mycophonic/primordium/digest"
+	"github.com/mycophonic/primordium/fault"
+)
+
+const (
+	blobLocksDir   = ".locks"
+	blobStoreLock  = ".lock"
+	blobTempPrefix = ".tmp-"
+)
+
+// BlobStore is a content-addressable store laying out blobs as <root>/<algorithm>/<encoded>.
+// Blobs are ingested atomically (temp file and rename) and verified against their digest before being committed.
+//
+// Cross-process safety relies on file locks: ingests and deletions hold a shared lock on the store (<root>/.lock) and an
+// exclusive lock on the digest being written, while garbage collection holds an exclusive lock on the store.
+type BlobStore struct {
+	root string
+
+	// VerifyOnRead makes Open re-verify content against its digest while it is being read.
+	VerifyOnRead bool
+}
+
+// NewBlobStore creates a BlobStore rooted at root, typically a subdirectory of CacheDir or DataDir.
+// Panics if root contains invalid path components.
+func NewBlobStore(root string) *BlobStore {
+	if err := ValidatePath(root); err != nil {
+		panic(fmt.Errorf("BlobStore: invalid root path: %w", err))
+	}
+
+	return &BlobStore{root: root}
+}
+
+// Path returns the location of the blob identified by dgst. The blob may not exist.
+func (bs *BlobStore) Path(dgst digest.Digest) string {
+	return filepath.Join(bs.root, string(dgst.Algorithm()), dgst.Encoded())
+}
+
+// Ingest streams reader into the store under expected.
+// The content is verified against expected before being committed, and a mismatch returns an error wrapping
+// fault.ErrHashMismatch. If the blob already exists, reader is not consumed and Ingest returns nil.
+func (bs *BlobStore) Ingest(expected digest.Digest, reader io.Reader) (err error) {
+	if err = validateBlobDigest(expected); err != nil {
+		return err
+	}
+
+	unlock, err := bs.lockDigest(expected)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		err = errors.Join(err, unlock())
+	}()
+
+	target := bs.Path(expected)
+
+	if _, err = os.Stat(target); err == nil {
+		return nil
+	}
+
+	verifier, err := digest.NewVerifier(expected, reader)
+	if err != nil {
+		return err
+	}
+
+	return bs.commit(target, verifier)
+}
+
+// Open returns a reader for the blob identified by dgst.
+// If VerifyOnRead is set, reading to EOF returns an error wrapping fault.ErrHashMismatch if the content on disk no
+// longer matches its digest.
+func (bs *BlobStore) Open(dgst digest.Digest) (io.ReadCloser, error) {
+	if err := validateBlobDigest(dgst); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(bs.Path(dgst))
+	if err != nil {
+		return nil, blobError(dgst, err)
+	}
+
+	if !bs.VerifyOnRead {
+		return file, nil
+	}
+
+	verifier, err := digest.NewVerifier(dgst, file)
+	if err != nil {
+		return nil, errors.Join(err, file.Close())
+	}
+
+	return &verifiedBlob{Verifier: verifier, file: file}, nil
+}
+
+// Stat returns file information for the blob identified by dgst.
+func (bs *BlobStore) Stat(dgst digest.Digest) (os.FileInfo, error) {
+	if err := validateBlobDigest(dgst); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(bs.Path(dgst))
+	if err != nil {
+		return nil, blobError(dgst, err)
+	}
+
+	return info, nil
+}
+
+// Delete removes the blob identified by dgst.
+func (bs *BlobStore) Delete(dgst digest.Digest) (err error) {
+	if err = validateBlobDigest(dgst); err != nil {
+		return err
+	}
+
+	unlock, err := bs.lockDigest(dgst)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		err = errors.Join(err, unlock())
+	}()
+
+	if err = os.Remove(bs.Path(dgst)); err != nil {
+		return blobError(dgst, err)
+	}
+
+	return nil
+}
+
+// Walk calls function for every blob in the store.
+// Entries that are not valid blobs (temporary files, unknown algorithms) are skipped.
+func (bs *BlobStore) Walk(function func(dgst digest.Digest, info os.FileInfo) error) error {
+	algorithms, err := os.ReadDir(bs.root)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	for _, algDir := range algorithms {
+		if !algDir.IsDir() || !digest.Algorithm(algDir.Name()).Available() {
+			continue
+		}
+
+		entries, err := os.ReadDir(filepath.Join(bs.root, algDir.Name()))
+		if err != nil {
+			return fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+		}
+
+		for _, entry := range entries {
+			dgst, err := digest.FromString(algDir.Name() + ":" + entry.Name())
+			if err != nil || !entry.Type().IsRegular() {
+				continue
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+			}
+
+			if err = function(dgst, info); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// GarbageCollect removes every blob for which keep returns false, along with leftover temporary files and lock files.
+// It holds an exclusive lock on the store for its whole duration, so no ingest or deletion can run concurrently.
+// Returns the number of blobs removed and the number of bytes freed.
+func (bs *BlobStore) GarbageCollect(keep func(dgst digest.Digest) bool) (removed int, freed int64, err error) {
+	storeLockPath, err := bs.prepareStoreLock()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = WithLock(storeLockPath, func() error {
+		walkErr := bs.Walk(func(dgst digest.Digest, info os.FileInfo) error {
+			if keep(dgst) {
+				return nil
+			}
+
+			if rmErr := os.Remove(bs.Path(dgst)); rmErr != nil {
+				return blobError(dgst, rmErr)
+			}
+
+			removed++
+			freed += info.Size()
+
+			return nil
+		})
+		if walkErr != nil {
+			return walkErr
+		}
+
+		return bs.removeLeftovers()
+	})
+
+	return removed, freed, err
+}
+
+// lockDigest takes a shared lock on the store root and an exclusive lock on the digest.
+func (bs *BlobStore) lockDigest(dgst digest.Digest) (func() error, error) {
+	storeLockPath, err := bs.prepareStoreLock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Directories are created under the store lock, as garbage collection removes the locks directory.
+	storeLock, err := ReadOnlyLock(storeLockPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: store lock: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	locksDir := filepath.Join(bs.root, blobLocksDir)
+
+	for _, dir := range []string{locksDir, filepath.Join(bs.root, string(dgst.Algorithm()))} {
+		if err = os.MkdirAll(dir, DirPermissionsPrivate); err != nil {
+			return nil, errors.Join(fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err), Unlock(storeLock))
+		}
+	}
+
+	lockPath := filepath.Join(locksDir, string(dgst.Algorithm())+"-"+dgst.Encoded())
+
+	if err = touchLockFile(lockPath); err != nil {
+		return nil, errors.Join(fmt.Errorf("%w: lock file: %w", fault.ErrFilesystemFailure, err), Unlock(storeLock))
+	}
+
+	blobLock, err := Lock(lockPath)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("%w: blob lock: %w", fault.ErrFilesystemFailure, err), Unlock(storeLock))
+	}
+
+	return func() error {
+		return errors.Join(Unlock(blobLock), Unlock(storeLock))
+	}, nil
+}
+
+// prepareStoreLock creates the store root and its lock file, and returns the path of the latter.
+// Directories cannot be locked on every platform, hence the dedicated file.
+func (bs *BlobStore) prepareStoreLock() (string, error) {
+	if err := os.MkdirAll(bs.root, DirPermissionsPrivate); err != nil {
+		return "", fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	lockPath := filepath.Join(bs.root, blobStoreLock)
+
+	if err := touchLockFile(lockPath); err != nil {
+		return "", fmt.Errorf("%w: store lock file: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	return lockPath, nil
+}
+
+// commit atomically writes the content of reader to target.
+func (bs *BlobStore) commit(target string, reader io.Reader) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(target), blobTempPrefix+filepath.Base(target))
+	if err != nil {
+		return errors.Join(ErrAtomicWriteFail, err)
+	}
+
+	tmpName := tmpFile.Name()
+
+	fail := func(err error) error {
+		return errors.Join(err, tmpFile.Close(), os.Remove(tmpName))
+	}
+
+	if err = os.Chmod(tmpName, (^os.FileMode(currentMask))&FilePermissionsPrivate); err != nil {
+		return fail(errors.Join(ErrAtomicWriteFail, err))
+	}
+
+	if _, err = io.Copy(tmpFile, reader); err != nil {
+		if errors.Is(err, fault.ErrHashMismatch) {
+			return fail(err)
+		}
+
+		return fail(errors.Join(ErrAtomicWriteFail, err))
+	}
+
+	if err = tmpFile.Sync(); err != nil {
+		return fail(errors.Join(ErrAtomicWriteFail, err))
+	}
+
+	if err = tmpFile.Close(); err != nil {
+		return errors.Join(ErrAtomicWriteFail, err, os.Remove(tmpName))
+	}
+
+	if err = os.Rename(tmpName, target); err != nil {
+		return errors.Join(ErrAtomicWriteFail, err, os.Remove(tmpName))
+	}
+
+	return nil
+}
+
+// removeLeftovers deletes temporary files from interrupted ingests and stale lock files.
+// Must be called with the store lock held exclusively.
+func (bs *BlobStore) removeLeftovers() error {
+	if err := os.RemoveAll(filepath.Join(bs.root, blobLocksDir)); err != nil {
+		return fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	temps, err := filepath.Glob(filepath.Join(bs.root, "*", blobTempPrefix+"*"))
+	if err != nil {
+		return fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	for _, temp := range temps {
+		if err = os.Remove(temp); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+		}
+	}
+
+	return nil
+}
+
+// validateBlobDigest rejects digests that do not designate a blob: Path would resolve outside of the blob files.
+func validateBlobDigest(dgst digest.Digest) error {
+	if dgst.IsZero() {
+		return fmt.Errorf("%w: empty digest", fault.ErrInvalidArgument)
+	}
+
+	if !dgst.Algorithm().Available() {
+		return fmt.Errorf("%w: unknown algorithm %s", fault.ErrInvalidArgument, dgst.Algorithm())
+	}
+
+	return nil
+}
+
+// blobError maps an os error on a blob to the matching fault.
+func blobError(dgst digest.Digest, err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: blob %s", fault.ErrNotFound, dgst)
+	}
+
+	return fmt.Errorf("%w: blob %s: %w", fault.ErrFilesystemFailure, dgst, err)
+}
+
+// verifiedBlob closes the underlying blob file of a Verifier.
+type verifiedBlob struct {
+	*digest.Verifier
+
+	file *os.File
+}
+
+// Close closes the underlying blob file.
+//
+//nolint:wrapcheck // passthrough to underlying file
+func (vb *verifiedBlob) Close() error {
+	return vb.file.Close()
+}
@@ -0,0 +1,216 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package filesystem_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/mycophonic/primordium/digest"
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/filesystem"
+)
+
+func TestBlobStore_IngestAndOpen(t *testing.T) {
+	t.Parallel()
+
+	store := filesystem.NewBlobStore(t.TempDir())
+	content := []byte("spectrogram")
+	dgst := digest.FromBytes(digest.SHA256, content)
+
+	err := store.Ingest(dgst, bytes.NewReader(content))
+	assert.NilError(t, err, "ingest should succeed")
+
+	assert.Equal(t, filepath.Base(filepath.Dir(store.Path(dgst))), "sha256")
+	assert.Equal(t, filepath.Base(store.Path(dgst)), dgst.Encoded())
+
+	info, err := store.Stat(dgst)
+	assert.NilError(t, err, "stat should succeed")
+	assert.Equal(t, info.Size(), int64(len(content)))
+
+	reader, err := store.Open(dgst)
+	assert.NilError(t, err, "open should succeed")
+
+	got, err := io.ReadAll(reader)
+	assert.NilError(t, err, "read should succeed")
+	assert.NilError(t, reader.Close(), "close should succeed")
+	assert.Assert(t, bytes.Equal(got, content), "content mismatch: got %q", got)
+}
+
+func TestBlobStore_IngestMismatch(t *testing.T) {
+	t.Parallel()
+
+	store := filesystem.NewBlobStore(t.TempDir())
+	dgst := digest.FromBytes(digest.SHA256, []byte("expected"))
+
+	err := store.Ingest(dgst, strings.NewReader("tampered"))
+	assert.Assert(t, errors.Is(err, fault.ErrHashMismatch), "expected ErrHashMismatch, got: %v", err)
+
+	_, err = store.Stat(dgst)
+	assert.Assert(t, errors.Is(err, fault.ErrNotFound), "mismatched blob should not be committed, got: %v", err)
+
+	entries, err := os.ReadDir(filepath.Dir(store.Path(dgst)))
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0, "temporary file should be cleaned up")
+}
+
+func TestBlobStore_VerifyOnRead(t *testing.T) {
+	t.Parallel()
+
+	store := filesystem.NewBlobStore(t.TempDir())
+	store.VerifyOnRead = true
+	content := []byte("decoded audio")
+	dgst := digest.FromBytes(digest.SHA256, content)
+
+	assert.NilError(t, store.Ingest(dgst, bytes.NewReader(content)))
+	assert.NilError(t, os.WriteFile(store.Path(dgst), []byte("corrupted"), filesystem.FilePermissionsPrivate))
+
+	reader, err := store.Open(dgst)
+	assert.NilError(t, err)
+
+	defer reader.Close()
+
+	_, err = io.ReadAll(reader)
+	assert.Assert(t, errors.Is(err, fault.ErrHashMismatch), "expected ErrHashMismatch, got: %v", err)
+}
+
+func TestBlobStore_ConcurrentIngest(t *testing.T) {
+	t.Parallel()
+
+	store := filesystem.NewBlobStore(t.TempDir())
+	content := bytes.Repeat([]byte("binary"), 4096)
+	dgst := digest.FromBytes(digest.SHA256, content)
+
+	var waitGroup sync.WaitGroup
+
+	for range 8 {
+		waitGroup.Go(func() {
+			assert.Check(t, store.Ingest(dgst, bytes.NewReader(content)))
+		})
+	}
+
+	waitGroup.Wait()
+
+	count := 0
+	err := store.Walk(func(d digest.Digest, _ os.FileInfo) error {
+		count++
+
+		assert.Equal(t, d.String(), dgst.String())
+
+		return nil
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, count, 1)
+}
+
+func TestBlobStore_DeleteAndGarbageCollect(t *testing.T) {
+	t.Parallel()
+
+	store := filesystem.NewBlobStore(t.TempDir())
+	keep := digest.FromBytes(digest.SHA256, []byte("keep"))
+	drop := digest.FromBytes(digest.SHA256, []byte("drop"))
+	gone := digest.FromBytes(digest.SHA512, []byte("gone"))
+
+	assert.NilError(t, store.Ingest(keep, strings.NewReader("keep")))
+	assert.NilError(t, store.Ingest(drop, strings.NewReader("drop")))
+	assert.NilError(t, store.Ingest(gone, strings.NewReader("gone")))
+
+	assert.NilError(t, store.Delete(gone))
+
+	err := store.Delete(gone)
+	assert.Assert(t, errors.Is(err, fault.ErrNotFound), "deleting twice should be ErrNotFound, got: %v", err)
+
+	// Simulate an interrupted ingest.
+	leftover := filepath.Join(filepath.Dir(store.Path(keep)), ".tmp-interrupted")
+	assert.NilError(t, os.WriteFile(leftover, []byte("partial"), filesystem.FilePermissionsPrivate))
+
+	removed, freed, err := store.GarbageCollect(func(d digest.Digest) bool {
+		return d.String() == keep.String()
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, removed, 1)
+	assert.Equal(t, freed, int64(len("drop")))
+
+	_, err = store.Stat(keep)
+	assert.NilError(t, err, "kept blob should still exist")
+
+	_, err = store.Stat(drop)
+	assert.Assert(t, errors.Is(err, fault.ErrNotFound))
+
+	_, err = os.Stat(leftover)
+	assert.Assert(t, errors.Is(err, os.ErrNotExist), "leftover temp file should be removed")
+
+	// Garbage collection removed the locks directory, which must be recreated.
+	assert.NilError(t, store.Ingest(drop, strings.NewReader("drop")))
+}
+
+func TestBlobStore_RejectsInvalidDigests(t *testing.T) {
+	t.Parallel()
+
+	store := filesystem.NewBlobStore(t.TempDir())
+
+	_, err := store.Open(digest.Digest{})
+	assert.Assert(t, errors.Is(err, fault.ErrInvalidArgument), "Open: got %v", err)
+
+	_, err = store.Stat(digest.Digest{})
+	assert.Assert(t, errors.Is(err, fault.ErrInvalidArgument), "Stat: got %v", err)
+
+	err = store.Delete(digest.Digest{})
+	assert.Assert(t, errors.Is(err, fault.ErrInvalidArgument), "Delete: got %v", err)
+
+	err = store.Ingest(digest.Digest{}, strings.NewReader(""))
+	assert.Assert(t, errors.Is(err, fault.ErrInvalidArgument), "Ingest: got %v", err)
+}
+
+func TestBlobStore_StoreLockFile(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	store := filesystem.NewBlobStore(root)
+	dgst := digest.FromBytes(digest.SHA256, []byte("locked"))
+
+	// Create the lock file, then hold it exclusively as garbage collection does.
+	assert.NilError(t, store.Ingest(dgst, strings.NewReader("locked")))
+	assert.NilError(t, store.Delete(dgst))
+
+	lock, err := filesystem.Lock(filepath.Join(root, ".lock"))
+	assert.NilError(t, err)
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- store.Ingest(dgst, strings.NewReader("locked"))
+	}()
+
+	select {
+	case err = <-done:
+		t.Fatalf("Ingest completed while the store was locked: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	assert.NilError(t, filesystem.Unlock(lock))
+	assert.NilError(t, <-done)
+}
@@ -4,6 +4,7 @@ go 1.25.7
 
 require (
 	github.com/getsentry/sentry-go v0.42.0
+	github.com/pkg/sftp v1.13.10
 	github.com/rs/zerolog v1.34.0
 	github.com/samber/slog-zerolog/v2 v2.9.1
 	golang.org/x/crypto v0.48.0
@@ -13,6 +14,7 @@ require (
 
 require (
 	github.com/google/go-cmp v0.5.9 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/mattn/go-colorable v0.1.14 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/samber/lo v1.52.0 // indirect
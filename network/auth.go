@@ -0,0 +1,452 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mycophonic/primordium/fault"
+)
+
+const (
+	// tokenExpirySkew renews tokens slightly before they expire, to absorb clock skew and latency.
+	tokenExpirySkew = 30 * time.Second
+	// defaultRegistryTokenLifetime applies when a token server does not announce one, as per the registry spec.
+	defaultRegistryTokenLifetime = 60 * time.Second
+	tokenResponseLimit           = 1 << 20
+	authorizationHeader          = "Authorization"
+	wwwAuthenticateHeader        = "WWW-Authenticate"
+	schemeBasic                  = "basic"
+	schemeBearer                 = "bearer"
+)
+
+// Authenticator sets credentials on outgoing requests.
+// RoundTripper always hands it a clone of the request, so that credentials never leak into a reused request.
+type Authenticator interface {
+	Authorize(req *http.Request) error
+}
+
+// Challenger is implemented by Authenticators able to react to a 401 response, typically by obtaining new
+// credentials. If Challenge returns true, RoundTripper authorizes and sends the request once more.
+type Challenger interface {
+	Challenge(resp *http.Response) (bool, error)
+}
+
+// BasicAuth authenticates with a user name and password.
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// Authorize implements Authenticator.
+func (b *BasicAuth) Authorize(req *http.Request) error {
+	req.SetBasicAuth(b.Username, b.Password)
+
+	return nil
+}
+
+// TokenSource obtains a token, along with its expiry. A zero expiry means the token is valid until rejected.
+type TokenSource func(ctx context.Context) (token string, expiry time.Time, err error)
+
+// BearerToken authenticates with a bearer token, obtained from a TokenSource and cached until it expires or is
+// rejected with a 401.
+type BearerToken struct {
+	source TokenSource
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// NewBearerToken returns a BearerToken obtaining its tokens from source.
+func NewBearerToken(source TokenSource) *BearerToken {
+	return &BearerToken{source: source}
+}
+
+// Authorize implements Authenticator.
+func (b *BearerToken) Authorize(req *http.Request) error {
+	token, err := b.get(req.Context())
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(authorizationHeader, "Bearer "+token)
+
+	return nil
+}
+
+// Challenge implements Challenger: the cached token is dropped, and the request retried with a fresh one.
+func (b *BearerToken) Challenge(_ *http.Response) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.token = ""
+
+	return true, nil
+}
+
+func (b *BearerToken) get(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.token != "" && (b.expiry.IsZero() || time.Until(b.expiry) > tokenExpirySkew) {
+		return b.token, nil
+	}
+
+	token, expiry, err := b.source(ctx)
+	if err != nil {
+		return "", fmt.Errorf("%w: obtaining token: %w", fault.ErrAuthenticationFailure, err)
+	}
+
+	b.token, b.expiry = token, expiry
+
+	return token, nil
+}
+
+// ClientCredentials configures the OAuth2 client credentials grant (RFC 6749, section 4.4).
+type ClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// Client requests tokens. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// NewClientCredentials returns a BearerToken obtaining access tokens with the OAuth2 client credentials grant.
+// Client credentials are sent with HTTP Basic authentication, as recommended by RFC 6749.
+func NewClientCredentials(config ClientCredentials) *BearerToken {
+	return NewBearerToken(func(ctx context.Context) (string, time.Time, error) {
+		form := url.Values{"grant_type": {"client_credentials"}}
+		if len(config.Scopes) > 0 {
+			form.Set("scope", strings.Join(config.Scopes, " "))
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.TokenURL,
+			strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("%w: %w", fault.ErrInvalidArgument, err)
+		}
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+
+		token, err := requestToken(config.Client, req)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+
+		if token.TokenType != "" && !strings.EqualFold(token.TokenType, schemeBearer) {
+			return "", time.Time{}, fmt.Errorf("%w: unsupported token type %q", fault.ErrAuthenticationFailure,
+				token.TokenType)
+		}
+
+		return token.AccessToken, token.expiry(0), nil
+	})
+}
+
+// ChallengeAuth answers WWW-Authenticate challenges, as container registries do: on a Bearer challenge, a token is
+// requested from the announced realm (with the optional user name and password), and on a Basic challenge, the user
+// name and password are used directly. Credentials are cached per host.
+//
+// Credentials are only sent to token realms over https, or on the same host as the challenged request.
+type ChallengeAuth struct {
+	Username string
+	Password string
+	// Client requests tokens. Defaults to http.DefaultClient.
+	Client *http.Client
+
+	mu    sync.Mutex
+	hosts map[string]hostCredential
+}
+
+type hostCredential struct {
+	authorization string
+	expiry        time.Time
+}
+
+// Authorize implements Authenticator, reusing credentials obtained by a previous challenge on the same host.
+func (c *ChallengeAuth) Authorize(req *http.Request) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	credential, ok := c.hosts[req.URL.Host]
+	if !ok {
+		return nil
+	}
+
+	if !credential.expiry.IsZero() && time.Until(credential.expiry) <= tokenExpirySkew {
+		delete(c.hosts, req.URL.Host)
+
+		return nil
+	}
+
+	req.Header.Set(authorizationHeader, credential.authorization)
+
+	return nil
+}
+
+// Challenge implements Challenger. Bearer challenges are preferred over Basic ones.
+func (c *ChallengeAuth) Challenge(resp *http.Response) (bool, error) {
+	req := resp.Request
+
+	challenges := parseChallenges(resp.Header.Values(wwwAuthenticateHeader))
+	slices.SortStableFunc(challenges, func(a, b challenge) int {
+		return cmp.Compare(challengePreference(a.scheme), challengePreference(b.scheme))
+	})
+
+	for _, challenge := range challenges {
+		var credential hostCredential
+
+		switch challenge.scheme {
+		case schemeBearer:
+			token, err := c.fetchToken(req, challenge.params)
+			if err != nil {
+				return false, err
+			}
+
+			credential = hostCredential{
+				authorization: "Bearer " + token.value(),
+				expiry:        token.expiry(defaultRegistryTokenLifetime),
+			}
+		case schemeBasic:
+			if c.Username == "" {
+				continue
+			}
+
+			basic := &http.Request{Header: http.Header{}}
+			basic.SetBasicAuth(c.Username, c.Password)
+			credential = hostCredential{authorization: basic.Header.Get(authorizationHeader)}
+		default:
+			continue
+		}
+
+		c.store(req.URL.Host, credential)
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func challengePreference(scheme string) int {
+	switch scheme {
+	case schemeBearer:
+		return 0
+	case schemeBasic:
+		return 1
+	default:
+		return 2 //nolint:mnd // Unsupported schemes last
+	}
+}
+
+func (c *ChallengeAuth) store(host string, credential hostCredential) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hosts == nil {
+		c.hosts = map[string]hostCredential{}
+	}
+
+	c.hosts[host] = credential
+}
+
+func (c *ChallengeAuth) fetchToken(challenged *http.Request, params map[string]string) (*tokenResponse, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return nil, fmt.Errorf("%w: invalid token realm %q", fault.ErrAuthenticationFailure, params["realm"])
+	}
+
+	query := realm.Query()
+
+	for _, key := range []string{"service", "scope"} {
+		if value, ok := params[key]; ok {
+			query.Set(key, value)
+		}
+	}
+
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(challenged.Context(), http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrInvalidArgument, err)
+	}
+
+	if c.Username != "" {
+		if realm.Scheme != "https" && realm.Host != challenged.URL.Host {
+			return nil, fmt.Errorf("%w: refusing to send credentials to insecure token realm %s",
+				fault.ErrAuthenticationFailure, realm.Redacted())
+		}
+
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	return requestToken(c.Client, req)
+}
+
+// tokenResponse covers both OAuth2 (RFC 6749, section 5.1) and registry token responses.
+type tokenResponse struct {
+	AccessToken string `json:"access_token"` //nolint:tagliatelle // Defined by RFC 6749
+	Token       string `json:"token"`
+	TokenType   string `json:"token_type"` //nolint:tagliatelle // Defined by RFC 6749
+	ExpiresIn   int    `json:"expires_in"` //nolint:tagliatelle // Defined by RFC 6749
+	Error       string `json:"error"`
+}
+
+func (t *tokenResponse) value() string {
+	if t.Token != "" {
+		return t.Token
+	}
+
+	return t.AccessToken
+}
+
+func (t *tokenResponse) expiry(fallback time.Duration) time.Time {
+	lifetime := time.Duration(t.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = fallback
+	}
+
+	if lifetime <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(lifetime)
+}
+
+func requestToken(client *http.Client, req *http.Request) (*tokenResponse, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: requesting token: %w", fault.ErrNetworkError, err)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var token tokenResponse
+
+	decodeErr := json.NewDecoder(io.LimitReader(resp.Body, tokenResponseLimit)).Decode(&token)
+
+	// Error codes are safe to report, descriptions and bodies might echo secrets.
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: token endpoint %s answered %d %s", fault.ErrAuthenticationFailure,
+			req.URL.Redacted(), resp.StatusCode, token.Error)
+	}
+
+	if decodeErr != nil {
+		return nil, fmt.Errorf("%w: decoding token response: %w", fault.ErrInvalidJSON, decodeErr)
+	}
+
+	if token.value() == "" {
+		return nil, fmt.Errorf("%w: token endpoint %s returned no token", fault.ErrAuthenticationFailure,
+			req.URL.Redacted())
+	}
+
+	return &token, nil
+}
+
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+// parseChallenges parses WWW-Authenticate headers (RFC 9110, section 11.6.1), which may hold several challenges each.
+func parseChallenges(headers []string) []challenge {
+	var challenges []challenge
+
+	for _, header := range headers {
+		var current *challenge
+
+		for rest := strings.TrimSpace(header); rest != ""; {
+			var token string
+
+			token, rest = cutToken(rest)
+			if token == "" {
+				// Stray character: skip it.
+				rest = strings.TrimSpace(rest[1:])
+
+				continue
+			}
+
+			if !strings.HasPrefix(rest, "=") || current == nil {
+				challenges = append(challenges, challenge{scheme: strings.ToLower(token), params: map[string]string{}})
+				current = &challenges[len(challenges)-1]
+				rest = strings.TrimLeft(rest, " ,")
+
+				continue
+			}
+
+			var value string
+
+			value, rest = cutValue(strings.TrimSpace(rest[1:]))
+			current.params[strings.ToLower(token)] = value
+			rest = strings.TrimLeft(rest, " ,")
+		}
+	}
+
+	return challenges
+}
+
+// cutToken splits a leading RFC 9110 token from s.
+func cutToken(s string) (string, string) {
+	end := strings.IndexAny(s, " \t,=\"")
+	if end < 0 {
+		return s, ""
+	}
+
+	return s[:end], strings.TrimLeft(s[end:], " \t")
+}
+
+// cutValue splits a leading token or quoted string from s.
+func cutValue(s string) (string, string) {
+	if !strings.HasPrefix(s, "\"") {
+		return cutToken(s)
+	}
+
+	var value strings.Builder
+
+	for index := 1; index < len(s); index++ {
+		switch s[index] {
+		case '\\':
+			if index+1 < len(s) {
+				index++
+				value.WriteByte(s[index])
+			}
+		case '"':
+			return value.String(), s[index+1:]
+		default:
+			value.WriteByte(s[index])
+		}
+	}
+
+	return value.String(), ""
+}
@@ -0,0 +1,276 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/network"
+)
+
+func authClient(t *testing.T, authenticator network.Authenticator) *http.Client {
+	t.Helper()
+
+	rt := newTransport(t)
+	rt.Authenticator = authenticator
+
+	return &http.Client{Transport: rt}
+}
+
+func doRequest(t *testing.T, client *http.Client, method, url string, body io.Reader) (*http.Response, error) {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(context.Background(), method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Do(req)
+	if err == nil {
+		t.Cleanup(func() { _ = resp.Body.Close() })
+	}
+
+	if req.Header.Get("Authorization") != "" {
+		t.Error("credentials leaked into the caller request")
+	}
+
+	return resp, err
+}
+
+func TestBasicAuth(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "alice" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	resp, err := doRequest(t, authClient(t, &network.BasicAuth{Username: "alice", Password: "secret"}),
+		http.MethodGet, server.URL, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("resp = %v, err = %v", resp, err)
+	}
+}
+
+func TestBearerToken_RefreshOnChallenge(t *testing.T) {
+	t.Parallel()
+
+	var (
+		issued   atomic.Int32
+		rejected atomic.Bool
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != "payload" {
+			t.Errorf("body = %q, want it replayed in full", body)
+		}
+
+		// The first token gets revoked after its first use.
+		if r.Header.Get("Authorization") == "Bearer token-1" && !rejected.CompareAndSwap(false, true) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	bearer := network.NewBearerToken(func(context.Context) (string, time.Time, error) {
+		return fmt.Sprintf("token-%d", issued.Add(1)), time.Time{}, nil
+	})
+	client := authClient(t, bearer)
+
+	for range 3 {
+		resp, err := doRequest(t, client, http.MethodPost, server.URL, strings.NewReader("payload"))
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("resp = %v, err = %v", resp, err)
+		}
+	}
+
+	if issued.Load() != 2 {
+		t.Errorf("issued %d tokens, want 2 (cached, then refreshed once on challenge)", issued.Load())
+	}
+
+	failing := network.NewBearerToken(func(context.Context) (string, time.Time, error) {
+		return "", time.Time{}, errors.New("source down")
+	})
+
+	if _, err := doRequest(t, authClient(t, failing), http.MethodGet, server.URL, nil); !errors.Is(
+		err, fault.ErrAuthenticationFailure) {
+		t.Errorf("expected ErrAuthenticationFailure, got %v", err)
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	t.Parallel()
+
+	var fetched atomic.Int32
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		fetched.Add(1)
+
+		id, secret, _ := r.BasicAuth()
+		if id != "client" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+
+			return
+		}
+
+		if r.FormValue("grant_type") != "client_credentials" || r.FormValue("scope") != "read write" {
+			t.Errorf("unexpected form: %v", r.Form)
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access", "token_type": "bearer", "expires_in": 3600,
+		})
+	})
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	config := network.ClientCredentials{
+		TokenURL:     server.URL + "/token",
+		ClientID:     "client",
+		ClientSecret: "s3cret",
+		Scopes:       []string{"read", "write"},
+	}
+	client := authClient(t, network.NewClientCredentials(config))
+
+	for range 2 {
+		resp, err := doRequest(t, client, http.MethodGet, server.URL+"/api", nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("resp = %v, err = %v", resp, err)
+		}
+	}
+
+	if fetched.Load() != 1 {
+		t.Errorf("fetched %d tokens, want 1", fetched.Load())
+	}
+
+	config.ClientSecret = "wrong-secret"
+
+	_, err := doRequest(t, authClient(t, network.NewClientCredentials(config)), http.MethodGet, server.URL+"/api", nil)
+	if !errors.Is(err, fault.ErrAuthenticationFailure) {
+		t.Fatalf("expected ErrAuthenticationFailure, got %v", err)
+	}
+
+	if strings.Contains(err.Error(), "wrong-secret") || !strings.Contains(err.Error(), "invalid_client") {
+		t.Errorf("error should report the OAuth2 error code without secrets: %v", err)
+	}
+}
+
+func TestChallengeAuth_Registry(t *testing.T) {
+	t.Parallel()
+
+	var fetched atomic.Int32
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		fetched.Add(1)
+
+		user, pass, _ := r.BasicAuth()
+		if user != "bob" || pass != "hunter2" || r.URL.Query().Get("service") != "registry" ||
+			r.URL.Query().Get("scope") != "repository:library/alpine:pull" {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]any{"token": "registry-token", "expires_in": 300})
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer registry-token" {
+			w.Header().Add("WWW-Authenticate", `Basic realm="legacy"`)
+			w.Header().Add("WWW-Authenticate", fmt.Sprintf(
+				`Bearer realm="%s/token",service="registry",scope="repository:library/alpine:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+
+	client := authClient(t, &network.ChallengeAuth{Username: "bob", Password: "hunter2"})
+
+	for range 2 {
+		resp, err := doRequest(t, client, http.MethodGet, server.URL+"/v2/library/alpine/manifests/latest", nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("resp = %v, err = %v", resp, err)
+		}
+	}
+
+	if fetched.Load() != 1 {
+		t.Errorf("fetched %d tokens, want 1", fetched.Load())
+	}
+
+	anonymous := authClient(t, &network.ChallengeAuth{})
+
+	if _, err := doRequest(t, anonymous, http.MethodGet, server.URL+"/v2/", nil); !errors.Is(
+		err, fault.ErrAuthenticationFailure) {
+		t.Errorf("anonymous pull: expected ErrAuthenticationFailure from the token server, got %v", err)
+	}
+}
+
+func TestChallengeAuth_RefusesInsecureRealm(t *testing.T) {
+	t.Parallel()
+
+	var leaked atomic.Bool
+
+	realm := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); ok {
+			leaked.Store(true)
+		}
+	}))
+	t.Cleanup(realm.Close)
+
+	// Same address, but a different host name: the realm is a different, plain http, host.
+	realmURL := strings.Replace(realm.URL, "127.0.0.1", "localhost", 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token"`, realmURL))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(server.Close)
+
+	_, err := doRequest(t, authClient(t, &network.ChallengeAuth{Username: "bob", Password: "hunter2"}),
+		http.MethodGet, server.URL, nil)
+	if !errors.Is(err, fault.ErrAuthenticationFailure) {
+		t.Errorf("expected ErrAuthenticationFailure, got %v", err)
+	}
+
+	if leaked.Load() {
+		t.Error("credentials were sent to an insecure realm")
+	}
+}
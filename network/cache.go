@@ -0,0 +1,979 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/filesystem"
+)
+
+const (
+	cacheLocksDir   = ".locks"
+	cacheTempPrefix = ".tmp-"
+	// cacheTempGrace protects the temporary files of responses still being read from Prune.
+	cacheTempGrace = time.Hour
+	// cacheHeuristicFraction is the fraction of the time since Last-Modified used as heuristic freshness.
+	cacheHeuristicFraction = 10
+	// cacheHeuristicMax caps heuristic freshness.
+	cacheHeuristicMax = 24 * time.Hour
+)
+
+// heuristicallyCacheable lists the status codes that can be stored without explicit freshness (RFC 9110 15.1).
+//
+//nolint:gochecknoglobals // Lookup table.
+var heuristicallyCacheable = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// Cache is a private HTTP cache (RFC 9111) storing responses on disk.
+//
+// GET responses are stored when cacheable, and served while fresh according to Cache-Control (max-age, no-cache,
+// no-store, max-stale, min-fresh, only-if-cached, must-revalidate), Expires, or a heuristic based on Last-Modified.
+// Stale entries are revalidated with If-None-Match and If-Modified-Since, and a 304 refreshes the stored entry.
+// Successful unsafe requests (POST, PUT, DELETE...) invalidate the entry of their target. Requests carrying Range or
+// conditional headers bypass the cache. Responses to requests carrying Authorization are only stored when marked
+// public, must-revalidate or s-maxage, as the directory may be shared.
+//
+// Entries are written atomically (temp file and rename) as bodies are read to EOF, and guarded by file locks, so that
+// several processes can share the same directory.
+//
+// Entries are only removed when invalidated: the cache grows without bound unless Prune is called periodically.
+type Cache struct {
+	// Transport sends the requests that cannot be answered from the cache. Defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+
+	root string
+}
+
+// NewCache returns a Cache stored under filesystem.CacheDir("http"), sending requests through transport.
+func NewCache(transport http.RoundTripper) (*Cache, error) {
+	root, err := filesystem.CacheDir("http")
+	if err != nil {
+		return nil, err //nolint:wrapcheck // filesystem errors are wrapped already
+	}
+
+	return NewCacheAt(root, transport), nil
+}
+
+// NewCacheAt returns a Cache stored under root, sending requests through transport.
+// Panics if root contains invalid path components.
+func NewCacheAt(root string, transport http.RoundTripper) *Cache {
+	if err := filesystem.ValidatePath(root); err != nil {
+		panic(fmt.Errorf("Cache: invalid root path: %w", err))
+	}
+
+	return &Cache{Transport: transport, root: root}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (c *Cache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !cacheableRequest(req) {
+		resp, err := c.transport().RoundTrip(req)
+		if err == nil && !safeMethod(req.Method) && resp.StatusCode < http.StatusBadRequest {
+			c.invalidate(req, resp)
+		}
+
+		return resp, err //nolint:wrapcheck // pass through
+	}
+
+	reqControl := parseCacheControl(req.Header)
+	if reqControl.has("no-store") {
+		return c.transport().RoundTrip(req) //nolint:wrapcheck // pass through
+	}
+
+	key := cacheKey(req.URL)
+
+	entry, body := c.lookup(req, key)
+	if entry != nil && entry.fresh(reqControl, time.Now()) {
+		return entry.response(req, body), nil
+	}
+
+	if reqControl.has("only-if-cached") {
+		if body != nil {
+			_ = body.Close()
+		}
+
+		return gatewayTimeout(req), nil
+	}
+
+	return c.forward(req, key, reqControl, entry, body)
+}
+
+// forward sends req, conditionally if a stale entry is available, and stores the response if possible.
+func (c *Cache) forward(
+	req *http.Request,
+	key string,
+	reqControl cacheControl,
+	entry *cacheEntry,
+	body io.ReadCloser,
+) (*http.Response, error) {
+	outgoing := req
+
+	if entry != nil {
+		outgoing = req.Clone(req.Context())
+
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			outgoing.Header.Set("If-None-Match", etag)
+		}
+
+		if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+			outgoing.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	requestTime := time.Now()
+
+	resp, err := c.transport().RoundTrip(outgoing)
+	if err != nil {
+		if body != nil {
+			_ = body.Close()
+		}
+
+		return nil, err //nolint:wrapcheck // pass through
+	}
+
+	responseTime := time.Now()
+
+	if entry != nil && resp.StatusCode == http.StatusNotModified {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, retryDrainLimit))
+		_ = resp.Body.Close()
+
+		entry.refresh(resp.Header, requestTime, responseTime)
+
+		if err = c.rewrite(key, entry); err != nil {
+			slog.DebugContext(req.Context(), "failed to refresh HTTP cache entry",
+				slog.String("url", req.URL.Redacted()),
+				slog.Any("error", err))
+		}
+
+		return entry.response(req, body), nil
+	}
+
+	if body != nil {
+		_ = body.Close()
+	}
+
+	if storable(req, reqControl, resp) {
+		c.store(req, key, resp, requestTime, responseTime)
+	}
+
+	return resp, nil
+}
+
+// lookup returns the entry stored for req, with its body, or nil if there is none or if it does not match req.
+func (c *Cache) lookup(req *http.Request, key string) (*cacheEntry, io.ReadCloser) {
+	var (
+		entry *cacheEntry
+		body  io.ReadCloser
+	)
+
+	err := c.withEntryLock(key, filesystem.ReadOnlyLock, func() error {
+		var err error
+
+		entry, body, err = readCacheEntry(c.entryPath(key))
+
+		return err
+	})
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.DebugContext(req.Context(), "ignoring unreadable HTTP cache entry",
+				slog.String("url", req.URL.Redacted()),
+				slog.Any("error", err))
+		}
+
+		return nil, nil
+	}
+
+	if entry.URL != cacheURL(req.URL) || !entry.matches(req) {
+		_ = body.Close()
+
+		return nil, nil
+	}
+
+	return entry, body
+}
+
+// store makes resp.Body write the response to the cache as it is read, committing the entry on EOF.
+func (c *Cache) store(req *http.Request, key string, resp *http.Response, requestTime, responseTime time.Time) {
+	entry := &cacheEntry{
+		URL:          cacheURL(req.URL),
+		Status:       resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+
+	for _, field := range headerTokens(resp.Header, "Vary") {
+		if entry.Vary == nil {
+			entry.Vary = map[string]string{}
+		}
+
+		entry.Vary[http.CanonicalHeaderKey(field)] = strings.Join(req.Header.Values(field), ", ")
+	}
+
+	temp, err := c.createTemp(key, entry)
+	if err != nil {
+		slog.DebugContext(req.Context(), "failed to store HTTP response in cache",
+			slog.String("url", req.URL.Redacted()),
+			slog.Any("error", err))
+
+		return
+	}
+
+	resp.Body = &cachingBody{
+		ReadCloser: resp.Body,
+		cache:      c,
+		key:        key,
+		temp:       temp,
+		expected:   resp.ContentLength,
+		req:        req,
+	}
+}
+
+// rewrite replaces the metadata of the entry stored under key, keeping its body.
+func (c *Cache) rewrite(key string, entry *cacheEntry) error {
+	return c.withEntryLock(key, filesystem.Lock, func() error {
+		_, body, err := readCacheEntry(c.entryPath(key))
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			_ = body.Close()
+		}()
+
+		temp, err := c.createTemp(key, entry)
+		if err != nil {
+			return err
+		}
+
+		if _, err = io.Copy(temp, body); err != nil {
+			return errors.Join(filesystem.ErrAtomicWriteFail, err, discardTemp(temp))
+		}
+
+		return commitTemp(temp, c.entryPath(key))
+	})
+}
+
+// invalidate removes the entries for the target of a successful unsafe request, and for its Location and
+// Content-Location when they share its origin.
+func (c *Cache) invalidate(req *http.Request, resp *http.Response) {
+	targets := []*url.URL{req.URL}
+
+	for _, header := range []string{"Location", "Content-Location"} {
+		if value := resp.Header.Get(header); value != "" {
+			if target, err := req.URL.Parse(value); err == nil && origin(target) == origin(req.URL) {
+				targets = append(targets, target)
+			}
+		}
+	}
+
+	for _, target := range targets {
+		key := cacheKey(target)
+
+		err := c.withEntryLock(key, filesystem.Lock, func() error {
+			return c.remove(key)
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.DebugContext(req.Context(), "failed to invalidate HTTP cache entry",
+				slog.String("url", target.Redacted()),
+				slog.Any("error", err))
+		}
+	}
+}
+
+// Prune removes the entries stored more than maxAge ago, then the least recently stored or revalidated entries until
+// the cache holds at most maxSize bytes, along with the lock files of missing entries and abandoned temporary files.
+// A zero maxAge or maxSize disables the corresponding bound. Entries stored or refreshed concurrently are kept.
+// Returns the number of entries removed and the number of bytes freed.
+func (c *Cache) Prune(maxSize int64, maxAge time.Duration) (removed int, freed int64, err error) {
+	entries, err := c.scan()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	slices.SortFunc(entries, func(a, b cacheFile) int {
+		return a.info.ModTime().Compare(b.info.ModTime())
+	})
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.info.Size()
+	}
+
+	now := time.Now()
+
+	for _, entry := range entries {
+		expired := maxAge > 0 && now.Sub(entry.info.ModTime()) > maxAge
+		if !expired && (maxSize <= 0 || total <= maxSize) {
+			break
+		}
+
+		pruned := false
+
+		err = c.withEntryLock(entry.key, filesystem.Lock, func() error {
+			// Keep the entry if it was replaced since the scan.
+			current, statErr := os.Stat(c.entryPath(entry.key))
+			if statErr != nil || !os.SameFile(current, entry.info) {
+				return nil //nolint:nilerr // Nothing to prune
+			}
+
+			pruned = true
+
+			return c.remove(entry.key)
+		})
+		if err != nil {
+			return removed, freed, err
+		}
+
+		total -= entry.info.Size()
+
+		if pruned {
+			removed++
+			freed += entry.info.Size()
+		}
+	}
+
+	return removed, freed, c.removeStaleLocks()
+}
+
+// cacheFile is an entry found on disk by scan.
+type cacheFile struct {
+	key  string
+	info os.FileInfo
+}
+
+// scan lists the stored entries, removing temporary files older than cacheTempGrace.
+func (c *Cache) scan() ([]cacheFile, error) {
+	shards, err := os.ReadDir(c.root)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	var entries []cacheFile
+
+	for _, shard := range shards {
+		if !shard.IsDir() || shard.Name() == cacheLocksDir {
+			continue
+		}
+
+		files, err := os.ReadDir(filepath.Join(c.root, shard.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+		}
+
+		for _, file := range files {
+			info, err := file.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+
+			if strings.HasPrefix(file.Name(), cacheTempPrefix) {
+				if time.Since(info.ModTime()) > cacheTempGrace {
+					_ = os.Remove(filepath.Join(c.root, shard.Name(), file.Name()))
+				}
+
+				continue
+			}
+
+			if validCacheKey(file.Name()) {
+				entries = append(entries, cacheFile{key: file.Name(), info: info})
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// removeStaleLocks removes the lock files of entries that are not stored, such as those created by cache misses.
+func (c *Cache) removeStaleLocks() error {
+	locks, err := os.ReadDir(filepath.Join(c.root, cacheLocksDir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	for _, lock := range locks {
+		key := lock.Name()
+		if !validCacheKey(key) {
+			continue
+		}
+
+		if _, err = os.Stat(c.entryPath(key)); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		err = c.withEntryLock(key, filesystem.Lock, func() error {
+			if _, statErr := os.Stat(c.entryPath(key)); errors.Is(statErr, os.ErrNotExist) {
+				_ = os.Remove(c.lockPath(key))
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remove deletes the entry stored under key and its lock file. The lock of the entry must be held exclusively.
+func (c *Cache) remove(key string) error {
+	if err := os.Remove(c.entryPath(key)); err != nil {
+		return fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	// Lockers of the removed lock file notice it is gone, see lockRemovable.
+	_ = os.Remove(c.lockPath(key))
+
+	return nil
+}
+
+// withEntryLock runs function while holding a lock on the entry stored under key. Lock files are removed with their
+// entry, by invalidate and Prune.
+func (c *Cache) withEntryLock(key string, lock func(string) (*os.File, error), function func() error) (err error) {
+	if err = os.MkdirAll(filepath.Join(c.root, cacheLocksDir), filesystem.DirPermissionsPrivate); err != nil {
+		return fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	locked, err := lockRemovable(c.lockPath(key), lock)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if unlockErr := filesystem.Unlock(locked); unlockErr != nil {
+			err = errors.Join(err, fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, unlockErr))
+		}
+	}()
+
+	return function()
+}
+
+// createTemp creates a temporary file for the entry stored under key, with the entry metadata written.
+func (c *Cache) createTemp(key string, entry *cacheEntry) (*os.File, error) {
+	dir := filepath.Dir(c.entryPath(key))
+
+	if err := os.MkdirAll(dir, filesystem.DirPermissionsPrivate); err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	metadata, err := json.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrSystemFailure, err)
+	}
+
+	temp, err := os.CreateTemp(dir, cacheTempPrefix+key)
+	if err != nil {
+		return nil, errors.Join(filesystem.ErrAtomicWriteFail, err)
+	}
+
+	if err = os.Chmod(temp.Name(), (^os.FileMode(filesystem.GetUmask()))&filesystem.FilePermissionsPrivate); err != nil {
+		return nil, errors.Join(filesystem.ErrAtomicWriteFail, err, discardTemp(temp))
+	}
+
+	if _, err = temp.Write(append(metadata, '\n')); err != nil {
+		return nil, errors.Join(filesystem.ErrAtomicWriteFail, err, discardTemp(temp))
+	}
+
+	return temp, nil
+}
+
+// commit moves a complete temporary file in place of the entry stored under key.
+func (c *Cache) commit(key string, temp *os.File) error {
+	return c.withEntryLock(key, filesystem.Lock, func() error {
+		return commitTemp(temp, c.entryPath(key))
+	})
+}
+
+func (c *Cache) entryPath(key string) string {
+	return filepath.Join(c.root, key[:2], key)
+}
+
+func (c *Cache) lockPath(key string) string {
+	return filepath.Join(c.root, cacheLocksDir, key)
+}
+
+func (c *Cache) transport() http.RoundTripper {
+	if c.Transport != nil {
+		return c.Transport
+	}
+
+	return http.DefaultTransport
+}
+
+// cacheEntry is the metadata of a stored response, written as a JSON line before its body.
+type cacheEntry struct {
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	// Vary holds the values of the request headers nominated by the Vary response header.
+	Vary         map[string]string `json:"vary,omitempty"`
+	RequestTime  time.Time         `json:"requestTime"`
+	ResponseTime time.Time         `json:"responseTime"`
+}
+
+// readCacheEntry opens the entry at path, returning its metadata and a reader positioned on its body.
+func readCacheEntry(path string) (*cacheEntry, io.ReadCloser, error) {
+	file, err := os.Open(path) //nolint:gosec // Entry path is derived from a hash in the cache directory
+	if err != nil {
+		return nil, nil, err //nolint:wrapcheck // callers check for os.ErrNotExist
+	}
+
+	reader := bufio.NewReader(file)
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, nil, errors.Join(fmt.Errorf("%w: %w", fault.ErrReadFailure, err), file.Close())
+	}
+
+	entry := &cacheEntry{}
+	if err = json.Unmarshal(line, entry); err != nil {
+		return nil, nil, errors.Join(fmt.Errorf("%w: %w", fault.ErrInvalidJSON, err), file.Close())
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, errors.Join(fmt.Errorf("%w: %w", fault.ErrReadFailure, err), file.Close())
+	}
+
+	return entry, &cachedBody{Reader: reader, file: file, size: info.Size() - int64(len(line))}, nil
+}
+
+// matches tells whether the request headers nominated by Vary have the same values as when the entry was stored.
+func (e *cacheEntry) matches(req *http.Request) bool {
+	for field, value := range e.Vary {
+		if strings.Join(req.Header.Values(field), ", ") != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fresh tells whether the entry can be served at now without revalidation, given the request directives.
+func (e *cacheEntry) fresh(reqControl cacheControl, now time.Time) bool {
+	respControl := parseCacheControl(e.Header)
+	if reqControl.has("no-cache") || respControl.has("no-cache") {
+		return false
+	}
+
+	lifetime := e.lifetime(respControl)
+	if maxAge, ok := reqControl.seconds("max-age"); ok {
+		lifetime = min(lifetime, maxAge)
+	}
+
+	age := e.age(now)
+	if minFresh, ok := reqControl.seconds("min-fresh"); ok {
+		age += minFresh
+	}
+
+	if age < lifetime {
+		return true
+	}
+
+	if !reqControl.has("max-stale") || respControl.has("must-revalidate") {
+		return false
+	}
+
+	maxStale, ok := reqControl.seconds("max-stale")
+
+	return !ok || age-lifetime < maxStale
+}
+
+// lifetime returns the freshness lifetime of the entry (RFC 9111 4.2.1).
+func (e *cacheEntry) lifetime(respControl cacheControl) time.Duration {
+	if maxAge, ok := respControl.seconds("max-age"); ok {
+		return maxAge
+	}
+
+	date := e.date()
+
+	if expires := e.Header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+
+		return expiresAt.Sub(date)
+	}
+
+	lastModified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	if err != nil || !heuristicallyCacheable[e.Status] || !lastModified.Before(date) {
+		return 0
+	}
+
+	return min(date.Sub(lastModified)/cacheHeuristicFraction, cacheHeuristicMax)
+}
+
+// age returns the current age of the entry (RFC 9111 4.2.3).
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparentAge := max(0, e.ResponseTime.Sub(e.date()))
+
+	ageValue := time.Duration(0)
+	if seconds, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+
+	correctedAge := ageValue + e.ResponseTime.Sub(e.RequestTime)
+
+	return max(apparentAge, correctedAge) + now.Sub(e.ResponseTime)
+}
+
+// date returns the Date of the response, or the time it was received if missing.
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+
+	return e.ResponseTime
+}
+
+// refresh updates the entry with the headers of a 304 response (RFC 9111 3.2).
+func (e *cacheEntry) refresh(header http.Header, requestTime, responseTime time.Time) {
+	for field, values := range header {
+		if field == "Content-Length" {
+			continue
+		}
+
+		e.Header[field] = values
+	}
+
+	e.RequestTime = requestTime
+	e.ResponseTime = responseTime
+}
+
+// response builds the response served from the entry.
+func (e *cacheEntry) response(req *http.Request, body io.ReadCloser) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(e.age(time.Now()).Seconds()), 10))
+
+	contentLength := int64(-1)
+	if cached, ok := body.(*cachedBody); ok {
+		contentLength = cached.size
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: contentLength,
+		Request:       req,
+	}
+}
+
+// cachedBody reads the body of a stored entry.
+type cachedBody struct {
+	io.Reader
+
+	file *os.File
+	size int64
+}
+
+// Close closes the entry file.
+//
+//nolint:wrapcheck // passthrough to underlying file
+func (cb *cachedBody) Close() error {
+	return cb.file.Close()
+}
+
+// cachingBody copies a response body to a temporary file as it is read, and commits it once read to EOF.
+// The entry is discarded if the body is closed early, fails, or does not match its Content-Length.
+type cachingBody struct {
+	io.ReadCloser
+
+	cache    *Cache
+	key      string
+	temp     *os.File
+	written  int64
+	expected int64
+	req      *http.Request
+}
+
+//nolint:wrapcheck // I/O wrapper must return unwrapped errors
+func (cb *cachingBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+
+	if cb.temp != nil && n > 0 {
+		if _, writeErr := cb.temp.Write(p[:n]); writeErr != nil {
+			cb.abandon(writeErr)
+		}
+
+		cb.written += int64(n)
+	}
+
+	switch {
+	case cb.temp == nil:
+	case errors.Is(err, io.EOF):
+		cb.finish()
+	case err != nil:
+		cb.abandon(err)
+	}
+
+	return n, err
+}
+
+// Close discards the entry if the body was not read to EOF, and closes the response body.
+//
+//nolint:wrapcheck // passthrough to response body
+func (cb *cachingBody) Close() error {
+	if cb.temp != nil {
+		cb.abandon(nil)
+	}
+
+	return cb.ReadCloser.Close()
+}
+
+func (cb *cachingBody) finish() {
+	temp := cb.temp
+	cb.temp = nil
+
+	if cb.expected >= 0 && cb.written != cb.expected {
+		cb.log(fmt.Errorf("%w: read %d bytes, expected %d", fault.ErrReadFailure, cb.written, cb.expected))
+		_ = discardTemp(temp)
+
+		return
+	}
+
+	if err := cb.cache.commit(cb.key, temp); err != nil {
+		cb.log(err)
+	}
+}
+
+func (cb *cachingBody) abandon(err error) {
+	if err != nil {
+		cb.log(err)
+	}
+
+	_ = discardTemp(cb.temp)
+	cb.temp = nil
+}
+
+func (cb *cachingBody) log(err error) {
+	slog.DebugContext(cb.req.Context(), "failed to store HTTP response in cache",
+		slog.String("url", cb.req.URL.Redacted()),
+		slog.Any("error", err))
+}
+
+func commitTemp(temp *os.File, target string) error {
+	if err := temp.Sync(); err != nil {
+		return errors.Join(filesystem.ErrAtomicWriteFail, err, discardTemp(temp))
+	}
+
+	if err := temp.Close(); err != nil {
+		return errors.Join(filesystem.ErrAtomicWriteFail, err, os.Remove(temp.Name()))
+	}
+
+	if err := os.Rename(temp.Name(), target); err != nil {
+		return errors.Join(filesystem.ErrAtomicWriteFail, err, os.Remove(temp.Name()))
+	}
+
+	return nil
+}
+
+func discardTemp(temp *os.File) error {
+	return errors.Join(temp.Close(), os.Remove(temp.Name()))
+}
+
+// cacheControl holds Cache-Control directives, with their value if any.
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	directives := cacheControl{}
+
+	for _, directive := range headerTokens(header, "Cache-Control") {
+		name, value, _ := strings.Cut(directive, "=")
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+
+	return directives
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+
+	return ok
+}
+
+// seconds returns the value of a delta-seconds directive. Invalid values are ignored.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	value, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+
+	return time.Duration(min(seconds, int64(maxDuration/time.Second))) * time.Second, true
+}
+
+// maxDuration is the largest time.Duration.
+const maxDuration = time.Duration(1<<63 - 1)
+
+// headerTokens splits the comma separated values of a header.
+func headerTokens(header http.Header, name string) []string {
+	var tokens []string
+
+	for _, value := range header.Values(name) {
+		for token := range strings.SplitSeq(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+
+	return tokens
+}
+
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != "" {
+		return false
+	}
+
+	for _, header := range []string{"Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+		if req.Header.Get(header) != "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// storable tells whether a response can be stored (RFC 9111 3).
+func storable(req *http.Request, reqControl cacheControl, resp *http.Response) bool {
+	if resp.StatusCode < http.StatusOK ||
+		resp.StatusCode == http.StatusPartialContent ||
+		resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+
+	respControl := parseCacheControl(resp.Header)
+	if reqControl.has("no-store") || respControl.has("no-store") || resp.Header.Get("Vary") == "*" {
+		return false
+	}
+
+	// Responses to authorized requests are only shared when explicitly allowed (RFC 9111 3.5).
+	if authorized(req, resp) &&
+		!respControl.has("public") && !respControl.has("must-revalidate") && !respControl.has("s-maxage") {
+		return false
+	}
+
+	explicit := respControl.has("max-age") || respControl.has("public") || resp.Header.Get("Expires") != ""
+	if !explicit && !heuristicallyCacheable[resp.StatusCode] {
+		return false
+	}
+
+	// Without explicit freshness nor validators, the entry would never be used.
+	return explicit || resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// authorized tells whether req carried credentials, either set by the caller or by the underlying transport.
+func authorized(req *http.Request, resp *http.Response) bool {
+	if req.Header.Get(authorizationHeader) != "" {
+		return true
+	}
+
+	return resp.Request != nil && resp.Request.Header.Get(authorizationHeader) != ""
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	default:
+		return false
+	}
+}
+
+// cacheURL returns the URL an entry is stored for, without fragment.
+func cacheURL(target *url.URL) string {
+	stripped := *target
+	stripped.Fragment = ""
+	stripped.RawFragment = ""
+
+	return stripped.String()
+}
+
+func cacheKey(target *url.URL) string {
+	sum := sha256.Sum256([]byte(cacheURL(target)))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// validCacheKey tells whether name is a key returned by cacheKey.
+func validCacheKey(name string) bool {
+	decoded, err := hex.DecodeString(name)
+
+	return err == nil && len(decoded) == sha256.Size && strings.ToLower(name) == name
+}
+
+// gatewayTimeout is the response to an only-if-cached request that cannot be served from the cache.
+func gatewayTimeout(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout)),
+		StatusCode: http.StatusGatewayTimeout,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       io.NopCloser(bytes.NewReader(nil)),
+		Request:    req,
+	}
+}
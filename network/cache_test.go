@@ -0,0 +1,385 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mycophonic/primordium/network"
+)
+
+// originServer serves body with header, answering conditional requests, and records the requests it receives.
+type originServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+	header   http.Header
+	body     string
+}
+
+func newOriginServer(t *testing.T, header http.Header, body string) *originServer {
+	t.Helper()
+
+	origin := &originServer{header: header, body: body}
+	origin.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin.mu.Lock()
+		origin.requests = append(origin.requests, r)
+		header, body := origin.header.Clone(), origin.body
+		origin.mu.Unlock()
+
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+
+		if r.Method != http.MethodGet {
+			return
+		}
+
+		if etag := header.Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		if lastModified := header.Get("Last-Modified"); lastModified != "" &&
+			r.Header.Get("If-Modified-Since") == lastModified {
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		_, _ = io.WriteString(w, body)
+	}))
+	t.Cleanup(origin.Close)
+
+	return origin
+}
+
+func (o *originServer) received() []*http.Request {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]*http.Request(nil), o.requests...)
+}
+
+func cachedGet(t *testing.T, cache *network.Cache, url string, header http.Header) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := (&http.Client{Transport: cache}).Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body failed: %v", err)
+	}
+
+	return resp, string(body)
+}
+
+func TestCache_ServesFreshResponses(t *testing.T) {
+	t.Parallel()
+
+	origin := newOriginServer(t, http.Header{"Cache-Control": {"max-age=60"}}, "cover")
+	cache := network.NewCacheAt(t.TempDir(), newTransport(t))
+
+	cachedGet(t, cache, origin.URL, nil)
+
+	resp, body := cachedGet(t, cache, origin.URL, nil)
+	if body != "cover" || resp.StatusCode != http.StatusOK {
+		t.Errorf("cached response = %d %q, want 200 %q", resp.StatusCode, body, "cover")
+	}
+
+	if resp.Header.Get("Age") == "" {
+		t.Error("cached response has no Age header")
+	}
+
+	if got := len(origin.received()); got != 1 {
+		t.Errorf("origin received %d requests, want 1", got)
+	}
+
+	// Requests can ask for a revalidation, and fail rather than reach the origin.
+	cachedGet(t, cache, origin.URL, http.Header{"Cache-Control": {"no-cache"}})
+
+	if got := len(origin.received()); got != 2 {
+		t.Errorf("origin received %d requests after no-cache, want 2", got)
+	}
+
+	resp, _ = cachedGet(t, cache, origin.URL+"/missing", http.Header{"Cache-Control": {"only-if-cached"}})
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("only-if-cached miss status = %d, want 504", resp.StatusCode)
+	}
+}
+
+func TestCache_Revalidates(t *testing.T) {
+	t.Parallel()
+
+	for name, header := range map[string]http.Header{
+		"ETag":          {"Etag": {`"v1"`}, "Cache-Control": {"no-cache"}},
+		"Last-Modified": {"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}, "Cache-Control": {"max-age=0"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			origin := newOriginServer(t, header, "metadata")
+			cache := network.NewCacheAt(t.TempDir(), newTransport(t))
+
+			cachedGet(t, cache, origin.URL, nil)
+
+			resp, body := cachedGet(t, cache, origin.URL, nil)
+			if body != "metadata" || resp.StatusCode != http.StatusOK {
+				t.Errorf("revalidated response = %d %q, want 200 %q", resp.StatusCode, body, "metadata")
+			}
+
+			requests := origin.received()
+			if len(requests) != 2 {
+				t.Fatalf("origin received %d requests, want 2", len(requests))
+			}
+
+			if requests[1].Header.Get("If-None-Match") == "" && requests[1].Header.Get("If-Modified-Since") == "" {
+				t.Error("second request was not conditional")
+			}
+		})
+	}
+}
+
+func TestCache_DoesNotStore(t *testing.T) {
+	t.Parallel()
+
+	for name, header := range map[string]http.Header{
+		"no-store":     {"Cache-Control": {"no-store"}, "Etag": {`"v1"`}},
+		"no-validator": {},
+		"vary-star":    {"Cache-Control": {"max-age=60"}, "Vary": {"*"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			origin := newOriginServer(t, header, "private")
+			cache := network.NewCacheAt(t.TempDir(), newTransport(t))
+
+			cachedGet(t, cache, origin.URL, nil)
+			cachedGet(t, cache, origin.URL, nil)
+
+			requests := origin.received()
+			if len(requests) != 2 {
+				t.Fatalf("origin received %d requests, want 2", len(requests))
+			}
+
+			if requests[1].Header.Get("If-None-Match") != "" {
+				t.Error("second request was conditional")
+			}
+		})
+	}
+}
+
+func TestCache_Authorization(t *testing.T) {
+	t.Parallel()
+
+	for name, test := range map[string]struct {
+		header    http.Header
+		transport bool
+		requests  int
+	}{
+		"private":               {http.Header{"Cache-Control": {"max-age=60"}}, false, 2},
+		"transport-credentials": {http.Header{"Cache-Control": {"max-age=60"}}, true, 2},
+		"public":                {http.Header{"Cache-Control": {"public, max-age=60"}}, false, 1},
+		"s-maxage":              {http.Header{"Cache-Control": {"max-age=60, s-maxage=60"}}, false, 1},
+		"must-revalidate":       {http.Header{"Cache-Control": {"max-age=60, must-revalidate"}}, false, 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			origin := newOriginServer(t, test.header, "account")
+			rt := newTransport(t)
+			cache := network.NewCacheAt(t.TempDir(), rt)
+
+			if test.transport {
+				rt.TokenType, rt.TokenValue = "Bearer", "secret-token"
+				cachedGet(t, cache, origin.URL, nil)
+			} else {
+				cachedGet(t, cache, origin.URL, http.Header{"Authorization": {"Bearer secret-token"}})
+			}
+
+			rt.TokenValue = ""
+			cachedGet(t, cache, origin.URL, nil)
+
+			if got := len(origin.received()); got != test.requests {
+				t.Errorf("origin received %d requests, want %d", got, test.requests)
+			}
+		})
+	}
+}
+
+func TestCache_Vary(t *testing.T) {
+	t.Parallel()
+
+	origin := newOriginServer(t, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept"}}, "image")
+	cache := network.NewCacheAt(t.TempDir(), newTransport(t))
+
+	cachedGet(t, cache, origin.URL, http.Header{"Accept": {"image/png"}})
+	cachedGet(t, cache, origin.URL, http.Header{"Accept": {"image/png"}})
+	cachedGet(t, cache, origin.URL, http.Header{"Accept": {"image/webp"}})
+
+	if got := len(origin.received()); got != 2 {
+		t.Errorf("origin received %d requests, want 2", got)
+	}
+}
+
+func TestCache_InvalidatesOnUnsafeRequests(t *testing.T) {
+	t.Parallel()
+
+	origin := newOriginServer(t, http.Header{"Cache-Control": {"max-age=60"}}, "v1")
+	cache := network.NewCacheAt(t.TempDir(), newTransport(t))
+
+	cachedGet(t, cache, origin.URL, nil)
+
+	origin.mu.Lock()
+	origin.body = "v2"
+	origin.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPut, origin.URL, strings.NewReader("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := (&http.Client{Transport: cache}).Do(req)
+	if err != nil {
+		t.Fatalf("PUT failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if _, body := cachedGet(t, cache, origin.URL, nil); body != "v2" {
+		t.Errorf("body after PUT = %q, want %q", body, "v2")
+	}
+}
+
+func TestCache_SharedAcrossInstances(t *testing.T) {
+	t.Parallel()
+
+	origin := newOriginServer(t, http.Header{"Cache-Control": {"max-age=60"}}, strings.Repeat("art", 10000))
+	root := t.TempDir()
+
+	// An entry is only committed once its body has been read to EOF.
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, origin.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := (&http.Client{Transport: network.NewCacheAt(root, newTransport(t))}).Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	_, _ = io.ReadFull(resp.Body, make([]byte, 10))
+	_ = resp.Body.Close()
+
+	cachedGet(t, network.NewCacheAt(root, newTransport(t)), origin.URL, nil)
+
+	if _, body := cachedGet(t, network.NewCacheAt(root, newTransport(t)), origin.URL, nil); len(body) != 30000 {
+		t.Errorf("cached body has %d bytes, want 30000", len(body))
+	}
+
+	if got := len(origin.received()); got != 2 {
+		t.Errorf("origin received %d requests, want 2", got)
+	}
+}
+
+func TestCache_Prune(t *testing.T) {
+	t.Parallel()
+
+	origin := newOriginServer(t, http.Header{"Cache-Control": {"max-age=3600"}}, strings.Repeat("art", 100))
+	root := t.TempDir()
+	cache := network.NewCacheAt(root, newTransport(t))
+
+	entryPath := func(url string) string {
+		sum := sha256.Sum256([]byte(url))
+		key := hex.EncodeToString(sum[:])
+
+		return filepath.Join(root, key[:2], key)
+	}
+
+	// Entries stored 3h, 2h and 1h ago.
+	urls := []string{origin.URL + "/old", origin.URL + "/older", origin.URL + "/recent"}
+	for i, url := range []string{urls[1], urls[0], urls[2]} {
+		cachedGet(t, cache, url, nil)
+
+		stored := time.Now().Add(-time.Duration(3-i) * time.Hour)
+		if err := os.Chtimes(entryPath(url), stored, stored); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A miss leaves a lock file behind.
+	cachedGet(t, network.NewCacheAt(root, http.NewFileTransport(http.Dir(t.TempDir()))), origin.URL+"/miss", nil)
+
+	removed, freed, err := cache.Prune(0, 150*time.Minute)
+	if err != nil || removed != 1 || freed == 0 {
+		t.Fatalf("Prune(age) = %d, %d, %v, want 1 entry removed", removed, freed, err)
+	}
+
+	info, err := os.Stat(entryPath(urls[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed, _, err = cache.Prune(info.Size(), 0); err != nil || removed != 1 {
+		t.Fatalf("Prune(size) = %d, %v, want 1 entry removed", removed, err)
+	}
+
+	for i, url := range urls {
+		if _, err = os.Stat(entryPath(url)); (i == 2) != (err == nil) {
+			t.Errorf("entry for %s: %v", url, err)
+		}
+	}
+
+	locks, err := os.ReadDir(filepath.Join(root, ".locks"))
+	if err != nil || len(locks) != 1 || locks[0].Name() != filepath.Base(entryPath(urls[2])) {
+		t.Errorf("lock files after Prune = %v (err: %v), want only the remaining entry", locks, err)
+	}
+
+	requests := len(origin.received())
+	cachedGet(t, cache, urls[2], nil)
+
+	if got := len(origin.received()); got != requests {
+		t.Errorf("remaining entry was not served from the cache")
+	}
+}
@@ -0,0 +1,103 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"cmp"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Config describes HTTP transports, without relying on global state: every call to Build returns an independent
+// RoundTripper. The zero value is usable, and zero fields apply the defaults.
+type Config struct {
+	// DialTimeout defaults to 30s, and KeepAlive to 30s.
+	DialTimeout time.Duration
+	KeepAlive   time.Duration
+	// TLSHandshakeTimeout defaults to 10s, ResponseHeaderTimeout to 30s, IdleConnTimeout to 90s and
+	// ExpectContinueTimeout to 1s.
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	ExpectContinueTimeout time.Duration
+	// MaxIdleConns, MaxIdleConnsPerHost and MaxConnsPerHost default to 100.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	// Proxy routes connections. Defaults to the environment (HTTP_PROXY, HTTPS_PROXY and NO_PROXY).
+	Proxy *ProxyConfig
+	// Timeout bounds whole requests, including reading the response body, for clients returned by Client. Zero means
+	// no limit.
+	Timeout time.Duration
+}
+
+// Build returns a new RoundTripper using TLS 1.3 with post-quantum key exchange, HTTP/2, and the configured timeouts,
+// connection pools and proxies, with opts applied.
+func (c *Config) Build(opts ...TransportOption) (*RoundTripper, error) {
+	rt := c.roundTripper()
+
+	if c.Proxy != nil {
+		opts = append([]TransportOption{WithProxy(c.Proxy)}, opts...)
+	}
+
+	for _, opt := range opts {
+		if err := opt(rt); err != nil {
+			return nil, err
+		}
+	}
+
+	return rt, nil
+}
+
+// Client returns a new http.Client using a RoundTripper built with opts.
+func (c *Config) Client(opts ...TransportOption) (*http.Client, error) {
+	rt, err := c.Build(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{Transport: rt, Timeout: c.Timeout}, nil
+}
+
+// roundTripper returns a new RoundTripper with the configured timeouts and connection pools.
+func (c *Config) roundTripper() *RoundTripper {
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ForceAttemptHTTP2:     true, // Required when setting a custom TLSClientConfig
+		TLSHandshakeTimeout:   cmp.Or(c.TLSHandshakeTimeout, tlsHandshakeTimeout),
+		ResponseHeaderTimeout: cmp.Or(c.ResponseHeaderTimeout, responseHeaderTimeout),
+		IdleConnTimeout:       cmp.Or(c.IdleConnTimeout, idleConnTimeout),
+		ExpectContinueTimeout: cmp.Or(c.ExpectContinueTimeout, expectContinueTimeout),
+		MaxIdleConns:          cmp.Or(c.MaxIdleConns, maxIdleConns),
+		MaxIdleConnsPerHost:   cmp.Or(c.MaxIdleConnsPerHost, maxIdleConnsPerHost),
+		MaxConnsPerHost:       cmp.Or(c.MaxConnsPerHost, maxConnsPerHost),
+		TLSClientConfig:       defaultTLSConfig(),
+	}
+
+	rt := &RoundTripper{
+		Transport: transport,
+		dialer: &net.Dialer{
+			Timeout:   cmp.Or(c.DialTimeout, dialTimeout),
+			KeepAlive: cmp.Or(c.KeepAlive, dialKeepAlive),
+		},
+	}
+
+	transport.DialContext = rt.dialContext
+
+	return rt
+}
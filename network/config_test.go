@@ -0,0 +1,100 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mycophonic/primordium/network"
+	"github.com/mycophonic/primordium/network/networktest"
+)
+
+func TestConfig_BuildIsIndependent(t *testing.T) {
+	t.Parallel()
+
+	config := &network.Config{MaxConnsPerHost: 4, ResponseHeaderTimeout: time.Second}
+
+	first, err := config.Build()
+	if err != nil {
+		t.Fatalf("Build returned error: %v", err)
+	}
+
+	second, err := config.Build()
+	if err != nil {
+		t.Fatalf("Build returned error: %v", err)
+	}
+
+	if first.Transport == second.Transport || first.TLSClientConfig == second.TLSClientConfig {
+		t.Fatal("built transports share state")
+	}
+
+	if def, ok := http.DefaultTransport.(*network.RoundTripper); ok && first.Transport == def.Transport {
+		t.Fatal("built transport is http.DefaultTransport")
+	}
+
+	first.TLSClientConfig.MinVersion = tls.VersionTLS12
+
+	if second.TLSClientConfig.MinVersion != tls.VersionTLS13 {
+		t.Error("modifying a built transport affected another one")
+	}
+
+	if first.MaxConnsPerHost != 4 || first.ResponseHeaderTimeout != time.Second {
+		t.Errorf("configured values not applied: %d, %s", first.MaxConnsPerHost, first.ResponseHeaderTimeout)
+	}
+
+	if first.MaxIdleConns == 0 || first.TLSHandshakeTimeout == 0 || !first.ForceAttemptHTTP2 {
+		t.Error("defaults not applied to unset values")
+	}
+}
+
+func TestConfig_Client(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "proxied")
+	}))
+	t.Cleanup(server.Close)
+
+	proxy := networktest.NewHTTPProxy(t, "", "")
+
+	config := &network.Config{Proxy: proxyConfig(proxy.URL), Timeout: 5 * time.Second}
+
+	client, err := config.Client()
+	if err != nil {
+		t.Fatalf("Client returned error: %v", err)
+	}
+
+	if client.Timeout != 5*time.Second {
+		t.Errorf("client Timeout = %s, want 5s", client.Timeout)
+	}
+
+	resp, err := getResponse(t, client, server.URL, nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if len(proxy.Targets()) != 1 {
+		t.Errorf("request did not go through the configured proxy: %v", proxy.Targets())
+	}
+}
@@ -0,0 +1,310 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mycophonic/primordium/fault"
+)
+
+const (
+	dnsDefaultPort      = "53"
+	dnsMessageMediaType = "application/dns-message"
+	// dnsMaxMessageSize is the largest DNS message, as bounded by the length prefix of stream transports.
+	dnsMaxMessageSize = 65535
+	dnsLengthSize     = 2
+)
+
+// WithResolver resolves host names with the DNS server at address ("host[:port]", port 53 by default) instead of the
+// system resolver.
+func WithResolver(address string) TransportOption {
+	return func(rt *RoundTripper) error {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, dnsDefaultPort)
+		}
+
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("%w: resolver address %q: %w", fault.ErrInvalidArgument, address, err)
+		}
+
+		dialer := &net.Dialer{Timeout: dialTimeout}
+
+		rt.dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				slog.DebugContext(ctx, "querying DNS server", slog.String("server", address), slog.String("network", network))
+
+				return dialer.DialContext(ctx, network, address)
+			},
+		}
+
+		return nil
+	}
+}
+
+// WithDNSOverHTTPS resolves host names with the DNS-over-HTTPS (RFC 8484) server at endpoint
+// ("https://dns.example/dns-query"), queried through a transport built with NewTransportWithOptions and opts.
+// The host of the endpoint itself is resolved with the system resolver, unless it is an IP address.
+func WithDNSOverHTTPS(endpoint string, opts ...TransportOption) TransportOption {
+	return func(rt *RoundTripper) error {
+		parsed, err := url.Parse(endpoint)
+		if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+			return errors.Join(fmt.Errorf("%w: DNS-over-HTTPS endpoint %q must be an https URL",
+				fault.ErrInvalidArgument, endpoint), err)
+		}
+
+		transport, err := NewTransportWithOptions(opts...)
+		if err != nil {
+			return err
+		}
+
+		client := &http.Client{Transport: transport}
+
+		rt.dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return &dohConn{ctx: ctx, client: client, endpoint: parsed.String()}, nil
+			},
+		}
+
+		return nil
+	}
+}
+
+// WithHosts resolves the host names of hosts to the given IP addresses, before and instead of any resolver.
+// Addresses are tried in order.
+func WithHosts(hosts map[string][]string) TransportOption {
+	return func(rt *RoundTripper) error {
+		if rt.hosts == nil {
+			rt.hosts = map[string][]netip.Addr{}
+		}
+
+		for host, values := range hosts {
+			addrs := make([]netip.Addr, 0, len(values))
+
+			for _, value := range values {
+				addr, err := netip.ParseAddr(value)
+				if err != nil {
+					return fmt.Errorf("%w: address %q for %s: %w", fault.ErrInvalidArgument, value, host, err)
+				}
+
+				addrs = append(addrs, addr)
+			}
+
+			if len(addrs) == 0 {
+				return fmt.Errorf("%w: no address for %s", fault.ErrInvalidArgument, host)
+			}
+
+			rt.hosts[strings.ToLower(host)] = addrs
+		}
+
+		return nil
+	}
+}
+
+// WithHappyEyeballs sets the delay after which a fallback connection over the other address family is attempted
+// (RFC 8305), when a host resolves to both IPv6 and IPv4 addresses. Zero applies the default of 300ms, and a negative
+// value disables fallback.
+func WithHappyEyeballs(fallbackDelay time.Duration) TransportOption {
+	return func(rt *RoundTripper) error {
+		rt.dialer.FallbackDelay = fallbackDelay
+
+		return nil
+	}
+}
+
+// dialContext connects to address with the configured dialer, after applying host overrides.
+func (rt *RoundTripper) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrInvalidArgument, err)
+	}
+
+	addrs, overridden := rt.hosts[strings.ToLower(host)]
+	if !overridden {
+		start := time.Now()
+
+		conn, err := rt.dialer.DialContext(ctx, network, address)
+		if err == nil && net.ParseIP(host) == nil {
+			slog.DebugContext(ctx, "dialed host",
+				slog.String("host", host),
+				slog.String("address", conn.RemoteAddr().String()),
+				slog.Duration("duration", time.Since(start)))
+		}
+
+		return conn, err //nolint:wrapcheck // pass through
+	}
+
+	slog.DebugContext(ctx, "resolved host from static overrides",
+		slog.String("host", host),
+		slog.Any("addresses", addrs))
+
+	var errs []error
+
+	for _, addr := range addrs {
+		conn, err := rt.dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+
+		errs = append(errs, err)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// dohConn exchanges DNS messages with a DNS-over-HTTPS server, posing as a stream connection to net.Resolver: it
+// receives length prefixed queries and returns length prefixed responses.
+type dohConn struct {
+	ctx      context.Context //nolint:containedctx // Dial context, bounding the exchanges.
+	client   *http.Client
+	endpoint string
+	deadline time.Time
+	query    bytes.Buffer
+	response bytes.Reader
+}
+
+func (dc *dohConn) Write(p []byte) (int, error) {
+	dc.query.Write(p)
+
+	if dc.query.Len() < dnsLengthSize {
+		return len(p), nil
+	}
+
+	size := int(binary.BigEndian.Uint16(dc.query.Bytes()))
+	if dc.query.Len() < dnsLengthSize+size {
+		return len(p), nil
+	}
+
+	message := bytes.Clone(dc.query.Bytes()[dnsLengthSize : dnsLengthSize+size])
+	dc.query.Next(dnsLengthSize + size)
+
+	answer, err := dc.exchange(message)
+	if err != nil {
+		return 0, err
+	}
+
+	dc.response.Reset(append(binary.BigEndian.AppendUint16(nil, uint16(len(answer))), answer...))
+
+	return len(p), nil
+}
+
+func (dc *dohConn) exchange(message []byte) ([]byte, error) {
+	ctx := dc.ctx
+	if !dc.deadline.IsZero() {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithDeadline(ctx, dc.deadline)
+		defer cancel()
+	}
+
+	slog.DebugContext(ctx, "querying DNS-over-HTTPS server", slog.String("endpoint", dc.endpoint))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dc.endpoint, bytes.NewReader(message))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrInvalidArgument, err)
+	}
+
+	req.Header.Set("Content-Type", dnsMessageMediaType)
+	req.Header.Set("Accept", dnsMessageMediaType)
+
+	resp, err := dc.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: DNS-over-HTTPS: %w", fault.ErrNetworkError, err)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: DNS-over-HTTPS server returned %s", fault.ErrUnacceptableResponse, resp.Status)
+	}
+
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, dnsMaxMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: DNS-over-HTTPS: %w", fault.ErrNetworkError, err)
+	}
+
+	if len(answer) > dnsMaxMessageSize {
+		return nil, fmt.Errorf("%w: DNS-over-HTTPS response exceeds %d bytes",
+			fault.ErrUnacceptableResponse, dnsMaxMessageSize)
+	}
+
+	return answer, nil
+}
+
+//nolint:wrapcheck // I/O wrapper must return unwrapped errors
+func (dc *dohConn) Read(p []byte) (int, error) {
+	return dc.response.Read(p)
+}
+
+func (dc *dohConn) Close() error {
+	return nil
+}
+
+func (dc *dohConn) LocalAddr() net.Addr {
+	return dohAddr(dc.endpoint)
+}
+
+func (dc *dohConn) RemoteAddr() net.Addr {
+	return dohAddr(dc.endpoint)
+}
+
+func (dc *dohConn) SetDeadline(deadline time.Time) error {
+	dc.deadline = deadline
+
+	return nil
+}
+
+func (dc *dohConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (dc *dohConn) SetWriteDeadline(deadline time.Time) error {
+	dc.deadline = deadline
+
+	return nil
+}
+
+// dohAddr is the net.Addr of a DNS-over-HTTPS endpoint.
+type dohAddr string
+
+func (dohAddr) Network() string {
+	return "https"
+}
+
+func (da dohAddr) String() string {
+	return string(da)
+}
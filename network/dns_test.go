@@ -0,0 +1,192 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/network"
+	"github.com/mycophonic/primordium/network/networktest"
+)
+
+// dnsAnswer answers a DNS query with 127.0.0.1 for A questions, and no record otherwise.
+//
+//nolint:mnd // DNS wire format
+func dnsAnswer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+
+	end += 5 // Root label, type and class.
+	if end > len(query) {
+		return nil
+	}
+
+	isA := binary.BigEndian.Uint16(query[end-4:]) == 1
+
+	answer := bytes.Clone(query[:2])
+	answer = append(answer, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0)
+	answer = append(answer, query[12:end]...)
+
+	if isA {
+		answer[7] = 1
+		answer = append(answer, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+	}
+
+	return answer
+}
+
+// backend returns a server on 127.0.0.1, and the port to reach it on.
+func backend(t *testing.T) string {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "resolved")
+	}))
+	t.Cleanup(server.Close)
+
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return port
+}
+
+func assertResolved(t *testing.T, rt *network.RoundTripper, url string) {
+	t.Helper()
+
+	resp, err := getResponse(t, &http.Client{Transport: rt}, url, nil)
+	if err != nil {
+		t.Fatalf("request to %s failed: %v", url, err)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if string(body) != "resolved" {
+		t.Errorf("request to %s returned %q", url, body)
+	}
+}
+
+func TestWithHosts(t *testing.T) {
+	t.Parallel()
+
+	port := backend(t)
+
+	rt := newTransport(t, network.WithHosts(map[string][]string{
+		"covers.example.test": {"127.0.0.2", "127.0.0.1"},
+	}))
+
+	assertResolved(t, rt, "http://Covers.example.test:"+port+"/front.jpg")
+
+	_, err := network.NewTransportWithOptions(network.WithHosts(map[string][]string{"covers.example.test": {"not-an-ip"}}))
+	if !errors.Is(err, fault.ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument for an invalid address, got %v", err)
+	}
+}
+
+func TestWithResolver(t *testing.T) {
+	t.Parallel()
+
+	port := backend(t)
+
+	conn, err := (&net.ListenConfig{}).ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	var queries atomic.Int32
+
+	go func() {
+		buffer := make([]byte, 1500)
+
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+
+			queries.Add(1)
+
+			_, _ = conn.WriteTo(dnsAnswer(buffer[:n]), addr)
+		}
+	}()
+
+	rt := newTransport(t, network.WithResolver(conn.LocalAddr().String()), network.WithHappyEyeballs(-1))
+
+	assertResolved(t, rt, "http://metadata.example.test:"+port+"/")
+
+	if queries.Load() == 0 {
+		t.Error("the custom resolver was not queried")
+	}
+}
+
+func TestWithDNSOverHTTPS(t *testing.T) {
+	t.Parallel()
+
+	port := backend(t)
+
+	var queries atomic.Int32
+
+	doh := networktest.NewTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		query, _ := io.ReadAll(r.Body)
+
+		queries.Add(1)
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(dnsAnswer(query))
+	}))
+
+	rt := newTransport(t, network.WithDNSOverHTTPS(doh.URL+"/dns-query", network.WithRootCAs(doh.CA.Pool())))
+
+	assertResolved(t, rt, "http://metadata.example.test:"+port+"/")
+
+	if queries.Load() == 0 {
+		t.Error("the DNS-over-HTTPS server was not queried")
+	}
+
+	_, err := network.NewTransportWithOptions(network.WithDNSOverHTTPS("http://dns.example.test/dns-query"))
+	if !errors.Is(err, fault.ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument for a plain http endpoint, got %v", err)
+	}
+}
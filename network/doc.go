@@ -15,5 +15,6 @@
 */
 
 // Package network currently provides sane defaults http and ssh transport config to be used across all network
-// operations.
+// operations, hardened http servers, along with helpers built on top of them (verified downloads, response caching,
+// ssh dialing and sftp transfers).
 package network
@@ -0,0 +1,515 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mycophonic/primordium/digest"
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/filesystem"
+)
+
+const (
+	defaultDownloadRetries  = 3
+	downloadBufferSize      = 32 * 1024
+	downloadPartialPrefix   = ".tmp-"
+	downloadPartialSuffix   = ".partial"
+	downloadLockSuffix      = ".lock"
+	downloadValidatorSuffix = ".validator"
+)
+
+// DownloadOptions configures Download. The zero value is usable.
+type DownloadOptions struct {
+	// Client performs the requests. Defaults to http.DefaultClient, hardened by SetDefaults.
+	Client *http.Client
+	// Header holds additional request headers.
+	Header http.Header
+	// Expected is the digest the content must match. If zero, the content is not verified.
+	Expected digest.Digest
+	// Permissions of the downloaded file, filtered through the umask. Defaults to filesystem.FilePermissionsDefault.
+	Permissions os.FileMode
+	// Retries is the number of times an interrupted transfer is resumed within one call. Defaults to 3, and a
+	// negative value disables resuming within the call.
+	Retries int
+	// Progress, if set, is called as data is written with the number of bytes on disk and the total size, or -1 if
+	// the server did not announce it.
+	Progress func(written, total int64)
+}
+
+// Download fetches url into dest.
+//
+// Content is streamed to a partial file next to dest, which is kept when the transfer is interrupted so that later
+// attempts resume it with an HTTP Range request. The ETag or Last-Modified validator of the response is saved alongside
+// and sent back with If-Range, so that a resource changed in the meantime is fetched again from the start. A partial
+// file without a saved validator is only resumed when opts.Expected is set, and discarded otherwise.
+// Once complete, the content is verified against opts.Expected (failing with fault.ErrHashMismatch and discarding the
+// partial file on mismatch) and atomically renamed to dest.
+// Concurrent downloads to the same dest are serialized across processes with a lock file next to dest, removed once
+// done. If dest already exists and matches opts.Expected, Download returns immediately.
+func Download(ctx context.Context, url, dest string, opts *DownloadOptions) (err error) {
+	if opts == nil {
+		opts = &DownloadOptions{}
+	}
+
+	if !opts.Expected.IsZero() && !opts.Expected.Algorithm().Secure() {
+		return fmt.Errorf("%w: algorithm %s cannot be used to verify content",
+			fault.ErrInvalidArgument, opts.Expected.Algorithm())
+	}
+
+	lockPath := dest + downloadLockSuffix
+
+	lock, err := lockRemovable(lockPath, filesystem.Lock)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		// Remove the lock file while still holding it: waiters locking the unlinked file notice and start over.
+		_ = os.Remove(lockPath)
+
+		if unlockErr := filesystem.Unlock(lock); unlockErr != nil {
+			err = errors.Join(err, fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, unlockErr))
+		}
+	}()
+
+	if alreadyDownloaded(dest, opts.Expected) {
+		return nil
+	}
+
+	return download(ctx, url, dest, opts)
+}
+
+// lockRemovable locks the file at path with lock, creating it if needed. As the holder of an exclusive lock may
+// remove the file before releasing it, the lock is retried until it is held on the file currently at path.
+func lockRemovable(path string, lock func(string) (*os.File, error)) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, filesystem.FilePermissionsPrivate) //nolint:gosec
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+		}
+
+		_ = file.Close()
+
+		locked, err := lock(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		lockedInfo, statErr := locked.Stat()
+		current, err := os.Stat(path)
+
+		if statErr == nil && err == nil && os.SameFile(lockedInfo, current) {
+			return locked, nil
+		}
+
+		_ = filesystem.Unlock(locked)
+
+		if statErr != nil || (err != nil && !errors.Is(err, os.ErrNotExist)) {
+			return nil, fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, errors.Join(statErr, err))
+		}
+	}
+}
+
+func download(ctx context.Context, url, dest string, opts *DownloadOptions) error {
+	partial := filepath.Join(filepath.Dir(dest), downloadPartialPrefix+filepath.Base(dest)+downloadPartialSuffix)
+
+	retries := opts.Retries
+	if retries == 0 {
+		retries = defaultDownloadRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := fetch(ctx, url, partial, opts)
+		if err == nil {
+			break
+		}
+
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return fmt.Errorf("%w: %w", fault.ErrCancelled, errors.Join(ctxErr, err))
+		}
+
+		if !errors.Is(err, fault.ErrNetworkError) || attempt >= retries {
+			return err
+		}
+
+		slog.DebugContext(ctx, "download interrupted, resuming",
+			slog.String("url", url),
+			slog.Int("attempt", attempt+1),
+			slog.Any("error", err))
+	}
+
+	if err := verifyPartial(partial, opts.Expected); err != nil {
+		return err
+	}
+
+	perm := opts.Permissions
+	if perm == 0 {
+		perm = filesystem.FilePermissionsDefault
+	}
+
+	if err := os.Chmod(partial, (^os.FileMode(filesystem.GetUmask()))&perm); err != nil {
+		return errors.Join(filesystem.ErrAtomicWriteFail, err)
+	}
+
+	if err := os.Rename(partial, dest); err != nil {
+		return errors.Join(filesystem.ErrAtomicWriteFail, err)
+	}
+
+	_ = os.Remove(partial + downloadValidatorSuffix)
+
+	return nil
+}
+
+// fetch appends the missing content to the partial file. Transport level failures wrap fault.ErrNetworkError.
+func fetch(ctx context.Context, url, partial string, opts *DownloadOptions) (err error) {
+	//nolint:gosec // Partial path is derived from the caller provided destination
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, filesystem.FilePermissionsPrivate)
+	if err != nil {
+		return fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, closeErr))
+		}
+	}()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	resp, offset, err := resume(ctx, url, file, offset, opts)
+	if err != nil || resp == nil {
+		return err
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	total := int64(-1)
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, size, parseErr := parseContentRange(resp.Header.Get("Content-Range"))
+		if parseErr != nil || start != offset {
+			return fmt.Errorf("%w: unexpected Content-Range %q for offset %d",
+				fault.ErrUnacceptableResponse, resp.Header.Get("Content-Range"), offset)
+		}
+
+		total = size
+	case http.StatusOK:
+		if offset > 0 {
+			slog.DebugContext(ctx, "remote content changed or range request ignored, restarting download",
+				slog.String("url", url))
+
+			if err = truncate(file); err != nil {
+				return err
+			}
+
+			offset = 0
+		}
+
+		total = resp.ContentLength
+	default:
+		return fmt.Errorf("%w: %s returned %s", fault.ErrUnacceptableResponse, url, resp.Status)
+	}
+
+	if err = saveValidator(file.Name(), resp.Header); err != nil {
+		return err
+	}
+
+	writer := &progressWriter{writer: file, written: offset, total: total, progress: opts.Progress}
+
+	if _, err = io.CopyBuffer(writer, resp.Body, make([]byte, downloadBufferSize)); err != nil {
+		if writer.failed {
+			return fmt.Errorf("%w: %w", fault.ErrWriteFailure, err)
+		}
+
+		return fmt.Errorf("%w: %w", fault.ErrNetworkError, err)
+	}
+
+	if err = file.Sync(); err != nil {
+		return fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	return nil
+}
+
+// resume requests the content missing from the partial file, which holds offset bytes. A partial file that cannot be
+// tied to the remote resource is truncated first, as is one that does not fit it. It returns a nil response if the
+// partial file is already complete, along with the offset the response body starts at.
+func resume(
+	ctx context.Context,
+	url string,
+	file *os.File,
+	offset int64,
+	opts *DownloadOptions,
+) (*http.Response, int64, error) {
+	validator := ""
+
+	if offset > 0 {
+		validator = loadValidator(file.Name())
+
+		// Without a validator, only the expected digest can tell whether the partial content is still relevant.
+		if validator == "" && opts.Expected.IsZero() {
+			slog.DebugContext(ctx, "no validator for partial download, restarting", slog.String("url", url))
+
+			if err := truncate(file); err != nil {
+				return nil, 0, err
+			}
+
+			offset = 0
+		}
+	}
+
+	resp, err := requestRange(ctx, url, offset, validator, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		return resp, offset, nil
+	}
+
+	_ = resp.Body.Close()
+
+	// The range is only unsatisfiable for an unchanged resource (otherwise If-Range yields the full content), so the
+	// partial file is complete if it has the announced size, and longer than the remote content otherwise.
+	if _, size, parseErr := parseContentRange(resp.Header.Get("Content-Range")); parseErr == nil && size == offset {
+		return nil, offset, nil
+	}
+
+	slog.DebugContext(ctx, "partial download does not fit remote content, restarting", slog.String("url", url))
+
+	if err = truncate(file); err != nil {
+		return nil, 0, err
+	}
+
+	resp, err = requestRange(ctx, url, 0, "", opts)
+
+	return resp, 0, err
+}
+
+func requestRange(
+	ctx context.Context,
+	url string,
+	offset int64,
+	validator string,
+	opts *DownloadOptions,
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrInvalidArgument, err)
+	}
+
+	for key, values := range opts.Header {
+		req.Header[key] = values
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+
+		if validator != "" {
+			req.Header.Set("If-Range", validator)
+		}
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrNetworkError, err)
+	}
+
+	return resp, nil
+}
+
+// verifyPartial checks the partial file against expected, removing it on mismatch so that the next attempt restarts
+// from scratch.
+func verifyPartial(partial string, expected digest.Digest) error {
+	if expected.IsZero() {
+		return nil
+	}
+
+	file, err := os.Open(partial) //nolint:gosec // Partial path is derived from the caller provided destination
+	if err != nil {
+		return fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	actual, err := digest.FromReader(expected.Algorithm(), file)
+
+	_ = file.Close()
+
+	if err != nil {
+		return err
+	}
+
+	if !actual.Equal(expected) {
+		_ = os.Remove(partial + downloadValidatorSuffix)
+
+		return errors.Join(
+			fmt.Errorf("%w: expected %s, got %s", fault.ErrHashMismatch, expected, actual),
+			os.Remove(partial),
+		)
+	}
+
+	return nil
+}
+
+// saveValidator records the validator of a response next to the partial file, preferring a strong ETag over
+// Last-Modified. Weak ETags are not usable with If-Range.
+func saveValidator(partial string, header http.Header) error {
+	validator := header.Get("Last-Modified")
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		validator = etag
+	}
+
+	path := partial + downloadValidatorSuffix
+
+	if validator == "" {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+		}
+
+		return nil
+	}
+
+	return filesystem.WriteFile(path, []byte(validator), filesystem.FilePermissionsPrivate)
+}
+
+// loadValidator returns the validator saved next to the partial file, or an empty string.
+func loadValidator(partial string) string {
+	data, err := os.ReadFile(partial + downloadValidatorSuffix) //nolint:gosec // Derived from the partial path
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+func alreadyDownloaded(dest string, expected digest.Digest) bool {
+	if expected.IsZero() {
+		return false
+	}
+
+	file, err := os.Open(dest) //nolint:gosec // Destination is provided by the caller
+	if err != nil {
+		return false
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	actual, err := digest.FromReader(expected.Algorithm(), file)
+
+	return err == nil && actual.Equal(expected)
+}
+
+func truncate(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	return nil
+}
+
+// parseContentRange parses a "bytes start-end/size" header. start is -1 for an unsatisfied range, and size is -1 if
+// unknown.
+func parseContentRange(header string) (start, size int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %q", fault.ErrInvalidArgument, header)
+	}
+
+	rangeSpec, sizeSpec, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %q", fault.ErrInvalidArgument, header)
+	}
+
+	// Unsatisfied ranges are reported as "bytes */size".
+	start = -1
+
+	if rangeSpec != "*" {
+		startSpec, _, ok := strings.Cut(rangeSpec, "-")
+		if !ok {
+			return 0, 0, fmt.Errorf("%w: %q", fault.ErrInvalidArgument, header)
+		}
+
+		if start, err = strconv.ParseInt(startSpec, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("%w: %w", fault.ErrInvalidArgument, err)
+		}
+	}
+
+	if sizeSpec == "*" {
+		return start, -1, nil
+	}
+
+	if size, err = strconv.ParseInt(sizeSpec, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("%w: %w", fault.ErrInvalidArgument, err)
+	}
+
+	return start, size, nil
+}
+
+// progressWriter reports progress and distinguishes local write failures from network read failures.
+type progressWriter struct {
+	writer   io.Writer
+	written  int64
+	total    int64
+	progress func(written, total int64)
+	failed   bool
+}
+
+//nolint:wrapcheck // I/O wrapper must return unwrapped errors
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.writer.Write(p)
+	pw.written += int64(n)
+
+	if err != nil {
+		pw.failed = true
+	}
+
+	if pw.progress != nil && n > 0 {
+		pw.progress(pw.written, pw.total)
+	}
+
+	return n, err
+}
@@ -0,0 +1,277 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mycophonic/primordium/digest"
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/network"
+)
+
+func newContentServer(t *testing.T, content []byte, etag string, ranges *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+
+		http.ServeContent(w, r, "content.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestDownload_VerifiesAndCommits(t *testing.T) {
+	t.Parallel()
+
+	content := bytes.Repeat([]byte("audio"), 10000)
+
+	var ranges atomic.Int32
+
+	server := newContentServer(t, content, "", &ranges)
+	dest := filepath.Join(t.TempDir(), "content.bin")
+
+	var lastWritten, lastTotal int64
+
+	err := network.Download(context.Background(), server.URL, dest, &network.DownloadOptions{
+		Expected: digest.FromBytes(digest.SHA256, content),
+		Progress: func(written, total int64) {
+			lastWritten, lastTotal = written, total
+		},
+	})
+	if err != nil {
+		t.Fatalf("Download returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(dest)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("downloaded content mismatch (err: %v)", err)
+	}
+
+	if lastWritten != int64(len(content)) || lastTotal != int64(len(content)) {
+		t.Errorf("last progress = %d/%d, want %d/%d", lastWritten, lastTotal, len(content), len(content))
+	}
+
+	if ranges.Load() != 0 {
+		t.Errorf("fresh download sent %d range requests", ranges.Load())
+	}
+
+	if _, err = os.Stat(dest + ".lock"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lock file should be gone, got: %v", err)
+	}
+}
+
+func TestDownload_ResumesPartial(t *testing.T) {
+	t.Parallel()
+
+	content := bytes.Repeat([]byte("0123456789"), 5000)
+
+	var ranges atomic.Int32
+
+	server := newContentServer(t, content, "", &ranges)
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "content.bin")
+
+	// Simulate an interrupted transfer.
+	partial := filepath.Join(dir, ".tmp-content.bin.partial")
+	if err := os.WriteFile(partial, content[:12345], 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := network.Download(context.Background(), server.URL, dest, &network.DownloadOptions{
+		Expected: digest.FromBytes(digest.SHA256, content),
+	})
+	if err != nil {
+		t.Fatalf("Download returned error: %v", err)
+	}
+
+	if ranges.Load() != 1 {
+		t.Errorf("expected 1 range request, got %d", ranges.Load())
+	}
+
+	got, err := os.ReadFile(dest)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("resumed content mismatch (err: %v)", err)
+	}
+
+	if _, err = os.Stat(partial); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial file should be gone, got: %v", err)
+	}
+}
+
+func TestDownload_RestartsStalePartial(t *testing.T) {
+	t.Parallel()
+
+	content := bytes.Repeat([]byte("0123456789"), 5000)
+
+	testCases := []struct {
+		name      string
+		partial   []byte
+		validator string
+	}{
+		// Without validator nor expected digest, nothing ties the partial file to the remote content.
+		{name: "no validator", partial: []byte("stale content")},
+		// The resource changed since the partial file was written: If-Range yields the full content.
+		{name: "changed resource", partial: []byte("stale content"), validator: `"v1"`},
+		// The partial file is longer than the remote content.
+		{name: "overlong partial", partial: append(bytes.Clone(content), "trailing"...), validator: `"v2"`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var ranges atomic.Int32
+
+			server := newContentServer(t, content, `"v2"`, &ranges)
+			dir := t.TempDir()
+			dest := filepath.Join(dir, "content.bin")
+			partial := filepath.Join(dir, ".tmp-content.bin.partial")
+
+			if err := os.WriteFile(partial, tc.partial, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.validator != "" {
+				if err := os.WriteFile(partial+".validator", []byte(tc.validator), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := network.Download(context.Background(), server.URL, dest, nil); err != nil {
+				t.Fatalf("Download returned error: %v", err)
+			}
+
+			got, err := os.ReadFile(dest)
+			if err != nil || !bytes.Equal(got, content) {
+				t.Fatalf("downloaded content mismatch (err: %v)", err)
+			}
+
+			for _, name := range []string{partial, partial + ".validator"} {
+				if _, err = os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("%s should be gone, got: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDownload_ResumesValidatedPartial(t *testing.T) {
+	t.Parallel()
+
+	content := bytes.Repeat([]byte("0123456789"), 5000)
+
+	var ranges atomic.Int32
+
+	server := newContentServer(t, content, `"v1"`, &ranges)
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "content.bin")
+	partial := filepath.Join(dir, ".tmp-content.bin.partial")
+
+	if err := os.WriteFile(partial, content[:12345], 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(partial+".validator", []byte(`"v1"`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := network.Download(context.Background(), server.URL, dest, nil); err != nil {
+		t.Fatalf("Download returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(dest)
+	if err != nil || !bytes.Equal(got, content) || ranges.Load() != 1 {
+		t.Fatalf("resumed content mismatch with %d range requests (err: %v)", ranges.Load(), err)
+	}
+}
+
+func TestDownload_HashMismatch(t *testing.T) {
+	t.Parallel()
+
+	var ranges atomic.Int32
+
+	server := newContentServer(t, []byte("tampered"), "", &ranges)
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "content.bin")
+
+	err := network.Download(context.Background(), server.URL, dest, &network.DownloadOptions{
+		Expected: digest.FromBytes(digest.SHA256, []byte("expected")),
+	})
+	if !errors.Is(err, fault.ErrHashMismatch) {
+		t.Fatalf("expected ErrHashMismatch, got: %v", err)
+	}
+
+	for _, name := range []string{dest, filepath.Join(dir, ".tmp-content.bin.partial")} {
+		if _, err = os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s should not exist, got: %v", name, err)
+		}
+	}
+}
+
+func TestDownload_UnacceptableResponse(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	err := network.Download(context.Background(), server.URL, filepath.Join(t.TempDir(), "missing"), nil)
+	if !errors.Is(err, fault.ErrUnacceptableResponse) {
+		t.Errorf("expected ErrUnacceptableResponse, got: %v", err)
+	}
+}
+
+func TestDownload_SkipsExisting(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	dest := filepath.Join(t.TempDir(), "content.bin")
+	if err := os.WriteFile(dest, []byte("present"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := network.Download(context.Background(), server.URL, dest, &network.DownloadOptions{
+		Expected: digest.FromBytes(digest.SHA256, []byte("present")),
+	})
+	if err != nil || requests.Load() != 0 {
+		t.Errorf("Download = %v with %d requests, want no request", err, requests.Load())
+	}
+}
@@ -19,21 +19,20 @@ package network
 import (
 	"crypto/tls"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"time"
+
+	"github.com/mycophonic/primordium/fault"
 )
 
-// defaultTransport holds the configured transport before any wrapping.
-// This allows NewTransport to clone from it.
-//
-//nolint:gochecknoglobals // Package-level reference needed for cloning.
+//nolint:gochecknoglobals // Read-only lookup tables.
 var (
-	defaultTransport *http.Transport
-
 	// RetryStatusCodes contains HTTP status codes that indicate retryable errors.
-	// This list is used both for logging in RoundTripper and can be passed to
+	// This list is used for logging and retries in RoundTripper, and can be passed to
 	// libraries like go-containerregistry via remote.WithRetryStatusCodes().
 	RetryStatusCodes = []int{
 		http.StatusTooManyRequests,     // 429 - Rate limit
@@ -64,40 +63,150 @@ type Transport struct {
 type RoundTripper struct {
 	*http.Transport
 
+	// TokenValue and TokenType set a static Authorization header. Authenticator takes precedence when set.
 	TokenValue string
 	TokenType  string
+
+	// Authenticator, if set, authorizes every request. If it implements Challenger, 401 responses are handed to it.
+	Authenticator Authenticator
+
+	// Scope restricts credentials to origins ("https://host[:port]") or host patterns ("*.example.com"). If empty,
+	// credentials are bound to the origin of the first request of a redirect chain. Either way, they are never sent
+	// after a redirect from https to http.
+	Scope []string
+	// Audit, if set, is notified when credentials are withheld. They are logged at debug level otherwise.
+	Audit CredentialAudit
+
+	// RateLimiter, if set, throttles requests per host. Every attempt, including retries, is subject to it.
+	RateLimiter *RateLimiter
+
+	// Instrumentation, if set, reports timings, sizes and TLS parameters of every attempt.
+	Instrumentation *Instrumentation
+
+	// Retry enables retries when set. Requests are sent once otherwise.
+	Retry *RetryPolicy
+
+	dialer *net.Dialer
+	hosts  map[string][]netip.Addr
 }
 
-// NewTransport returns a new RoundTripper cloned from the default configuration.
+// NewTransport returns a new RoundTripper with the default configuration.
 // The returned RoundTripper can be modified (e.g., adding client certificates)
 // without affecting http.DefaultTransport.
-// Panics if SetDefaults has not been called.
 func NewTransport() *RoundTripper {
-	if defaultTransport == nil {
-		panic("NewTransport called before SetDefaults")
+	return (&Config{}).roundTripper()
+}
+
+// NewTransportWithOptions returns a new RoundTripper with the default configuration, with opts applied. It is a
+// shorthand for building a zero Config.
+// Options cover the common needs (CA bundles, client certificates, key pinning, proxies, DNS), and fail with the
+// reason an option cannot be applied.
+func NewTransportWithOptions(opts ...TransportOption) (*RoundTripper, error) {
+	return (&Config{}).Build(opts...)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt.Retry != nil {
+		return rt.Retry.do(req, rt.attempt)
 	}
 
-	cloned := defaultTransport.Clone()
-	cloned.TLSClientConfig = defaultTLSConfig()
+	return rt.attempt(req)
+}
+
+// attempt authorizes and sends the request, answering an authentication challenge once if the Authenticator can.
+func (rt *RoundTripper) attempt(req *http.Request) (*http.Response, error) {
+	if (rt.Authenticator != nil || rt.TokenValue != "") && !rt.credentialsAllowed(req) {
+		return rt.send(req)
+	}
+
+	resp, err := rt.authorizeAndSend(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	challenger, ok := rt.Authenticator.(Challenger)
+	if !ok {
+		return resp, nil
+	}
+
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		slog.DebugContext(req.Context(), "cannot replay request body, not answering authentication challenge",
+			slog.String("url", req.URL.Redacted()))
+
+		return resp, nil
+	}
+
+	retry, err := challenger.Challenge(resp)
+	if err != nil {
+		_ = resp.Body.Close()
+
+		return nil, err //nolint:wrapcheck // Authenticators wrap their errors
+	}
 
-	return &RoundTripper{
-		Transport: cloned,
+	if !retry {
+		return resp, nil
 	}
+
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, retryDrainLimit))
+	_ = resp.Body.Close()
+
+	if req, err = rewind(req); err != nil {
+		return nil, err
+	}
+
+	return rt.authorizeAndSend(req)
 }
 
-// RoundTrip implements http.RoundTripper.
-func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	if rt.TokenValue != "" {
-		// Ensure we don't leak that if the req is getting reused.
+// authorizeAndSend sets credentials on a clone of req, so that they never leak into a reused request, and sends it.
+func (rt *RoundTripper) authorizeAndSend(req *http.Request) (*http.Response, error) {
+	switch {
+	case rt.Authenticator != nil:
+		req = req.Clone(req.Context())
+		if err := rt.Authenticator.Authorize(req); err != nil {
+			return nil, err //nolint:wrapcheck // Authenticators wrap their errors
+		}
+	case rt.TokenValue != "":
 		req = req.Clone(req.Context())
-		req.Header.Set("Authorization", fmt.Sprintf("%s %s", rt.TokenType, rt.TokenValue))
+		req.Header.Set(authorizationHeader, fmt.Sprintf("%s %s", rt.TokenType, rt.TokenValue))
+	}
+
+	return rt.send(req)
+}
+
+// send performs a single attempt.
+func (rt *RoundTripper) send(req *http.Request) (*http.Response, error) {
+	release := func() {}
+
+	if rt.RateLimiter != nil {
+		var err error
+		if release, err = rt.RateLimiter.wait(req); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		resp *http.Response
+		err  error
+	)
+
+	if rt.Instrumentation != nil {
+		resp, err = rt.Instrumentation.roundTrip(req, rt.Transport.RoundTrip)
+	} else {
+		resp, err = rt.Transport.RoundTrip(req)
 	}
 
-	resp, err := rt.Transport.RoundTrip(req)
 	if err != nil {
+		release()
+
 		return resp, err //nolint:wrapcheck // pass through
 	}
 
+	if rt.RateLimiter != nil {
+		rt.RateLimiter.observe(resp)
+		resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	}
+
 	if reason, isRetryable := retryReasons[resp.StatusCode]; isRetryable {
 		slog.DebugContext(req.Context(), "HTTP request received retryable status",
 			slog.String("url", req.URL.String()),
@@ -132,45 +241,14 @@ const (
 	maxConnsPerHost       = 100
 )
 
-// SetDefaults configures http.DefaultTransport with our TLS and connection settings,
-// and wraps it with logging. Must be called once at startup before any HTTP requests.
+// SetDefaults replaces http.DefaultTransport with a RoundTripper built from a zero Config, so that libraries using
+// http.DefaultClient get our TLS and connection settings. Call it once at startup, before any HTTP request.
+// Code that can be handed a client should prefer Config, which does not rely on global state.
 func SetDefaults() {
-	transport, ok := http.DefaultTransport.(*http.Transport)
-	if !ok {
-		panic("http.DefaultTransport has been tampered with")
+	rt, err := (&Config{}).Build()
+	if err != nil {
+		panic(fmt.Errorf("%w: building the default transport: %w", fault.ErrSystemFailure, err))
 	}
 
-	// Proxy configuration
-	transport.Proxy = http.ProxyFromEnvironment
-
-	// Dialer configuration
-	transport.DialContext = (&net.Dialer{
-		Timeout:   dialTimeout,
-		KeepAlive: dialKeepAlive,
-	}).DialContext
-
-	// Enable HTTP/2 - required when setting custom TLSClientConfig
-	transport.ForceAttemptHTTP2 = true
-
-	// Timeout configuration
-	transport.TLSHandshakeTimeout = tlsHandshakeTimeout
-	transport.ResponseHeaderTimeout = responseHeaderTimeout
-	transport.IdleConnTimeout = idleConnTimeout
-	transport.ExpectContinueTimeout = expectContinueTimeout
-
-	// Connection pool tuning - prevent connection churn
-	transport.MaxIdleConns = maxIdleConns
-	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
-	transport.MaxConnsPerHost = maxConnsPerHost
-
-	// TLS configuration
-	transport.TLSClientConfig = defaultTLSConfig()
-
-	// Store for cloning
-	defaultTransport = transport
-
-	// Wrap with logging for retry-worthy responses
-	http.DefaultTransport = &RoundTripper{
-		Transport: transport,
-	}
+	http.DefaultTransport = rt
 }
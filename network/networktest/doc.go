@@ -0,0 +1,20 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package networktest provides offline fixtures for code built on the network package: a TLS 1.3 server with an
+// ephemeral certificate authority, an in-process ssh server using the hardened ssh defaults, and SOCKS5 and HTTP
+// proxies.
+package networktest
@@ -0,0 +1,350 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package networktest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const proxyReadHeaderTimeout = 10 * time.Second
+
+var (
+	errProxyAuthentication = errors.New("proxy authentication failed")
+	errUnsupportedAddress  = errors.New("unsupported address type")
+)
+
+// Proxy is an in-process forwarding proxy speaking SOCKS5 or HTTP (CONNECT and absolute-form requests), optionally
+// requiring a username and password.
+type Proxy struct {
+	// URL is the proxy URL, with its credentials if any, as expected by network.ProxyRule.
+	URL *url.URL
+
+	tb       testing.TB
+	username string
+	password string
+	listener net.Listener
+	mu       sync.Mutex
+	targets  []string
+}
+
+// NewSOCKS5Proxy starts a SOCKS5 proxy on 127.0.0.1, requiring username and password unless username is empty.
+// It is closed when the test ends.
+func NewSOCKS5Proxy(tb testing.TB, username, password string) *Proxy {
+	tb.Helper()
+
+	proxy := newProxy(tb, "socks5h", username, password)
+
+	go func() {
+		for {
+			conn, err := proxy.listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go proxy.serveSOCKS5(conn)
+		}
+	}()
+
+	return proxy
+}
+
+// NewHTTPProxy starts an HTTP proxy on 127.0.0.1, requiring username and password (Basic Proxy-Authorization)
+// unless username is empty. It is closed when the test ends.
+func NewHTTPProxy(tb testing.TB, username, password string) *Proxy {
+	tb.Helper()
+
+	proxy := newProxy(tb, "http", username, password)
+	server := &http.Server{Handler: http.HandlerFunc(proxy.serveHTTP), ReadHeaderTimeout: proxyReadHeaderTimeout}
+
+	go func() {
+		_ = server.Serve(proxy.listener)
+	}()
+
+	tb.Cleanup(func() {
+		_ = server.Close()
+	})
+
+	return proxy
+}
+
+func newProxy(tb testing.TB, scheme, username, password string) *Proxy {
+	tb.Helper()
+
+	listener, err := (&net.ListenConfig{}).Listen(tb.Context(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("networktest: listening: %v", err)
+	}
+
+	tb.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	proxyURL := &url.URL{Scheme: scheme, Host: listener.Addr().String()}
+	if username != "" {
+		proxyURL.User = url.UserPassword(username, password)
+	}
+
+	return &Proxy{URL: proxyURL, tb: tb, username: username, password: password, listener: listener}
+}
+
+// Targets returns the addresses clients asked the proxy to connect to, in order.
+func (p *Proxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string(nil), p.targets...)
+}
+
+func (p *Proxy) record(target string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.targets = append(p.targets, target)
+}
+
+func (p *Proxy) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.username != "" {
+		username, password, ok := (&http.Request{Header: http.Header{
+			"Authorization": r.Header.Values("Proxy-Authorization"),
+		}}).BasicAuth()
+		if !ok || username != p.username || password != p.password {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="networktest"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+
+			return
+		}
+	}
+
+	p.record(r.Host)
+
+	if r.Method != http.MethodConnect {
+		p.forward(w, r)
+
+		return
+	}
+
+	target, err := (&net.Dialer{}).DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+
+		return
+	}
+
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		_ = target.Close()
+
+		return
+	}
+
+	_, _ = buffered.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n")
+	_ = buffered.Flush()
+
+	pipe(&readerConn{Conn: conn, reader: buffered.Reader}, target)
+}
+
+// forward relays an absolute-form request.
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request) {
+	outgoing := r.Clone(r.Context())
+	outgoing.RequestURI = ""
+	outgoing.Header.Del("Proxy-Authorization")
+
+	resp, err := (&http.Transport{}).RoundTrip(outgoing)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+
+		return
+	}
+
+	defer resp.Body.Close()
+
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func (p *Proxy) serveSOCKS5(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+
+	target, err := p.socksNegotiate(conn, reader)
+	if err != nil {
+		_ = conn.Close()
+
+		return
+	}
+
+	p.record(target)
+
+	upstream, err := (&net.Dialer{}).DialContext(p.tb.Context(), "tcp", target)
+	if err != nil {
+		_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0}) // Connection refused
+		_ = conn.Close()
+
+		return
+	}
+
+	if _, err = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		_ = conn.Close()
+		_ = upstream.Close()
+
+		return
+	}
+
+	pipe(&readerConn{Conn: conn, reader: reader}, upstream)
+}
+
+// socksNegotiate performs the SOCKS5 authentication and reads the CONNECT request, returning its target.
+//
+//nolint:mnd // SOCKS5 protocol values
+func (p *Proxy) socksNegotiate(conn net.Conn, reader *bufio.Reader) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(0)
+	if p.username != "" {
+		method = 2
+	}
+
+	if header[0] != 5 || !slices.Contains(methods, method) {
+		_, _ = conn.Write([]byte{5, 0xff})
+
+		return "", errProxyAuthentication
+	}
+
+	if _, err := conn.Write([]byte{5, method}); err != nil {
+		return "", err
+	}
+
+	if method == 2 {
+		username, _ := readSOCKSField(reader, 1)
+		password, err := readSOCKSField(reader, 0)
+
+		if err != nil || username != p.username || password != p.password {
+			_, _ = conn.Write([]byte{1, 1})
+
+			return "", errProxyAuthentication
+		}
+
+		if _, err = conn.Write([]byte{1, 0}); err != nil {
+			return "", err
+		}
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return "", err
+	}
+
+	var host string
+
+	switch request[3] {
+	case 1, 4:
+		ip := make(net.IP, map[byte]int{1: net.IPv4len, 4: net.IPv6len}[request[3]])
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+
+		host = ip.String()
+	case 3:
+		name, err := readSOCKSField(reader, 0)
+		if err != nil {
+			return "", err
+		}
+
+		host = name
+	default:
+		return "", errUnsupportedAddress
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// readSOCKSField reads a length prefixed field, after skipping skip bytes.
+func readSOCKSField(reader *bufio.Reader, skip int) (string, error) {
+	if _, err := reader.Discard(skip); err != nil {
+		return "", err
+	}
+
+	length, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	field := make([]byte, length)
+	if _, err = io.ReadFull(reader, field); err != nil {
+		return "", err
+	}
+
+	return string(field), nil
+}
+
+// pipe copies data both ways until either side is done, then closes both.
+func pipe(client, upstream net.Conn) {
+	done := make(chan struct{}, 2)
+
+	go func() {
+		_, _ = io.Copy(upstream, client)
+		done <- struct{}{}
+	}()
+
+	go func() {
+		_, _ = io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+
+	<-done
+
+	_ = client.Close()
+	_ = upstream.Close()
+}
+
+// readerConn reads from a buffered reader wrapping the connection.
+type readerConn struct {
+	net.Conn
+
+	reader io.Reader
+}
+
+func (rc *readerConn) Read(p []byte) (int, error) {
+	return rc.reader.Read(p)
+}
@@ -0,0 +1,308 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package networktest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/mycophonic/primordium/filesystem"
+	"github.com/mycophonic/primordium/network"
+)
+
+const (
+	sshChannelSession     = "session"
+	sshChannelDirectTCPIP = "direct-tcpip"
+	sshSubsystemRequest   = "subsystem"
+	sshSubsystemSFTP      = "sftp"
+	sshStringHeaderLength = 4
+)
+
+var errUnauthorizedKey = errors.New("unauthorized key")
+
+// SSHServer is an in-process ssh server using network.DefaultSSHConfig and an ed25519 host key.
+//
+// It authenticates a generated ed25519 client key, forwards direct-tcpip channels (so that it can serve as a jump
+// host), and serves the local filesystem over the sftp subsystem. Other channels are rejected.
+type SSHServer struct {
+	// Addr is the address the server listens on, once started.
+	Addr string
+	// HostKey is the ed25519 host key of the server.
+	HostKey ssh.Signer
+	// ClientKeyFile is the path of an unencrypted ed25519 private key the server accepts.
+	ClientKeyFile string
+	// KnownHostsFile is the path of a known hosts file trusting HostKey for Addr, once started.
+	KnownHostsFile string
+	// Config is the server configuration. It can be modified before Start.
+	Config *ssh.ServerConfig
+	// Unresponsive makes the server ignore global requests, such as keepalives, simulating a dead peer.
+	// It must be set before Start.
+	Unresponsive bool
+
+	tb       testing.TB
+	dir      string
+	listener net.Listener
+	mu       sync.Mutex
+	conns    []net.Conn
+}
+
+// NewSSHServer starts an SSHServer on 127.0.0.1. It is closed when the test ends.
+func NewSSHServer(tb testing.TB) *SSHServer {
+	tb.Helper()
+
+	server := NewUnstartedSSHServer(tb)
+	server.Start()
+
+	return server
+}
+
+// NewUnstartedSSHServer returns an SSHServer with its keys generated, that can be configured before calling Start.
+func NewUnstartedSSHServer(tb testing.TB) *SSHServer {
+	tb.Helper()
+
+	dir := tb.TempDir()
+
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		tb.Fatalf("generating host key: %v", err)
+	}
+
+	hostKey, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		tb.Fatalf("loading host key: %v", err)
+	}
+
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		tb.Fatalf("generating client key: %v", err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		tb.Fatalf("marshalling client key: %v", err)
+	}
+
+	clientKeyFile := filepath.Join(dir, "id_ed25519")
+	if err = os.WriteFile(clientKeyFile, pem.EncodeToMemory(block), filesystem.FilePermissionsPrivate); err != nil {
+		tb.Fatalf("writing client key: %v", err)
+	}
+
+	authorized, err := ssh.NewPublicKey(clientPub)
+	if err != nil {
+		tb.Fatalf("loading client key: %v", err)
+	}
+
+	config := &ssh.ServerConfig{
+		Config: network.DefaultSSHConfig,
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return &ssh.Permissions{}, nil
+			}
+
+			return nil, errUnauthorizedKey
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	return &SSHServer{
+		HostKey:       hostKey,
+		ClientKeyFile: clientKeyFile,
+		Config:        config,
+		tb:            tb,
+		dir:           dir,
+	}
+}
+
+// Start listens on 127.0.0.1 and serves connections until the test ends.
+func (s *SSHServer) Start() {
+	s.tb.Helper()
+
+	listener, err := (&net.ListenConfig{}).Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		s.tb.Fatalf("listening: %v", err)
+	}
+
+	s.listener = listener
+	s.Addr = listener.Addr().String()
+	s.KnownHostsFile = filepath.Join(s.dir, "known_hosts")
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.Addr)}, s.HostKey.PublicKey()) + "\n"
+	if err = os.WriteFile(s.KnownHostsFile, []byte(line), filesystem.FilePermissionsPrivate); err != nil {
+		s.tb.Fatalf("writing known hosts: %v", err)
+	}
+
+	s.tb.Cleanup(s.Close)
+
+	go s.serve()
+}
+
+// Close stops the server and closes all connections.
+func (s *SSHServer) Close() {
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+
+	s.conns = nil
+}
+
+// Options returns network.SSHOptions authenticating with ClientKeyFile and trusting only KnownHostsFile, ignoring the
+// agent and the user ssh_config.
+func (s *SSHServer) Options() *network.SSHOptions {
+	return &network.SSHOptions{
+		IdentityFiles:   []string{s.ClientKeyFile},
+		KnownHostsFiles: []string{s.KnownHostsFile},
+		DisableAgent:    true,
+		SSHConfig:       &network.SSHConfig{},
+	}
+}
+
+func (s *SSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+func (s *SSHServer) handle(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.Config)
+	if err != nil {
+		_ = conn.Close()
+
+		return
+	}
+
+	if !s.Unresponsive {
+		go ssh.DiscardRequests(reqs)
+	}
+
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case sshChannelSession:
+			go serveSession(newChannel)
+		case sshChannelDirectTCPIP:
+			go forward(newChannel)
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// serveSession serves the sftp subsystem, and nothing else.
+func serveSession(newChannel ssh.NewChannel) {
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		_ = channel.Close()
+	}()
+
+	for req := range reqs {
+		isSFTP := req.Type == sshSubsystemRequest && len(req.Payload) > sshStringHeaderLength &&
+			string(req.Payload[sshStringHeaderLength:]) == sshSubsystemSFTP
+
+		_ = req.Reply(isSFTP, nil)
+
+		if !isSFTP {
+			continue
+		}
+
+		go ssh.DiscardRequests(reqs)
+
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			return
+		}
+
+		_ = server.Serve()
+
+		return
+	}
+}
+
+// forward connects a direct-tcpip channel to its target.
+func forward(newChannel ssh.NewChannel) {
+	var target struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, "malformed direct-tcpip request")
+
+		return
+	}
+
+	address := net.JoinHostPort(target.Host, strconv.FormatUint(uint64(target.Port), 10))
+
+	conn, err := (&net.Dialer{}).DialContext(context.Background(), "tcp", address)
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+
+		return
+	}
+
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		_ = conn.Close()
+
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	go func() {
+		_, _ = io.Copy(channel, conn)
+		_ = channel.CloseWrite()
+	}()
+
+	_, _ = io.Copy(conn, channel)
+	_ = conn.Close()
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package networktest
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mycophonic/primordium/network"
+)
+
+// TLSServer is an httptest.Server speaking TLS 1.3 only, with X25519MLKEM768 key exchange only, using a certificate
+// issued by its own ephemeral CA.
+type TLSServer struct {
+	*httptest.Server
+
+	// CA issued the server certificate.
+	CA *CA
+
+	tb testing.TB
+}
+
+// NewTLSServer starts a TLSServer serving handler on 127.0.0.1. It is closed when the test ends.
+func NewTLSServer(tb testing.TB, handler http.Handler) *TLSServer {
+	tb.Helper()
+
+	server := NewUnstartedTLSServer(tb, handler)
+	server.StartTLS()
+
+	return server
+}
+
+// NewUnstartedTLSServer returns a TLSServer with its TLS configuration ready, which can be adjusted (for example to
+// require client certificates) before calling StartTLS. It is closed when the test ends.
+func NewUnstartedTLSServer(tb testing.TB, handler http.Handler) *TLSServer {
+	tb.Helper()
+
+	ca, err := NewCA()
+	if err != nil {
+		tb.Fatalf("creating CA: %v", err)
+	}
+
+	cert, err := ca.Issue("127.0.0.1", "localhost")
+	if err != nil {
+		tb.Fatalf("issuing server certificate: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{
+		MinVersion:       tls.VersionTLS13,
+		CurvePreferences: []tls.CurveID{tls.X25519MLKEM768},
+		Certificates:     []tls.Certificate{cert},
+	}
+
+	tb.Cleanup(server.Close)
+
+	return &TLSServer{Server: server, CA: ca, tb: tb}
+}
+
+// RoundTripper returns a network.NewTransportWithOptions trusting only the server CA, with opts applied.
+func (s *TLSServer) RoundTripper(opts ...network.TransportOption) *network.RoundTripper {
+	s.tb.Helper()
+
+	transport, err := network.NewTransportWithOptions(append([]network.TransportOption{network.WithRootCAs(s.CA.Pool())},
+		opts...)...)
+	if err != nil {
+		s.tb.Fatalf("creating transport: %v", err)
+	}
+
+	return transport
+}
+
+// Client returns an http.Client using RoundTripper.
+func (s *TLSServer) Client() *http.Client {
+	s.tb.Helper()
+
+	return &http.Client{Transport: s.RoundTripper()}
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package networktest_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	"github.com/mycophonic/primordium/network"
+	"github.com/mycophonic/primordium/network/networktest"
+)
+
+func TestMain(m *testing.M) {
+	network.SetDefaults()
+	m.Run()
+}
+
+func get(t *testing.T, client *http.Client, url string) (*http.Response, error) {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client.Do(req)
+}
+
+func TestTLSServer(t *testing.T) {
+	t.Parallel()
+
+	server := networktest.NewTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	resp, err := get(t, server.Client(), server.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.TLS == nil || resp.TLS.Version != tls.VersionTLS13 {
+		t.Fatalf("expected TLS 1.3, got %+v", resp.TLS)
+	}
+
+	if resp.TLS.CurveID != tls.X25519MLKEM768 {
+		t.Errorf("CurveID = %v, want X25519MLKEM768", resp.TLS.CurveID)
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("StatusCode = %d", resp.StatusCode)
+	}
+}
+
+func TestTLSServer_UntrustedByDefault(t *testing.T) {
+	t.Parallel()
+
+	server := networktest.NewTLSServer(t, http.NotFoundHandler())
+
+	resp, err := get(t, &http.Client{Transport: network.NewTransport()}, server.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("expected a certificate verification error without the test CA")
+	}
+}
+
+func TestCA_Issue(t *testing.T) {
+	t.Parallel()
+
+	ca, err := networktest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := ca.Issue("example.test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = cert.Leaf.VerifyHostname("example.test"); err != nil {
+		t.Errorf("VerifyHostname(example.test): %v", err)
+	}
+
+	if err = cert.Leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Errorf("VerifyHostname(127.0.0.1): %v", err)
+	}
+
+	if err = cert.Leaf.CheckSignatureFrom(ca.Certificate()); err != nil {
+		t.Errorf("certificate not signed by the CA: %v", err)
+	}
+}
@@ -0,0 +1,454 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/mycophonic/primordium/fault"
+)
+
+// ProxyDirect is the ProxyRule.Proxy value connecting directly.
+const ProxyDirect = "direct"
+
+// SOCKS5 protocol constants (RFC 1928 and RFC 1929).
+const (
+	socksVersion         = 0x05
+	socksAuthVersion     = 0x01
+	socksNoAuth          = 0x00
+	socksUserPass        = 0x02
+	socksNoAcceptable    = 0xff
+	socksConnect         = 0x01
+	socksIPv4            = 0x01
+	socksDomain          = 0x03
+	socksIPv6            = 0x04
+	socksSucceeded       = 0x00
+	socksMaxFieldLength  = 255
+	socksReplyHeaderSize = 4
+)
+
+// dialFunc is the signature of net.Dialer.DialContext.
+type dialFunc = func(ctx context.Context, network, address string) (net.Conn, error)
+
+// ProxyRule routes the hosts matching Hosts through Proxy.
+type ProxyRule struct {
+	// Hosts are ssh_config style patterns matched against the host name ("*.example.com", "!internal.example.com").
+	Hosts []string `json:"hosts"`
+	// Proxy is the proxy URL: "http://[user:password@]host[:port]" and "https://..." for HTTP CONNECT proxies,
+	// "socks5://[user:password@]host[:port]" or "socks5h://..." for SOCKS5 proxies, or ProxyDirect. Ports default to
+	// 80 for http, 443 for https and 1080 for SOCKS5. As with net/http, SOCKS5 proxies resolve host names themselves
+	// with either scheme.
+	Proxy string `json:"proxy"`
+}
+
+// ProxyConfig routes connections through proxies, for HTTP (see WithProxy) and SSH (see SSHOptions.Proxy) alike.
+// The first rule matching the destination host applies. When none does, connections are direct, unless
+// FromEnvironment is set.
+type ProxyConfig struct {
+	Rules []ProxyRule `json:"rules"`
+	// FromEnvironment falls back to HTTP_PROXY, HTTPS_PROXY and NO_PROXY, as http.ProxyFromEnvironment does. Non HTTP
+	// connections (SSH) use HTTPS_PROXY.
+	FromEnvironment bool `json:"fromEnvironment"`
+}
+
+// WithProxy routes the requests of the RoundTripper as configured. Proxy URLs are validated immediately.
+func WithProxy(config *ProxyConfig) TransportOption {
+	return func(rt *RoundTripper) error {
+		if err := config.validate(); err != nil {
+			return err
+		}
+
+		rt.Proxy = func(req *http.Request) (*url.URL, error) {
+			return config.ProxyFor(req.URL)
+		}
+
+		return nil
+	}
+}
+
+// ProxyFor returns the proxy to use to reach target, or nil for a direct connection.
+// Targets with a scheme other than http use the https environment fallback.
+func (pc *ProxyConfig) ProxyFor(target *url.URL) (*url.URL, error) {
+	for _, rule := range pc.Rules {
+		if matchPatternList(target.Hostname(), rule.Hosts) {
+			return parseProxy(rule.Proxy)
+		}
+	}
+
+	if !pc.FromEnvironment {
+		return nil, nil //nolint:nilnil // No proxy is not an error
+	}
+
+	envTarget := *target
+	if envTarget.Scheme != "http" {
+		envTarget.Scheme = "https"
+	}
+
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: &envTarget})
+	if err != nil {
+		return nil, fmt.Errorf("%w: proxy from environment: %w", fault.ErrInvalidArgument, err)
+	}
+
+	if proxy != nil {
+		withDefaultPort(proxy)
+	}
+
+	return proxy, nil
+}
+
+// DialContext connects to address ("host:port") over TCP, through the proxy configured for its host.
+func (pc *ProxyConfig) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return pc.dialer((&net.Dialer{Timeout: dialTimeout, KeepAlive: dialKeepAlive}).DialContext)(ctx, network, address)
+}
+
+// dialer returns a dialFunc going through the configured proxies, using dial to reach them.
+func (pc *ProxyConfig) dialer(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", fault.ErrInvalidArgument, err)
+		}
+
+		proxy, err := pc.ProxyFor(&url.URL{Scheme: "tcp", Host: address})
+		if err != nil {
+			return nil, err
+		}
+
+		if proxy == nil {
+			return dial(ctx, network, address)
+		}
+
+		return dialProxy(ctx, dial, proxy, host, address)
+	}
+}
+
+func (pc *ProxyConfig) validate() error {
+	for _, rule := range pc.Rules {
+		if _, err := parseProxy(rule.Proxy); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseProxy parses a ProxyRule.Proxy value, returning nil for direct connections.
+func parseProxy(value string) (*url.URL, error) {
+	if value == "" || value == ProxyDirect {
+		return nil, nil //nolint:nilnil // No proxy is not an error
+	}
+
+	proxy, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: proxy %q: %w", fault.ErrInvalidArgument, value, err)
+	}
+
+	switch proxy.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("%w: unsupported proxy scheme %q", fault.ErrInvalidArgument, proxy.Scheme)
+	}
+
+	if proxy.Hostname() == "" {
+		return nil, fmt.Errorf("%w: proxy %s has no host", fault.ErrInvalidArgument, proxy.Redacted())
+	}
+
+	withDefaultPort(proxy)
+
+	return proxy, nil
+}
+
+// withDefaultPort sets the default port of the proxy scheme on proxy if it has none, as net/http does.
+func withDefaultPort(proxy *url.URL) {
+	if proxy.Port() != "" {
+		return
+	}
+
+	port := "1080"
+
+	switch proxy.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	}
+
+	proxy.Host = net.JoinHostPort(proxy.Hostname(), port)
+}
+
+// dialProxy connects to address through proxy. Interrupting the handshake with the proxy relies on deadlines, set
+// from ctx.
+func dialProxy(ctx context.Context, dial dialFunc, proxy *url.URL, host, address string) (net.Conn, error) {
+	conn, err := dial(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("%w: dialing proxy %s: %w", fault.ErrNetworkError, proxy.Redacted(), err)
+	}
+
+	if proxy.Scheme == "https" {
+		tlsConfig := defaultTLSConfig()
+		tlsConfig.ServerName = proxy.Hostname()
+
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, errors.Join(
+				fmt.Errorf("%w: TLS handshake with proxy %s: %w", fault.ErrNetworkError, proxy.Redacted(), err),
+				conn.Close())
+		}
+
+		conn = tlsConn
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	tunnel := conn
+
+	switch proxy.Scheme {
+	case "socks5", "socks5h":
+		err = socksHandshake(conn, proxy, host, address)
+	default:
+		tunnel, err = connectHandshake(conn, proxy, address)
+	}
+
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		if ctx.Err() != nil {
+			err = cancelled(ctx, err)
+		}
+
+		return nil, errors.Join(err, conn.Close())
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return tunnel, nil
+}
+
+// connectHandshake asks an HTTP proxy to open a tunnel to address.
+func connectHandshake(conn net.Conn, proxy *url.URL, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		req.SetBasicAuth(proxy.User.Username(), password)
+		req.Header["Proxy-Authorization"] = req.Header[authorizationHeader]
+		req.Header.Del(authorizationHeader)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("%w: writing CONNECT to proxy %s: %w", fault.ErrNetworkError, proxy.Redacted(), err)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading CONNECT response from proxy %s: %w",
+			fault.ErrNetworkError, proxy.Redacted(), err)
+	}
+
+	_ = resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusProxyAuthRequired:
+		return nil, fmt.Errorf("%w: proxy %s: %s", fault.ErrAuthenticationFailure, proxy.Redacted(), resp.Status)
+	default:
+		return nil, fmt.Errorf("%w: proxy %s refused CONNECT to %s: %s",
+			fault.ErrNetworkError, proxy.Redacted(), address, resp.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+// socksHandshake asks a SOCKS5 proxy to connect to address.
+func socksHandshake(conn net.Conn, proxy *url.URL, host, address string) error {
+	methods := []byte{socksNoAuth}
+	if proxy.User != nil {
+		methods = []byte{socksUserPass}
+	}
+
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return fmt.Errorf("%w: SOCKS5 proxy %s: %w", fault.ErrNetworkError, proxy.Redacted(), err)
+	}
+
+	reply := make([]byte, 2) //nolint:mnd // version and method
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("%w: SOCKS5 proxy %s: %w", fault.ErrNetworkError, proxy.Redacted(), err)
+	}
+
+	switch {
+	case reply[0] != socksVersion:
+		return fmt.Errorf("%w: %s is not a SOCKS5 proxy", fault.ErrNetworkError, proxy.Redacted())
+	case reply[1] == socksNoAcceptable:
+		return fmt.Errorf("%w: SOCKS5 proxy %s accepts none of the authentication methods",
+			fault.ErrAuthenticationFailure, proxy.Redacted())
+	case reply[1] == socksUserPass && proxy.User != nil:
+		if err := socksAuthenticate(conn, proxy); err != nil {
+			return err
+		}
+	case reply[1] != socksNoAuth:
+		return fmt.Errorf("%w: SOCKS5 proxy %s selected unexpected method %d",
+			fault.ErrNetworkError, proxy.Redacted(), reply[1])
+	}
+
+	request, err := socksRequest(host, address)
+	if err != nil {
+		return err
+	}
+
+	if _, err = conn.Write(request); err != nil {
+		return fmt.Errorf("%w: SOCKS5 proxy %s: %w", fault.ErrNetworkError, proxy.Redacted(), err)
+	}
+
+	return socksReply(conn, proxy, address)
+}
+
+func socksAuthenticate(conn net.Conn, proxy *url.URL) error {
+	username := proxy.User.Username()
+	password, _ := proxy.User.Password()
+
+	if len(username) > socksMaxFieldLength || len(password) > socksMaxFieldLength {
+		return fmt.Errorf("%w: SOCKS5 credentials exceed %d bytes", fault.ErrInvalidArgument, socksMaxFieldLength)
+	}
+
+	message := []byte{socksAuthVersion, byte(len(username))}
+	message = append(message, username...)
+	message = append(message, byte(len(password)))
+	message = append(message, password...)
+
+	if _, err := conn.Write(message); err != nil {
+		return fmt.Errorf("%w: SOCKS5 proxy %s: %w", fault.ErrNetworkError, proxy.Redacted(), err)
+	}
+
+	reply := make([]byte, 2) //nolint:mnd // version and status
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("%w: SOCKS5 proxy %s: %w", fault.ErrNetworkError, proxy.Redacted(), err)
+	}
+
+	if reply[1] != socksSucceeded {
+		return fmt.Errorf("%w: SOCKS5 proxy %s rejected the credentials", fault.ErrAuthenticationFailure,
+			proxy.Redacted())
+	}
+
+	return nil
+}
+
+// socksRequest builds a CONNECT request, leaving the resolution of host names to the proxy.
+func socksRequest(host, address string) ([]byte, error) {
+	_, portValue, _ := net.SplitHostPort(address)
+
+	port, err := strconv.ParseUint(portValue, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: port %q: %w", fault.ErrInvalidArgument, portValue, err)
+	}
+
+	ip := net.ParseIP(host)
+
+	request := []byte{socksVersion, socksConnect, 0}
+
+	switch {
+	case ip.To4() != nil:
+		request = append(append(request, socksIPv4), ip.To4()...)
+	case ip != nil:
+		request = append(append(request, socksIPv6), ip.To16()...)
+	case len(host) > socksMaxFieldLength:
+		return nil, fmt.Errorf("%w: host name exceeds %d bytes", fault.ErrInvalidArgument, socksMaxFieldLength)
+	default:
+		request = append(append(request, socksDomain, byte(len(host))), host...)
+	}
+
+	return binary.BigEndian.AppendUint16(request, uint16(port)), nil
+}
+
+func socksReply(conn net.Conn, proxy *url.URL, address string) error {
+	header := make([]byte, socksReplyHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("%w: SOCKS5 proxy %s: %w", fault.ErrNetworkError, proxy.Redacted(), err)
+	}
+
+	if header[1] != socksSucceeded {
+		return fmt.Errorf("%w: SOCKS5 proxy %s failed to connect to %s (reply %d)",
+			fault.ErrNetworkError, proxy.Redacted(), address, header[1])
+	}
+
+	// Skip the bound address and port.
+	var length int
+
+	switch header[3] {
+	case socksIPv4:
+		length = net.IPv4len
+	case socksIPv6:
+		length = net.IPv6len
+	case socksDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return fmt.Errorf("%w: SOCKS5 proxy %s: %w", fault.ErrNetworkError, proxy.Redacted(), err)
+		}
+
+		length = int(size[0])
+	default:
+		return fmt.Errorf("%w: SOCKS5 proxy %s returned address type %d",
+			fault.ErrNetworkError, proxy.Redacted(), header[3])
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, length+2)); err != nil { //nolint:mnd // port
+		return fmt.Errorf("%w: SOCKS5 proxy %s: %w", fault.ErrNetworkError, proxy.Redacted(), err)
+	}
+
+	return nil
+}
+
+// bufferedConn returns the data read ahead by a bufio.Reader before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+
+	reader *bufio.Reader
+}
+
+//nolint:wrapcheck // I/O wrapper must return unwrapped errors
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	return bc.reader.Read(p)
+}
@@ -0,0 +1,241 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/network"
+	"github.com/mycophonic/primordium/network/networktest"
+)
+
+func proxyConfig(proxy *url.URL) *network.ProxyConfig {
+	return &network.ProxyConfig{Rules: []network.ProxyRule{
+		{Hosts: []string{"localhost"}, Proxy: network.ProxyDirect},
+		{Hosts: []string{"*"}, Proxy: proxy.String()},
+	}}
+}
+
+func TestWithProxy_HTTP(t *testing.T) {
+	t.Parallel()
+
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "plain")
+	}))
+	t.Cleanup(plain.Close)
+
+	secure := networktest.NewTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "secure")
+	}))
+
+	for name, proxy := range map[string]*networktest.Proxy{
+		"socks5":  networktest.NewSOCKS5Proxy(t, "user", "s3cret"),
+		"connect": networktest.NewHTTPProxy(t, "user", "s3cret"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			client := &http.Client{Transport: secure.RoundTripper(network.WithProxy(proxyConfig(proxy.URL)))}
+
+			for _, target := range []string{plain.URL, secure.URL} {
+				resp, err := getResponse(t, client, target, nil)
+				if err != nil {
+					t.Fatalf("request to %s through %s failed: %v", target, name, err)
+				}
+
+				_ = resp.Body.Close()
+
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("request to %s through %s: status %d", target, name, resp.StatusCode)
+				}
+			}
+
+			if got := len(proxy.Targets()); got != 2 {
+				t.Errorf("proxy received %d connections, want 2: %v", got, proxy.Targets())
+			}
+		})
+	}
+}
+
+func TestProxyConfig_DialContext(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(server.Close)
+
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	for name, proxy := range map[string]*networktest.Proxy{
+		"socks5":  networktest.NewSOCKS5Proxy(t, "user", "s3cret"),
+		"connect": networktest.NewHTTPProxy(t, "user", "s3cret"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			conn, err := proxyConfig(proxy.URL).DialContext(context.Background(), "tcp", address)
+			if err != nil {
+				t.Fatalf("DialContext returned error: %v", err)
+			}
+
+			_ = conn.Close()
+
+			if !slices.Contains(proxy.Targets(), address) {
+				t.Errorf("proxy targets = %v, want %s", proxy.Targets(), address)
+			}
+
+			wrong := *proxy.URL
+			wrong.User = url.UserPassword("user", "wrong")
+
+			_, err = proxyConfig(&wrong).DialContext(context.Background(), "tcp", address)
+			if !errors.Is(err, fault.ErrAuthenticationFailure) {
+				t.Errorf("expected ErrAuthenticationFailure with wrong credentials, got %v", err)
+			}
+		})
+	}
+}
+
+func TestProxyConfig_SOCKS5RemoteResolution(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(server.Close)
+
+	proxy := networktest.NewSOCKS5Proxy(t, "", "")
+
+	// As with net/http, the socks5 scheme leaves name resolution to the proxy.
+	socks5 := *proxy.URL
+	socks5.Scheme = "socks5"
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := net.JoinHostPort("localhost", port)
+
+	config := &network.ProxyConfig{Rules: []network.ProxyRule{{Hosts: []string{"*"}, Proxy: socks5.String()}}}
+
+	conn, err := config.DialContext(context.Background(), "tcp", address)
+	if err != nil {
+		t.Fatalf("DialContext returned error: %v", err)
+	}
+
+	_ = conn.Close()
+
+	if !slices.Contains(proxy.Targets(), address) {
+		t.Errorf("proxy targets = %v, want %s", proxy.Targets(), address)
+	}
+}
+
+func TestProxyConfig_ProxyFor(t *testing.T) {
+	t.Parallel()
+
+	config := &network.ProxyConfig{Rules: []network.ProxyRule{
+		{Hosts: []string{"*.internal.example.com"}, Proxy: network.ProxyDirect},
+		{Hosts: []string{"*.example.com", "!legacy.example.com"}, Proxy: "socks5h://proxy.example.com:1080"},
+	}}
+
+	for target, want := range map[string]string{
+		"https://api.example.com/v1":        "socks5h://proxy.example.com:1080",
+		"https://db.internal.example.com/":  "",
+		"https://legacy.example.com/":       "",
+		"http://unrelated.example.org:8080": "",
+	} {
+		parsed, err := url.Parse(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		proxy, err := config.ProxyFor(parsed)
+		if err != nil {
+			t.Fatalf("ProxyFor(%s) returned error: %v", target, err)
+		}
+
+		if got := proxyString(proxy); got != want {
+			t.Errorf("ProxyFor(%s) = %q, want %q", target, got, want)
+		}
+	}
+
+	for proxy, want := range map[string]string{
+		"socks5://proxy.example.com": "socks5://proxy.example.com:1080",
+		"http://proxy.example.com":   "http://proxy.example.com:80",
+		"https://[2001:db8::1]":      "https://[2001:db8::1]:443",
+	} {
+		config := &network.ProxyConfig{Rules: []network.ProxyRule{{Hosts: []string{"*"}, Proxy: proxy}}}
+
+		got, err := config.ProxyFor(&url.URL{Scheme: "https", Host: "api.example.com"})
+		if err != nil || proxyString(got) != want {
+			t.Errorf("ProxyFor through %s = %q, %v, want %q", proxy, proxyString(got), err, want)
+		}
+	}
+
+	for _, invalid := range []string{"ftp://proxy:21", "socks5://:1080", "://"} {
+		_, err := network.NewTransportWithOptions(network.WithProxy(&network.ProxyConfig{
+			Rules: []network.ProxyRule{{Hosts: []string{"*"}, Proxy: invalid}},
+		}))
+		if !errors.Is(err, fault.ErrInvalidArgument) {
+			t.Errorf("WithProxy(%q): expected ErrInvalidArgument, got %v", invalid, err)
+		}
+	}
+}
+
+func TestDialSSH_Proxy(t *testing.T) {
+	t.Parallel()
+
+	for name, proxy := range map[string]*networktest.Proxy{
+		"socks5":  networktest.NewSOCKS5Proxy(t, "", ""),
+		"connect": networktest.NewHTTPProxy(t, "user", "s3cret"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			server := networktest.NewSSHServer(t)
+
+			opts := server.Options()
+			opts.Proxy = proxyConfig(proxy.URL)
+
+			client, err := network.DialSSH(context.Background(), "tester@"+server.Addr, opts)
+			if err != nil {
+				t.Fatalf("DialSSH through %s returned error: %v", name, err)
+			}
+
+			_ = client.Close()
+
+			if !slices.Contains(proxy.Targets(), server.Addr) {
+				t.Errorf("proxy targets = %v, want %s", proxy.Targets(), server.Addr)
+			}
+		})
+	}
+}
+
+func proxyString(proxy *url.URL) string {
+	if proxy == nil {
+		return ""
+	}
+
+	return proxy.String()
+}
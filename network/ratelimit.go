@@ -0,0 +1,309 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mycophonic/primordium/fault"
+)
+
+const (
+	// rateLimitBackoffFactor divides the rate on every 429, down to rateLimitMinFactor of the configured rate.
+	rateLimitBackoffFactor = 2
+	rateLimitMinFactor     = 16
+	// rateLimitRecoverySteps is the number of successful responses needed to recover the configured rate.
+	rateLimitRecoverySteps = 10
+	// rateLimitDefaultPause applies on a 429 without Retry-After.
+	rateLimitDefaultPause = time.Second
+	// epochThreshold tells X-RateLimit-Reset epoch timestamps apart from delays in seconds.
+	epochThreshold = 1_000_000_000
+)
+
+// RateLimit declares the limits applied to the hosts matching Host.
+type RateLimit struct {
+	// Host is an ssh_config style pattern ("api.example.com", "*.example.com", "!internal.example.com").
+	Host string `json:"host"`
+	// Rate is the sustained number of requests per second. Zero means no rate limit.
+	Rate float64 `json:"rate"`
+	// Burst is the number of requests that can be sent at once. Defaults to 1.
+	Burst int `json:"burst"`
+	// MaxConcurrent limits the number of requests in flight, until their response body is closed. Zero means no
+	// limit.
+	MaxConcurrent int `json:"maxConcurrent"`
+}
+
+// RateLimiter applies RateLimits per host (host and port), with a token bucket for the rate and a semaphore for
+// concurrency. The first RateLimit matching a host applies, and hosts matching none are not limited.
+//
+// Limits adapt to servers: a 429 halves the rate (recovering progressively on success) and pauses the host for its
+// Retry-After delay, and hosts announcing an exhausted quota through RateLimit-Remaining / RateLimit-Reset,
+// X-RateLimit-Remaining / X-RateLimit-Reset or RateLimit ("r" and "t" parameters) headers are paused until reset.
+//
+// Waiting respects the request context: if its deadline would expire before the request could be sent, it fails
+// immediately with fault.ErrCancelled.
+type RateLimiter struct {
+	limits []RateLimit
+
+	mu    sync.Mutex
+	hosts map[string]*hostLimiter
+}
+
+// NewRateLimiter returns a RateLimiter applying limits.
+func NewRateLimiter(limits ...RateLimit) *RateLimiter {
+	return &RateLimiter{limits: limits, hosts: map[string]*hostLimiter{}}
+}
+
+type hostLimiter struct {
+	slots chan struct{}
+
+	mu         sync.Mutex
+	configured float64
+	rate       float64
+	burst      float64
+	tokens     float64
+	last       time.Time
+	pausedTill time.Time
+}
+
+// wait blocks until req may be sent. The returned function must be called once the response is done with.
+func (l *RateLimiter) wait(req *http.Request) (func(), error) {
+	limiter := l.limiter(req.URL.Host, req.URL.Hostname())
+	if limiter == nil {
+		return func() {}, nil
+	}
+
+	ctx := req.Context()
+
+	delay := limiter.reserve(time.Now())
+	if delay > 0 {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			limiter.cancel()
+
+			return nil, fmt.Errorf("%w: %w: rate limit delay of %s for %s exceeds the deadline",
+				fault.ErrCancelled, context.DeadlineExceeded, delay, req.URL.Host)
+		}
+
+		slog.DebugContext(ctx, "rate limiting HTTP request",
+			slog.String("host", req.URL.Host),
+			slog.Duration("delay", delay))
+
+		if err := sleep(ctx, delay); err != nil {
+			limiter.cancel()
+
+			return nil, err
+		}
+	}
+
+	if limiter.slots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case limiter.slots <- struct{}{}:
+		var once sync.Once
+
+		return func() { once.Do(func() { <-limiter.slots }) }, nil
+	case <-ctx.Done():
+		limiter.cancel()
+
+		return nil, cancelled(ctx, nil)
+	}
+}
+
+// observe adapts the limits of the host of resp.
+func (l *RateLimiter) observe(resp *http.Response) {
+	limiter := l.limiter(resp.Request.URL.Host, resp.Request.URL.Hostname())
+	if limiter == nil {
+		return
+	}
+
+	now := time.Now()
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		limiter.rate = max(limiter.rate/rateLimitBackoffFactor, limiter.configured/rateLimitMinFactor)
+
+		pause, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+		if !ok {
+			pause = rateLimitDefaultPause
+		}
+
+		limiter.pause(now.Add(pause))
+
+		return
+	}
+
+	if resp.StatusCode < http.StatusBadRequest {
+		limiter.rate = min(limiter.configured, limiter.rate+limiter.configured/rateLimitRecoverySteps)
+	}
+
+	if reset, exhausted := quotaReset(resp.Header, now); exhausted {
+		limiter.pause(reset)
+	}
+}
+
+// limiter returns the limiter of host, or nil if no RateLimit applies. Only limited hosts are remembered, so that
+// requests to arbitrary hosts cannot grow the map.
+func (l *RateLimiter) limiter(host, hostname string) *hostLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limiter, ok := l.hosts[host]; ok {
+		return limiter
+	}
+
+	for _, limit := range l.limits {
+		if !matchPatternList(hostname, []string{limit.Host}) {
+			continue
+		}
+
+		limiter := &hostLimiter{
+			configured: limit.Rate,
+			rate:       limit.Rate,
+			burst:      float64(max(limit.Burst, 1)),
+			tokens:     float64(max(limit.Burst, 1)),
+			last:       time.Now(),
+		}
+
+		if limit.MaxConcurrent > 0 {
+			limiter.slots = make(chan struct{}, limit.MaxConcurrent)
+		}
+
+		l.hosts[host] = limiter
+
+		return limiter
+	}
+
+	return nil
+}
+
+// reserve takes a token, and returns how long to wait before using it.
+func (h *hostLimiter) reserve(now time.Time) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var delay time.Duration
+
+	if h.rate > 0 {
+		h.tokens = min(h.burst, h.tokens+now.Sub(h.last).Seconds()*h.rate)
+		h.last = now
+		h.tokens--
+
+		if h.tokens < 0 {
+			delay = time.Duration(-h.tokens / h.rate * float64(time.Second))
+		}
+	}
+
+	return max(delay, h.pausedTill.Sub(now))
+}
+
+// cancel gives back a token that was not used.
+func (h *hostLimiter) cancel() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.rate > 0 {
+		h.tokens = min(h.burst, h.tokens+1)
+	}
+}
+
+func (h *hostLimiter) pause(until time.Time) {
+	if until.After(h.pausedTill) {
+		h.pausedTill = until
+	}
+}
+
+// quotaReset returns when the quota announced by the response headers resets, if it is exhausted.
+func quotaReset(header http.Header, now time.Time) (time.Time, bool) {
+	for _, prefix := range []string{"RateLimit-", "X-RateLimit-"} {
+		remaining, err := strconv.Atoi(header.Get(prefix + "Remaining"))
+		if err != nil || remaining > 0 {
+			continue
+		}
+
+		reset, ok := resetSeconds(header.Get(prefix + "Reset"))
+		if !ok {
+			return now.Add(rateLimitDefaultPause), true
+		}
+
+		if reset > epochThreshold {
+			return time.Unix(reset, 0), true
+		}
+
+		return now.Add(time.Duration(reset) * time.Second), true
+	}
+
+	// Structured field form: RateLimit: "policy";r=0;t=30
+	for item := range strings.SplitSeq(header.Get("RateLimit"), ",") {
+		params := map[string]string{}
+
+		for param := range strings.SplitSeq(item, ";") {
+			if key, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok {
+				params[key] = value
+			}
+		}
+
+		if remaining, err := strconv.Atoi(params["r"]); err != nil || remaining > 0 {
+			continue
+		}
+
+		reset, ok := resetSeconds(params["t"])
+		if !ok {
+			return now.Add(rateLimitDefaultPause), true
+		}
+
+		return now.Add(time.Duration(reset) * time.Second), true
+	}
+
+	return time.Time{}, false
+}
+
+// resetSeconds parses a quota reset in seconds, rejecting negative values. Out of range values are clamped by
+// ParseInt, and clamped again so that the conversion to a time.Duration cannot overflow.
+func resetSeconds(value string) (int64, bool) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if (err != nil && !errors.Is(err, strconv.ErrRange)) || seconds < 0 {
+		return 0, false
+	}
+
+	return min(seconds, int64(maxDuration/time.Second)), true
+}
+
+// releaseBody calls release once the body is closed.
+type releaseBody struct {
+	io.ReadCloser
+
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	defer b.release()
+
+	return b.ReadCloser.Close() //nolint:wrapcheck // Passthrough
+}
@@ -0,0 +1,290 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/network"
+)
+
+func limitedClient(t *testing.T, limits ...network.RateLimit) *http.Client {
+	t.Helper()
+
+	rt := newTransport(t)
+	rt.RateLimiter = network.NewRateLimiter(limits...)
+
+	return &http.Client{Transport: rt}
+}
+
+func getStatus(t *testing.T, client *http.Client, ctx context.Context, url string) (int, error) {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	_ = resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+func TestRateLimiter_Rate(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	t.Cleanup(server.Close)
+
+	client := limitedClient(t, network.RateLimit{Host: "example.com", Rate: 1},
+		network.RateLimit{Host: "127.0.0.*", Rate: 20, Burst: 2})
+
+	start := time.Now()
+
+	for range 6 {
+		if _, err := getStatus(t, client, context.Background(), server.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two requests go in a burst, the four others are spaced by 50ms.
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Errorf("6 requests at 20/s with a burst of 2 took %s, want at least 200ms", elapsed)
+	}
+
+	unlimited := limitedClient(t, network.RateLimit{Host: "example.com", Rate: 1})
+	start = time.Now()
+
+	for range 6 {
+		if _, err := getStatus(t, unlimited, context.Background(), server.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("requests to a host without limits took %s", elapsed)
+	}
+}
+
+func TestRateLimiter_RespectsDeadline(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	t.Cleanup(server.Close)
+
+	client := limitedClient(t, network.RateLimit{Host: "*", Rate: 0.1})
+
+	if _, err := getStatus(t, client, context.Background(), server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+
+	_, err := getStatus(t, client, ctx, server.URL)
+	if !errors.Is(err, fault.ErrCancelled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected ErrCancelled and DeadlineExceeded, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("request waited %s instead of failing immediately", elapsed)
+	}
+}
+
+func TestRateLimiter_Adapts(t *testing.T) {
+	t.Parallel()
+
+	for name, header := range map[string]http.Header{
+		"429":                  {"Retry-After": {"1"}},
+		"X-RateLimit":          {"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {"1"}},
+		"RateLimit":            {"Ratelimit-Remaining": {"0"}, "Ratelimit-Reset": {"1"}},
+		"RateLimit-Structured": {"Ratelimit": {`"default";r=0;t=1`}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			var calls atomic.Int32
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if calls.Add(1) > 1 {
+					return
+				}
+
+				for key, values := range header {
+					w.Header()[key] = values
+				}
+
+				if name == "429" {
+					w.WriteHeader(http.StatusTooManyRequests)
+				}
+			}))
+			t.Cleanup(server.Close)
+
+			client := limitedClient(t, network.RateLimit{Host: "*"})
+
+			if _, err := getStatus(t, client, context.Background(), server.URL); err != nil {
+				t.Fatal(err)
+			}
+
+			start := time.Now()
+
+			if status, err := getStatus(t, client, context.Background(), server.URL); err != nil ||
+				status != http.StatusOK {
+				t.Fatalf("status = %d, err = %v", status, err)
+			}
+
+			if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+				t.Errorf("host was not paused, second request took %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_ResetBounds(t *testing.T) {
+	t.Parallel()
+
+	for name, test := range map[string]struct {
+		header http.Header
+		paused time.Duration
+	}{
+		// Converted naively, the structured delay overflows into a negative one, and the host is not paused at all.
+		"Overflowing-Structured": {http.Header{"Ratelimit": {`"default";r=0;t=9300000000`}}, time.Hour},
+		// Out of range values are clamped, not ignored.
+		"Out-Of-Range": {
+			http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {"99999999999999999999"}}, time.Hour,
+		},
+		"Out-Of-Range-Structured": {http.Header{"Ratelimit": {`"default";r=0;t=99999999999999999999`}}, time.Hour},
+		// Negative values are rejected, and the default pause applies.
+		"Negative":            {http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {"-5"}}, time.Second},
+		"Negative-Structured": {http.Header{"Ratelimit": {`"default";r=0;t=-5`}}, time.Second},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				for key, values := range test.header {
+					w.Header()[key] = values
+				}
+			}))
+			t.Cleanup(server.Close)
+
+			client := limitedClient(t, network.RateLimit{Host: "*"})
+
+			if _, err := getStatus(t, client, context.Background(), server.URL); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), test.paused/2)
+			defer cancel()
+
+			if _, err := getStatus(t, client, ctx, server.URL); !errors.Is(err, fault.ErrCancelled) {
+				t.Errorf("expected the host to be paused for %s, got %v", test.paused, err)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_MaxConcurrent(t *testing.T) {
+	t.Parallel()
+
+	var inFlight, peak atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+
+		for {
+			previous := peak.Load()
+			if current <= previous || peak.CompareAndSwap(previous, current) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}))
+	t.Cleanup(server.Close)
+
+	client := limitedClient(t, network.RateLimit{Host: "*", MaxConcurrent: 2})
+
+	var group sync.WaitGroup
+
+	for range 8 {
+		group.Go(func() {
+			if _, err := getStatus(t, client, context.Background(), server.URL); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	group.Wait()
+
+	if peak.Load() > 2 {
+		t.Errorf("peak concurrency = %d, want at most 2", peak.Load())
+	}
+}
+
+func TestRateLimiter_SlotWaitGivesBackToken(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	t.Cleanup(server.Close)
+
+	client := limitedClient(t, network.RateLimit{Host: "*", Rate: 0.1, Burst: 2, MaxConcurrent: 1})
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the only slot.
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err = getStatus(t, client, ctx, server.URL); !errors.Is(err, fault.ErrCancelled) {
+		t.Fatalf("expected ErrCancelled while waiting for a slot, got %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	// The token taken by the cancelled request was given back: no 10s delay.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err = getStatus(t, client, ctx, server.URL); err != nil {
+		t.Errorf("request after a cancelled slot wait failed: %v", err)
+	}
+}
@@ -0,0 +1,312 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mycophonic/primordium/fault"
+)
+
+// Retry defaults.
+const (
+	defaultRetryMaxAttempts = 4
+	defaultRetryMinBackoff  = 500 * time.Millisecond
+	defaultRetryMaxBackoff  = 30 * time.Second
+	retryDrainLimit         = 64 * 1024
+)
+
+// idempotentMethods are retried automatically, as defined by RFC 9110, section 9.2.2.
+//
+//nolint:gochecknoglobals // Read-only lookup table
+var idempotentMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+	http.MethodTrace,
+	http.MethodPut,
+	http.MethodDelete,
+}
+
+type retryableKey struct{}
+
+// AllowRetry marks requests made with the returned context as safe to retry, even if their method is not idempotent.
+// Requests carrying an Idempotency-Key or X-Idempotency-Key header are considered safe as well, following net/http.
+func AllowRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryableKey{}, true)
+}
+
+// RetryPolicy configures retries in RoundTripper. The zero value is usable and applies the defaults.
+//
+// Requests are retried on transient network errors (connection failures, resets, timeouts) and on RetryStatusCodes,
+// with exponential backoff and full jitter. Other errors, such as authentication failures or rate limiting deadlines,
+// are returned immediately.
+// For 429 and 503 responses, a Retry-After header takes precedence over the computed backoff, and the response is
+// returned as is if the server asks to wait longer than MaxBackoff.
+// Only idempotent requests (see AllowRetry) with a rewindable body (http.Request.GetBody) are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one. Defaults to 4.
+	MaxAttempts int
+	// MinBackoff is the base delay before the first retry. Defaults to 500ms.
+	MinBackoff time.Duration
+	// MaxBackoff caps the delay between attempts. Defaults to 30s.
+	MaxBackoff time.Duration
+	// Budget, if set, limits the overall proportion of retries and can be shared between policies.
+	Budget *RetryBudget
+}
+
+// RetryBudget limits retries to a proportion of requests, so that retries cannot amplify an outage.
+// Every request deposits ratio tokens, up to a maximum of reserve tokens, and every retry withdraws one.
+type RetryBudget struct {
+	mu      sync.Mutex
+	ratio   float64
+	reserve float64
+	tokens  float64
+}
+
+// NewRetryBudget returns a budget allowing retries for ratio of the requests (eg: 0.2 for 20%), with up to reserve
+// retries available in a burst. The budget starts full.
+func NewRetryBudget(ratio float64, reserve int) *RetryBudget {
+	return &RetryBudget{
+		ratio:   ratio,
+		reserve: float64(reserve),
+		tokens:  float64(reserve),
+	}
+}
+
+func (b *RetryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = min(b.reserve, b.tokens+b.ratio)
+}
+
+func (b *RetryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// do sends req, retrying according to the policy.
+func (p *RetryPolicy) do(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	ctx := req.Context()
+	retryable := isRetryableRequest(req)
+
+	if p.Budget != nil {
+		p.Budget.deposit()
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := send(req)
+		if err != nil && ctx.Err() != nil {
+			return nil, cancelled(ctx, err)
+		}
+
+		if !retryable || attempt >= p.maxAttempts() || !p.shouldRetry(resp, err) {
+			return resp, err //nolint:wrapcheck // pass through
+		}
+
+		delay, ok := p.delay(attempt, resp)
+		if !ok || (p.Budget != nil && !p.Budget.withdraw()) {
+			return resp, err //nolint:wrapcheck // pass through
+		}
+
+		slog.DebugContext(ctx, "retrying HTTP request",
+			slog.String("url", req.URL.String()),
+			slog.Int("attempt", attempt),
+			slog.Duration("delay", delay),
+			slog.Any("error", err))
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, retryDrainLimit))
+			_ = resp.Body.Close()
+		}
+
+		if err = sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+
+		if req, err = rewind(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *RetryPolicy) shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return transientError(err)
+	}
+
+	return slices.Contains(RetryStatusCodes, resp.StatusCode)
+}
+
+// transientError tells whether err is a network failure that another attempt may not hit.
+func transientError(err error) bool {
+	if errors.Is(err, fault.ErrAuthenticationFailure) || errors.Is(err, fault.ErrCancelled) ||
+		errors.Is(err, fault.ErrInvalidArgument) {
+		return false
+	}
+
+	var (
+		netErr net.Error
+		opErr  *net.OpError
+	)
+
+	switch {
+	case errors.Is(err, fault.ErrNetworkError),
+		errors.As(err, &opErr),
+		errors.As(err, &netErr) && netErr.Timeout(),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	default:
+		return false
+	}
+}
+
+// delay returns how long to wait before the next attempt, or false if the server asked for more than MaxBackoff.
+func (p *RetryPolicy) delay(attempt int, resp *http.Response) (time.Duration, bool) {
+	if resp != nil &&
+		(resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if after, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return after, after <= p.maxBackoff()
+		}
+	}
+
+	backoff := p.minBackoff() << min(attempt-1, 30) //nolint:mnd // avoid overflowing the shift
+	if backoff <= 0 || backoff > p.maxBackoff() {
+		backoff = p.maxBackoff()
+	}
+
+	// Full jitter, see https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+	return rand.N(backoff + 1), true //nolint:gosec // Jitter does not need a secure source
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return defaultRetryMaxAttempts
+	}
+
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) minBackoff() time.Duration {
+	if p.MinBackoff <= 0 {
+		return defaultRetryMinBackoff
+	}
+
+	return p.MinBackoff
+}
+
+func (p *RetryPolicy) maxBackoff() time.Duration {
+	if p.MaxBackoff <= 0 {
+		return defaultRetryMaxBackoff
+	}
+
+	return p.MaxBackoff
+}
+
+func isRetryableRequest(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+
+	if slices.Contains(idempotentMethods, req.Method) {
+		return true
+	}
+
+	if req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != "" {
+		return true
+	}
+
+	allowed, _ := req.Context().Value(retryableKey{}).(bool)
+
+	return allowed
+}
+
+// rewind returns a copy of req with a fresh body.
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, fmt.Errorf("%w: rewinding request body: %w", fault.ErrReadFailure, err)
+	}
+
+	clone := req.Clone(req.Context())
+	clone.Body = body
+
+	return clone, nil
+}
+
+// parseRetryAfter parses a Retry-After header, either in seconds or as an HTTP date.
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	// Out of range values are clamped by ParseInt, and clamped again so that the conversion cannot overflow.
+	if seconds, err := strconv.ParseInt(header, 10, 64); err == nil || errors.Is(err, strconv.ErrRange) {
+		return time.Duration(min(max(seconds, 0), int64(maxDuration/time.Second))) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+
+	return 0, false
+}
+
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return cancelled(ctx, nil)
+	}
+}
+
+// cancelled maps a context failure to fault.ErrCancelled.
+func cancelled(ctx context.Context, err error) error {
+	return fmt.Errorf("%w: %w", fault.ErrCancelled, errors.Join(ctx.Err(), err))
+}
@@ -0,0 +1,329 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/network"
+)
+
+// flakyServer fails the first failures requests with status, then succeeds, echoing the request body.
+func flakyServer(t *testing.T, failures int32, status int, header http.Header) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var attempts atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		if attempts.Add(1) <= failures {
+			for key, values := range header {
+				w.Header()[key] = values
+			}
+
+			w.WriteHeader(status)
+
+			return
+		}
+
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &attempts
+}
+
+func fastRetryTransport(t *testing.T, policy *network.RetryPolicy) *network.RoundTripper {
+	t.Helper()
+
+	if policy.MinBackoff == 0 {
+		policy.MinBackoff = time.Millisecond
+	}
+
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = 10 * time.Millisecond
+	}
+
+	rt := newTransport(t)
+	rt.Retry = policy
+
+	return rt
+}
+
+func TestRetry_RetriesIdempotentRequests(t *testing.T) {
+	t.Parallel()
+
+	server, attempts := flakyServer(t, 2, http.StatusServiceUnavailable, nil)
+	client := &http.Client{Transport: fastRetryTransport(t, &network.RetryPolicy{})}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL, nil)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || attempts.Load() != 3 {
+		t.Errorf("status = %d after %d attempts, want 200 after 3", resp.StatusCode, attempts.Load())
+	}
+}
+
+func TestRetry_GivesUpAfterMaxAttempts(t *testing.T) {
+	t.Parallel()
+
+	server, attempts := flakyServer(t, 10, http.StatusBadGateway, nil)
+	client := &http.Client{Transport: fastRetryTransport(t, &network.RetryPolicy{MaxAttempts: 2})}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL, nil)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway || attempts.Load() != 2 {
+		t.Errorf("status = %d after %d attempts, want 502 after 2", resp.StatusCode, attempts.Load())
+	}
+}
+
+func TestRetry_PostNotRetriedUnlessMarked(t *testing.T) {
+	t.Parallel()
+
+	server, attempts := flakyServer(t, 1, http.StatusServiceUnavailable, nil)
+	client := &http.Client{Transport: fastRetryTransport(t, &network.RetryPolicy{})}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, server.URL, strings.NewReader("x"))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable || attempts.Load() != 1 {
+		t.Fatalf("unmarked POST: status = %d after %d attempts", resp.StatusCode, attempts.Load())
+	}
+
+	// Marked POST is retried, and the body is rewound.
+	req, _ = http.NewRequestWithContext(
+		network.AllowRetry(context.Background()), http.MethodPost, server.URL, strings.NewReader("payload"))
+
+	attempts.Store(0)
+
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "payload" || attempts.Load() != 2 {
+		t.Errorf("marked POST: status = %d, body = %q after %d attempts", resp.StatusCode, body, attempts.Load())
+	}
+}
+
+func TestRetry_RetryAfterBeyondMaxBackoff(t *testing.T) {
+	t.Parallel()
+
+	// The last two would overflow time.Duration, or int64.
+	for _, retryAfter := range []string{"3600", "9223372037", "99999999999999999999"} {
+		t.Run(retryAfter, func(t *testing.T) {
+			t.Parallel()
+
+			server, attempts := flakyServer(t, 1, http.StatusTooManyRequests, http.Header{"Retry-After": {retryAfter}})
+			client := &http.Client{Transport: fastRetryTransport(t, &network.RetryPolicy{})}
+
+			req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL, nil)
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusTooManyRequests || attempts.Load() != 1 {
+				t.Errorf("status = %d after %d attempts, want 429 after 1", resp.StatusCode, attempts.Load())
+			}
+		})
+	}
+}
+
+func TestRetry_RetryAfterHonored(t *testing.T) {
+	t.Parallel()
+
+	server, attempts := flakyServer(t, 1, http.StatusServiceUnavailable, http.Header{"Retry-After": {"0"}})
+	client := &http.Client{Transport: fastRetryTransport(t, &network.RetryPolicy{})}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL, nil)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || attempts.Load() != 2 {
+		t.Errorf("status = %d after %d attempts, want 200 after 2", resp.StatusCode, attempts.Load())
+	}
+}
+
+func TestRetry_Budget(t *testing.T) {
+	t.Parallel()
+
+	server, attempts := flakyServer(t, 10, http.StatusServiceUnavailable, nil)
+	budget := network.NewRetryBudget(0, 1)
+	client := &http.Client{Transport: fastRetryTransport(t, &network.RetryPolicy{Budget: budget})}
+
+	for range 2 {
+		req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL, nil)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+
+		resp.Body.Close()
+	}
+
+	// One retry allowed by the reserve, then the budget is exhausted.
+	if attempts.Load() != 3 {
+		t.Errorf("attempts = %d, want 3", attempts.Load())
+	}
+}
+
+func TestRetry_ContextCancellation(t *testing.T) {
+	t.Parallel()
+
+	server, _ := flakyServer(t, 10, http.StatusServiceUnavailable, nil)
+	client := &http.Client{Transport: fastRetryTransport(t, &network.RetryPolicy{
+		MinBackoff: time.Hour,
+		MaxBackoff: time.Hour,
+	})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	if !errors.Is(err, fault.ErrCancelled) {
+		t.Errorf("expected ErrCancelled, got: %v", err)
+	}
+}
+
+// failingAuthenticator fails every authorization with err.
+type failingAuthenticator struct {
+	err   error
+	calls atomic.Int32
+}
+
+func (a *failingAuthenticator) Authorize(*http.Request) error {
+	a.calls.Add(1)
+
+	return a.err
+}
+
+func TestRetry_NonTransientErrorsNotRetried(t *testing.T) {
+	t.Parallel()
+
+	server, attempts := flakyServer(t, 0, http.StatusOK, nil)
+
+	for _, failure := range []error{fault.ErrAuthenticationFailure, fault.ErrCancelled} {
+		t.Run(failure.Error(), func(t *testing.T) {
+			t.Parallel()
+
+			authenticator := &failingAuthenticator{err: fmt.Errorf("%w: refused", failure)}
+
+			rt := fastRetryTransport(t, &network.RetryPolicy{})
+			rt.Authenticator = authenticator
+
+			req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL, nil)
+
+			resp, err := (&http.Client{Transport: rt}).Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+
+			if !errors.Is(err, failure) || authenticator.calls.Load() != 1 {
+				t.Errorf("error = %v after %d attempts, want %v after 1", err, authenticator.calls.Load(), failure)
+			}
+		})
+	}
+
+	if attempts.Load() != 0 {
+		t.Errorf("server received %d requests, want none", attempts.Load())
+	}
+}
+
+func TestRetry_TransientErrorsRetried(t *testing.T) {
+	t.Parallel()
+
+	var attempts atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if attempts.Add(1) == 1 {
+			// Drop the connection without answering.
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err == nil {
+				_ = conn.Close()
+			}
+
+			return
+		}
+
+		_, _ = io.WriteString(w, "payload")
+	}))
+	t.Cleanup(server.Close)
+
+	client := &http.Client{Transport: fastRetryTransport(t, &network.RetryPolicy{})}
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL, nil)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || attempts.Load() != 2 {
+		t.Errorf("status = %d after %d attempts, want 200 after 2", resp.StatusCode, attempts.Load())
+	}
+}
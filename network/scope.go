@@ -0,0 +1,134 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	schemeHTTP  = "http"
+	schemeHTTPS = "https"
+)
+
+// Reasons reported in CredentialEvent.
+const (
+	ReasonOutOfScope      = "host outside of the credential scope"
+	ReasonCrossOrigin     = "redirected to another origin"
+	ReasonSchemeDowngrade = "redirected from https to http"
+)
+
+// CredentialEvent describes a request that credentials were withheld from. It never holds secrets.
+type CredentialEvent struct {
+	// URL of the request, with any user information redacted.
+	URL string
+	// Origin of the first request of the redirect chain.
+	Origin string
+	// Reason is one of the Reason constants.
+	Reason string
+}
+
+// CredentialAudit is notified when a RoundTripper withholds credentials.
+type CredentialAudit func(ctx context.Context, event CredentialEvent)
+
+// credentialsAllowed reports whether credentials may be sent with req. Without a scope, credentials are bound to the
+// origin of the first request of a redirect chain. Credentials are never sent after a redirect from https to http.
+func (rt *RoundTripper) credentialsAllowed(req *http.Request) bool {
+	first := req
+	for first.Response != nil && first.Response.Request != nil {
+		first = first.Response.Request
+	}
+
+	var reason string
+
+	switch {
+	case first.URL.Scheme == schemeHTTPS && req.URL.Scheme != schemeHTTPS:
+		reason = ReasonSchemeDowngrade
+	case len(rt.Scope) > 0 && !inScope(req.URL, rt.Scope):
+		reason = ReasonOutOfScope
+	case len(rt.Scope) == 0 && origin(first.URL) != origin(req.URL):
+		reason = ReasonCrossOrigin
+	default:
+		return true
+	}
+
+	event := CredentialEvent{URL: req.URL.Redacted(), Origin: origin(first.URL), Reason: reason}
+
+	if rt.Audit != nil {
+		rt.Audit(req.Context(), event)
+	} else {
+		slog.DebugContext(req.Context(), "withholding credentials",
+			slog.String("url", event.URL),
+			slog.String("origin", event.Origin),
+			slog.String("reason", event.Reason))
+	}
+
+	return false
+}
+
+// inScope reports whether target matches one of the scope entries, either origins ("https://host[:port]") or
+// ssh_config style host patterns ("*.example.com", "!internal.example.com").
+// A matching negated pattern excludes the target even when an origin entry matches it.
+func inScope(target *url.URL, scope []string) bool {
+	var patterns []string
+
+	for _, entry := range scope {
+		if strings.Contains(entry, "://") {
+			continue
+		}
+
+		if negated, ok := strings.CutPrefix(entry, "!"); ok && matchPatternList(target.Hostname(), []string{negated}) {
+			return false
+		}
+
+		patterns = append(patterns, entry)
+	}
+
+	for _, entry := range scope {
+		if !strings.Contains(entry, "://") {
+			continue
+		}
+
+		if parsed, err := url.Parse(entry); err == nil && origin(parsed) == origin(target) {
+			return true
+		}
+	}
+
+	return len(patterns) > 0 && matchPatternList(target.Hostname(), patterns)
+}
+
+// origin returns the canonical origin of u (RFC 6454): lower case scheme and host, with the port made explicit.
+func origin(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+
+	port := u.Port()
+	if port == "" {
+		switch scheme {
+		case schemeHTTP:
+			port = "80"
+		case schemeHTTPS:
+			port = "443"
+		}
+	}
+
+	return scheme + "://" + net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
@@ -0,0 +1,217 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mycophonic/primordium/network"
+	"github.com/mycophonic/primordium/network/networktest"
+)
+
+// authProbe records the Authorization header it receives, per path.
+type authProbe struct {
+	mu       sync.Mutex
+	received map[string]string
+}
+
+func (p *authProbe) record(r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.received[r.URL.Path] = r.Header.Get("Authorization")
+}
+
+func (p *authProbe) get(path string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.received[path]
+}
+
+// redirectServers returns a target server, and an origin server redirecting /cross to the target under the
+// "localhost" name, and /same to itself.
+func redirectServers(t *testing.T) (origin, target *httptest.Server, probe *authProbe) {
+	t.Helper()
+
+	probe = &authProbe{received: map[string]string{}}
+
+	target = httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		probe.record(r)
+	}))
+	t.Cleanup(target.Close)
+
+	targetURL := strings.Replace(target.URL, "127.0.0.1", "user:password@localhost", 1)
+
+	origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probe.record(r)
+
+		switch r.URL.Path {
+		case "/cross":
+			http.Redirect(w, r, targetURL+"/landed", http.StatusFound)
+		case "/same":
+			http.Redirect(w, r, "/final", http.StatusFound)
+		}
+	}))
+	t.Cleanup(origin.Close)
+
+	return origin, target, probe
+}
+
+func scopedClient(t *testing.T, scope []string, events *[]network.CredentialEvent) *http.Client {
+	t.Helper()
+
+	rt := newTransport(t)
+	rt.TokenType, rt.TokenValue = "Bearer", "secret-token"
+	rt.Scope = scope
+
+	var mu sync.Mutex
+
+	rt.Audit = func(_ context.Context, event network.CredentialEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		*events = append(*events, event)
+	}
+
+	return &http.Client{Transport: rt}
+}
+
+func TestRoundTripper_StripsCredentialsOnCrossOriginRedirect(t *testing.T) {
+	t.Parallel()
+
+	origin, _, probe := redirectServers(t)
+
+	var events []network.CredentialEvent
+
+	client := scopedClient(t, nil, &events)
+
+	for _, path := range []string{"/same", "/cross"} {
+		if _, err := doRequest(t, client, http.MethodGet, origin.URL+path, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, path := range []string{"/same", "/final", "/cross"} {
+		if probe.get(path) != "Bearer secret-token" {
+			t.Errorf("%s: Authorization = %q, want credentials on the same origin", path, probe.get(path))
+		}
+	}
+
+	// The redirect URL carries its own user information, which net/http sends as Basic credentials.
+	if strings.Contains(probe.get("/landed"), "secret-token") {
+		t.Errorf("credentials leaked to another origin: %q", probe.get("/landed"))
+	}
+
+	if len(events) != 1 || events[0].Reason != network.ReasonCrossOrigin {
+		t.Fatalf("events = %+v, want one cross origin event", events)
+	}
+
+	if strings.Contains(events[0].URL, "password") || strings.Contains(events[0].URL, "secret-token") ||
+		!strings.Contains(events[0].URL, "/landed") {
+		t.Errorf("event URL = %q, want the redacted target", events[0].URL)
+	}
+}
+
+func TestRoundTripper_Scope(t *testing.T) {
+	t.Parallel()
+
+	origin, target, probe := redirectServers(t)
+	targetPort := target.URL[strings.LastIndex(target.URL, ":"):]
+
+	var events []network.CredentialEvent
+
+	// The target is explicitly in scope, by origin, while the origin server is excluded by pattern.
+	client := scopedClient(t, []string{"http://LOCALHOST" + targetPort, "!127.0.0.1", "*"}, &events)
+
+	if _, err := doRequest(t, client, http.MethodGet, origin.URL+"/cross", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if probe.get("/cross") != "" {
+		t.Errorf("credentials sent out of scope: %q", probe.get("/cross"))
+	}
+
+	if probe.get("/landed") != "Bearer secret-token" {
+		t.Errorf("credentials withheld in scope: %q", probe.get("/landed"))
+	}
+
+	if len(events) != 1 || events[0].Reason != network.ReasonOutOfScope {
+		t.Errorf("events = %+v, want one out of scope event", events)
+	}
+}
+
+func TestRoundTripper_ScopeNegationOverridesOrigin(t *testing.T) {
+	t.Parallel()
+
+	origin, _, probe := redirectServers(t)
+
+	var events []network.CredentialEvent
+
+	// The origin server is listed by origin, and excluded by pattern: the exclusion wins.
+	client := scopedClient(t, []string{origin.URL, "!127.0.0.1"}, &events)
+
+	if _, err := doRequest(t, client, http.MethodGet, origin.URL+"/same", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/same", "/final"} {
+		if probe.get(path) != "" {
+			t.Errorf("%s: credentials sent to an excluded host: %q", path, probe.get(path))
+		}
+	}
+
+	if len(events) != 2 || events[0].Reason != network.ReasonOutOfScope {
+		t.Errorf("events = %+v, want out of scope events", events)
+	}
+}
+
+func TestRoundTripper_NoCredentialsAfterDowngrade(t *testing.T) {
+	t.Parallel()
+
+	_, target, probe := redirectServers(t)
+
+	secure := networktest.NewTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+"/plain", http.StatusFound)
+	}))
+
+	var events []network.CredentialEvent
+
+	rt := secure.RoundTripper()
+	rt.TokenType, rt.TokenValue = "Bearer", "secret-token"
+	rt.Scope = []string{"*"}
+	rt.Audit = func(_ context.Context, event network.CredentialEvent) {
+		events = append(events, event)
+	}
+
+	if _, err := doRequest(t, &http.Client{Transport: rt}, http.MethodGet, secure.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if probe.get("/plain") != "" {
+		t.Errorf("credentials sent over http after a redirect from https: %q", probe.get("/plain"))
+	}
+
+	if len(events) != 1 || events[0].Reason != network.ReasonSchemeDowngrade {
+		t.Errorf("events = %+v, want one downgrade event", events)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mycophonic/primordium/app/shutdown"
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/filesystem"
+)
+
+// Server defaults.
+const (
+	serverReadHeaderTimeout = 10 * time.Second
+	serverReadTimeout       = 30 * time.Second
+	serverWriteTimeout      = 60 * time.Second
+	serverIdleTimeout       = 120 * time.Second
+	serverMaxHeaderBytes    = 64 * 1024
+	serverShutdownTimeout   = 5 * time.Second
+)
+
+// ServerOptions configures NewServer. The zero value is usable, and zero fields apply the defaults.
+type ServerOptions struct {
+	// Addr is the TCP address to listen on. Defaults to "localhost:0". Ignored if UnixSocket is set.
+	Addr string
+	// UnixSocket, if set, is the path of a Unix socket to listen on instead of Addr. Ownership and stale sockets are
+	// handled as with ListenUnix.
+	UnixSocket string
+	// TLSConfig, if set, enables TLS. It is cloned, and the TLS 1.3 and post-quantum curve policy of the client side
+	// is enforced on the clone.
+	TLSConfig *tls.Config
+
+	// ReadHeaderTimeout defaults to 10s, ReadTimeout to 30s, WriteTimeout to 60s and IdleTimeout to 120s.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// MaxHeaderBytes defaults to 64KiB.
+	MaxHeaderBytes int
+	// ShutdownTimeout bounds the graceful shutdown on application exit. Defaults to 5s.
+	ShutdownTimeout time.Duration
+}
+
+// Server is an *http.Server with hardened defaults, shut down gracefully on application exit.
+type Server struct {
+	*http.Server
+
+	unixSocket      string
+	shutdownTimeout time.Duration
+
+	mu         sync.Mutex
+	closed     bool
+	deregister func()
+}
+
+// NewServer returns a Server for handler. Once it serves, it is registered with the shutdown package so that it is
+// shut down gracefully when the application exits, until Shutdown or Close is called.
+// A UnixSocket path exceeding the platform limit fails with fault.ErrInvalidArgument.
+func NewServer(handler http.Handler, opts *ServerOptions) (*Server, error) {
+	if opts == nil {
+		opts = &ServerOptions{}
+	}
+
+	if opts.UnixSocket != "" {
+		if err := filesystem.ValidateSocketPath(opts.UnixSocket); err != nil {
+			return nil, err //nolint:wrapcheck // fault error already
+		}
+	}
+
+	addr := opts.Addr
+	if addr == "" {
+		addr = "localhost:0"
+	}
+
+	server := &Server{
+		Server: &http.Server{
+			Addr:              addr,
+			Handler:           handler,
+			ReadHeaderTimeout: cmp.Or(opts.ReadHeaderTimeout, serverReadHeaderTimeout),
+			ReadTimeout:       cmp.Or(opts.ReadTimeout, serverReadTimeout),
+			WriteTimeout:      cmp.Or(opts.WriteTimeout, serverWriteTimeout),
+			IdleTimeout:       cmp.Or(opts.IdleTimeout, serverIdleTimeout),
+			MaxHeaderBytes:    cmp.Or(opts.MaxHeaderBytes, serverMaxHeaderBytes),
+			ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelDebug),
+		},
+		unixSocket:      opts.UnixSocket,
+		shutdownTimeout: cmp.Or(opts.ShutdownTimeout, serverShutdownTimeout),
+	}
+
+	if opts.TLSConfig != nil {
+		server.TLSConfig = opts.TLSConfig.Clone()
+		server.TLSConfig.MinVersion = tls.VersionTLS13
+		server.TLSConfig.CurvePreferences = defaultTLSConfig().CurvePreferences
+	}
+
+	return server, nil
+}
+
+// Listen opens the listener of the server, on its Unix socket if set (as ListenUnix does) and on Addr otherwise.
+func (s *Server) Listen() (net.Listener, error) {
+	if s.unixSocket != "" {
+		return listenUnix(s.unixSocket)
+	}
+
+	listener, err := (&net.ListenConfig{}).Listen(context.Background(), "tcp", s.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrNetworkError, err)
+	}
+
+	return listener, nil
+}
+
+// Serve serves on listener, with TLS if configured, until the server is shut down.
+// Unlike http.Server.Serve, a shutdown returns nil.
+func (s *Server) Serve(listener net.Listener) error {
+	s.register()
+
+	var err error
+
+	if s.TLSConfig != nil {
+		err = s.Server.ServeTLS(listener, "", "")
+	} else {
+		err = s.Server.Serve(listener)
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err //nolint:wrapcheck // pass through
+}
+
+// Shutdown deregisters the server from the shutdown package, and shuts it down gracefully, see http.Server.Shutdown.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.release()
+
+	return s.Server.Shutdown(ctx) //nolint:wrapcheck // pass through
+}
+
+// Close deregisters the server from the shutdown package, and closes it immediately, see http.Server.Close.
+func (s *Server) Close() error {
+	s.release()
+
+	return s.Server.Close() //nolint:wrapcheck // pass through
+}
+
+// register makes the application exit shut the server down, once.
+func (s *Server) register() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.deregister != nil {
+		return
+	}
+
+	s.deregister = shutdown.RegisterRemovable(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+		defer cancel()
+
+		if err := s.Server.Shutdown(ctx); err != nil {
+			slog.Warn("HTTP server did not shut down gracefully", slog.Any("error", err))
+		}
+	})
+}
+
+// release marks the server closed, and removes its shutdown handler.
+func (s *Server) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	if s.deregister != nil {
+		s.deregister()
+		s.deregister = nil
+	}
+}
+
+// ListenAndServe listens and serves until the server is shut down.
+func (s *Server) ListenAndServe() error {
+	listener, err := s.Listen()
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(listener)
+}
+
+// ServeTLS serves TLS on listener until the server is shut down, with the certificate and key loaded from certFile
+// and keyFile unless the TLS configuration provides them. Unlike http.Server.ServeTLS, a shutdown returns nil.
+func (s *Server) ServeTLS(listener net.Listener, certFile, keyFile string) error {
+	s.register()
+
+	if err := s.Server.ServeTLS(listener, certFile, keyFile); !errors.Is(err, http.ErrServerClosed) {
+		return err //nolint:wrapcheck // pass through
+	}
+
+	return nil
+}
+
+// ListenAndServeTLS listens and serves TLS until the server is shut down, see ServeTLS.
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	listener, err := s.Listen()
+	if err != nil {
+		return err
+	}
+
+	return s.ServeTLS(listener, certFile, keyFile)
+}
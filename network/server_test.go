@@ -0,0 +1,221 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/network"
+	"github.com/mycophonic/primordium/network/networktest"
+)
+
+func startServer(t *testing.T, opts *network.ServerOptions) (*network.Server, net.Listener) {
+	t.Helper()
+
+	server, err := network.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), opts)
+	if err != nil {
+		t.Fatalf("NewServer returned error: %v", err)
+	}
+
+	listener, err := server.Listen()
+	if err != nil {
+		t.Fatalf("Listen returned error: %v", err)
+	}
+
+	served := make(chan error, 1)
+
+	go func() {
+		served <- server.Serve(listener)
+	}()
+
+	t.Cleanup(func() {
+		if err := server.Shutdown(context.Background()); err != nil {
+			t.Errorf("Shutdown returned error: %v", err)
+		}
+
+		if err := <-served; err != nil {
+			t.Errorf("Serve returned error after shutdown: %v", err)
+		}
+	})
+
+	return server, listener
+}
+
+func getResponse(t *testing.T, client *http.Client, url string, header http.Header) (*http.Response, error) {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	return client.Do(req)
+}
+
+func TestNewServer_TLS(t *testing.T) {
+	t.Parallel()
+
+	ca, err := networktest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := ca.Issue("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, listener := startServer(t, &network.ServerOptions{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12},
+	})
+
+	client := &http.Client{Transport: newTransport(t, network.WithRootCAs(ca.Pool()))}
+
+	resp, err := getResponse(t, client, "https://"+listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.TLS.Version != tls.VersionTLS13 || resp.TLS.CurveID != tls.X25519MLKEM768 {
+		t.Errorf("negotiated %s with %s", tls.VersionName(resp.TLS.Version), resp.TLS.CurveID)
+	}
+
+	// Clients that cannot do TLS 1.3 are refused, whatever the provided configuration allowed.
+	legacy := newTransport(t, network.WithRootCAs(ca.Pool()))
+	legacy.TLSClientConfig.MinVersion = tls.VersionTLS12
+	legacy.TLSClientConfig.MaxVersion = tls.VersionTLS12
+
+	if _, err = getResponse(t, &http.Client{Transport: legacy}, "https://"+listener.Addr().String(), nil); err == nil {
+		t.Error("TLS 1.2 client was accepted")
+	}
+}
+
+func TestServer_ServeTLS(t *testing.T) {
+	t.Parallel()
+
+	ca, err := networktest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := ca.Issue("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := network.NewServer(http.NotFoundHandler(), &network.ServerOptions{
+		Addr:      "127.0.0.1:0",
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS13},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := server.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+
+	go func() {
+		served <- server.ServeTLS(listener, "", "")
+	}()
+
+	client := &http.Client{Transport: newTransport(t, network.WithRootCAs(ca.Pool()))}
+
+	resp, err := getResponse(t, client, "https://"+listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if err = server.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown returned error: %v", err)
+	}
+
+	if err = <-served; err != nil {
+		t.Errorf("ServeTLS returned error after shutdown: %v", err)
+	}
+}
+
+func TestNewServer_MaxHeaderBytes(t *testing.T) {
+	t.Parallel()
+
+	_, listener := startServer(t, &network.ServerOptions{Addr: "127.0.0.1:0", MaxHeaderBytes: 1024})
+
+	resp, err := getResponse(t, &http.Client{Transport: newTransport(t)}, "http://"+listener.Addr().String(),
+		http.Header{"X-Large": {strings.Repeat("a", 8192)}})
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("status = %d, want 431", resp.StatusCode)
+	}
+}
+
+func TestNewServer_UnixSocket(t *testing.T) {
+	t.Parallel()
+
+	socket := filepath.Join(t.TempDir(), "control.sock")
+
+	startServer(t, &network.ServerOptions{UnixSocket: socket})
+
+	transport := newTransport(t)
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+	}
+
+	resp, err := getResponse(t, &http.Client{Transport: transport}, "http://control/", nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d, want 204", resp.StatusCode)
+	}
+
+	_, err = network.NewServer(http.NotFoundHandler(), &network.ServerOptions{
+		UnixSocket: filepath.Join(t.TempDir(), strings.Repeat("s", 120)),
+	})
+	if !errors.Is(err, fault.ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument for a long socket path, got %v", err)
+	}
+}
@@ -0,0 +1,405 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mycophonic/primordium/digest"
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/filesystem"
+)
+
+const sftpTempPrefix = ".tmp-"
+
+// TransferOptions configures SFTP transfers. The zero value is usable.
+type TransferOptions struct {
+	// Algorithm used to digest transferred files. Defaults to the algorithm of Expected, or digest.SHA256. Setting
+	// both Algorithm and Expected with different algorithms fails with fault.ErrInvalidArgument.
+	Algorithm digest.Algorithm
+	// Expected is the digest a single file transfer must match. If zero, the content is not verified.
+	// Its algorithm must be cryptographically secure. It is ignored by tree transfers.
+	Expected digest.Digest
+}
+
+// SFTPClient transfers files and directory trees over an ssh connection.
+//
+// Files are written atomically on both sides: content goes to a temporary file next to the destination, is digested
+// while in flight and verified, then renamed into place. Permissions are preserved, filtered through the umask
+// (see filesystem.GetUmask). Symbolic links and special files are skipped.
+type SFTPClient struct {
+	client *sftp.Client
+}
+
+// NewSFTPClient starts an sftp session over conn, typically obtained from DialSSH.
+// Closing the SFTPClient does not close conn.
+func NewSFTPClient(conn *ssh.Client) (*SFTPClient, error) {
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return nil, fmt.Errorf("%w: starting sftp session: %w", fault.ErrNetworkError, err)
+	}
+
+	return &SFTPClient{client: client}, nil
+}
+
+// Close ends the sftp session.
+func (c *SFTPClient) Close() error {
+	return c.client.Close() //nolint:wrapcheck // Passthrough
+}
+
+// Upload copies the local file to remote, and returns its digest.
+// A mismatch with opts.Expected fails with fault.ErrHashMismatch, leaving remote untouched.
+func (c *SFTPClient) Upload(ctx context.Context, local, remote string, opts *TransferOptions) (digest.Digest, error) {
+	file, err := os.Open(local) //nolint:gosec // Caller provided path
+	if err != nil {
+		return digest.Digest{}, fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	info, err := file.Stat()
+	if err != nil {
+		return digest.Digest{}, fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+	}
+
+	return c.upload(ctx, file, info.Mode().Perm(), remote, opts)
+}
+
+// Download copies the remote file to local, and returns its digest.
+// A mismatch with opts.Expected fails with fault.ErrHashMismatch, leaving local untouched.
+func (c *SFTPClient) Download(ctx context.Context, remote, local string, opts *TransferOptions) (digest.Digest, error) {
+	file, err := c.client.Open(remote)
+	if err != nil {
+		return digest.Digest{}, remoteError(remote, err, fault.ErrReadFailure)
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	info, err := file.Stat()
+	if err != nil {
+		return digest.Digest{}, remoteError(remote, err, fault.ErrReadFailure)
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(local), sftpTempPrefix+filepath.Base(local))
+	if err != nil {
+		return digest.Digest{}, errors.Join(filesystem.ErrAtomicWriteFail, err)
+	}
+
+	dgst, err := transfer(ctx, tmpFile, file, opts)
+	if err == nil {
+		err = os.Chmod(tmpFile.Name(), (^os.FileMode(filesystem.GetUmask()))&info.Mode().Perm())
+	}
+
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+
+	if closeErr := tmpFile.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), local)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+
+		if errors.Is(err, fault.ErrHashMismatch) || errors.Is(err, fault.ErrCancelled) {
+			return digest.Digest{}, err
+		}
+
+		return digest.Digest{}, errors.Join(filesystem.ErrAtomicWriteFail, err)
+	}
+
+	return dgst, nil
+}
+
+// UploadTree copies the local directory tree to remoteDir, creating it if need be, and returns the manifest of the
+// transferred files, with paths relative to localDir.
+func (c *SFTPClient) UploadTree(
+	ctx context.Context,
+	localDir, remoteDir string,
+	opts *TransferOptions,
+) (*digest.Manifest, error) {
+	fileOpts := &TransferOptions{}
+	if opts != nil {
+		fileOpts.Algorithm = opts.Algorithm
+	}
+
+	manifest := &digest.Manifest{}
+
+	err := filepath.WalkDir(localDir, func(localPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+		}
+
+		if err = ctx.Err(); err != nil {
+			return fmt.Errorf("%w: %w", fault.ErrCancelled, err)
+		}
+
+		rel, err := filepath.Rel(localDir, localPath)
+		if err != nil {
+			return fmt.Errorf("%w: %w", fault.ErrInvalidArgument, err)
+		}
+
+		rel = filepath.ToSlash(rel)
+		remotePath := path.Join(remoteDir, rel)
+
+		switch {
+		case entry.IsDir():
+			info, err := entry.Info()
+			if err != nil {
+				return fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+			}
+
+			if err = c.client.MkdirAll(remotePath); err != nil {
+				return remoteError(remotePath, err, fault.ErrWriteFailure)
+			}
+
+			if err = c.client.Chmod(remotePath, (^os.FileMode(filesystem.GetUmask()))&info.Mode().Perm()); err != nil {
+				return remoteError(remotePath, err, fault.ErrWriteFailure)
+			}
+		case entry.Type().IsRegular():
+			dgst, err := c.Upload(ctx, localPath, remotePath, fileOpts)
+			if err != nil {
+				return err
+			}
+
+			manifest.Entries = append(manifest.Entries, digest.ManifestEntry{Path: rel, Digest: dgst})
+		default:
+			slog.DebugContext(ctx, "skipping non regular file", slog.String("path", localPath))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err //nolint:wrapcheck // Wrapped by the walk function
+	}
+
+	return manifest, nil
+}
+
+// DownloadTree copies the remote directory tree to localDir, creating it if need be, and returns the manifest of the
+// transferred files, with paths relative to remoteDir.
+func (c *SFTPClient) DownloadTree(
+	ctx context.Context,
+	remoteDir, localDir string,
+	opts *TransferOptions,
+) (*digest.Manifest, error) {
+	fileOpts := &TransferOptions{}
+	if opts != nil {
+		fileOpts.Algorithm = opts.Algorithm
+	}
+
+	manifest := &digest.Manifest{}
+	remoteDir = path.Clean(remoteDir)
+	walker := c.client.Walk(remoteDir)
+
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, remoteError(walker.Path(), err, fault.ErrReadFailure)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("%w: %w", fault.ErrCancelled, err)
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), remoteDir), "/")
+		if rel == "" {
+			rel = "."
+		}
+
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			return nil, fmt.Errorf("%w: remote path %q escapes %q", fault.ErrInvalidArgument, walker.Path(), remoteDir)
+		}
+
+		localPath := filepath.Join(localDir, filepath.FromSlash(rel))
+		info := walker.Stat()
+
+		switch {
+		case info.IsDir():
+			perm := (^os.FileMode(filesystem.GetUmask())) & info.Mode().Perm()
+			if err := os.MkdirAll(localPath, perm); err != nil {
+				return nil, fmt.Errorf("%w: %w", fault.ErrWriteFailure, err)
+			}
+
+			if err := os.Chmod(localPath, perm); err != nil {
+				return nil, fmt.Errorf("%w: %w", fault.ErrWriteFailure, err)
+			}
+		case info.Mode().IsRegular():
+			dgst, err := c.Download(ctx, walker.Path(), localPath, fileOpts)
+			if err != nil {
+				return nil, err
+			}
+
+			manifest.Entries = append(manifest.Entries, digest.ManifestEntry{Path: rel, Digest: dgst})
+		default:
+			slog.DebugContext(ctx, "skipping non regular file", slog.String("path", walker.Path()))
+		}
+	}
+
+	return manifest, nil
+}
+
+// upload writes content to a temporary file next to remote, then renames it into place.
+func (c *SFTPClient) upload(
+	ctx context.Context,
+	content io.Reader,
+	perm os.FileMode,
+	remote string,
+	opts *TransferOptions,
+) (digest.Digest, error) {
+	dir, base := path.Split(remote)
+	tmpName := path.Join(dir, sftpTempPrefix+base+"-"+rand.Text())
+
+	tmpFile, err := c.client.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return digest.Digest{}, remoteError(tmpName, err, fault.ErrWriteFailure)
+	}
+
+	dgst, err := transfer(ctx, tmpFile, content, opts)
+	if err == nil {
+		err = c.client.Chmod(tmpName, (^os.FileMode(filesystem.GetUmask()))&perm)
+	}
+
+	if closeErr := tmpFile.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = c.rename(tmpName, remote)
+	}
+
+	if err != nil {
+		_ = c.client.Remove(tmpName)
+
+		if errors.Is(err, fault.ErrHashMismatch) || errors.Is(err, fault.ErrCancelled) {
+			return digest.Digest{}, err
+		}
+
+		return digest.Digest{}, remoteError(remote, err, fault.ErrWriteFailure)
+	}
+
+	return dgst, nil
+}
+
+// rename replaces newname atomically with the posix-rename extension, falling back to removing then renaming if the
+// server does not support it.
+func (c *SFTPClient) rename(oldname, newname string) error {
+	err := c.client.PosixRename(oldname, newname)
+
+	var status *sftp.StatusError
+	if !errors.As(err, &status) || status.FxCode() != sftp.ErrSSHFxOpUnsupported {
+		return err //nolint:wrapcheck // Wrapped by the caller
+	}
+
+	if err = c.client.Remove(newname); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err //nolint:wrapcheck // Wrapped by the caller
+	}
+
+	return c.client.Rename(oldname, newname) //nolint:wrapcheck // Wrapped by the caller
+}
+
+// transfer copies src into dst, digesting the content, and verifies it against opts.Expected.
+func transfer(ctx context.Context, dst io.Writer, src io.Reader, opts *TransferOptions) (digest.Digest, error) {
+	var expected digest.Digest
+
+	alg := digest.SHA256
+
+	if opts != nil {
+		expected = opts.Expected
+
+		switch {
+		case opts.Algorithm != "":
+			alg = opts.Algorithm
+		case !expected.IsZero():
+			alg = expected.Algorithm()
+		}
+	}
+
+	if !alg.Available() {
+		return digest.Digest{}, fmt.Errorf("%w: unknown algorithm %s", fault.ErrInvalidArgument, alg)
+	}
+
+	if !expected.IsZero() && !expected.Algorithm().Secure() {
+		return digest.Digest{}, fmt.Errorf("%w: algorithm %s cannot be used to verify content",
+			fault.ErrInvalidArgument, expected.Algorithm())
+	}
+
+	if !expected.IsZero() && alg != expected.Algorithm() {
+		return digest.Digest{}, fmt.Errorf("%w: algorithm %s conflicts with expected digest %s",
+			fault.ErrInvalidArgument, alg, expected)
+	}
+
+	digester := digest.NewDigester(alg, dst)
+
+	if _, err := io.Copy(digester, &contextReader{ctx: ctx, reader: src}); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return digest.Digest{}, fmt.Errorf("%w: %w", fault.ErrCancelled, errors.Join(ctxErr, err))
+		}
+
+		return digest.Digest{}, fmt.Errorf("%w: %w", fault.ErrNetworkError, err)
+	}
+
+	actual := digester.Digest()
+	if !expected.IsZero() && !expected.Equal(actual) {
+		return digest.Digest{}, &digest.MismatchError{Expected: expected, Actual: actual}
+	}
+
+	return actual, nil
+}
+
+// remoteError wraps an sftp error, mapping missing files to fault.ErrNotFound.
+func remoteError(name string, err, fallback error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s: %w", fault.ErrNotFound, name, err)
+	}
+
+	return fmt.Errorf("%w: %s: %w", fallback, name, err)
+}
+
+// contextReader stops reading once ctx is done.
+type contextReader struct {
+	ctx    context.Context //nolint:containedctx // Bound to a single copy
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err //nolint:wrapcheck // Mapped by the caller
+	}
+
+	return r.reader.Read(p) //nolint:wrapcheck // Passthrough
+}
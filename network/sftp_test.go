@@ -0,0 +1,248 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mycophonic/primordium/digest"
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/filesystem"
+	"github.com/mycophonic/primordium/network"
+	"github.com/mycophonic/primordium/network/networktest"
+)
+
+func newSFTPClient(t *testing.T) *network.SFTPClient {
+	t.Helper()
+
+	fixture := networktest.NewSSHServer(t)
+
+	conn, err := network.DialSSH(context.Background(), "tester@"+fixture.Addr, fixture.Options())
+	if err != nil {
+		t.Fatalf("DialSSH returned error: %v", err)
+	}
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	client, err := network.NewSFTPClient(conn)
+	if err != nil {
+		t.Fatalf("NewSFTPClient returned error: %v", err)
+	}
+
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client
+}
+
+// assertNoTemp fails if dir holds leftover temporary files.
+func assertNoTemp(t *testing.T, dir string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			t.Errorf("temporary file left behind: %s", entry.Name())
+		}
+	}
+}
+
+func TestSFTPClient_UploadDownload(t *testing.T) {
+	t.Parallel()
+
+	client := newSFTPClient(t)
+	ctx := context.Background()
+
+	localDir, remoteDir := t.TempDir(), t.TempDir()
+	content := []byte("rendered audio")
+	expected := digest.FromBytes(digest.SHA256, content)
+
+	source := filepath.Join(localDir, "mix.flac")
+	if err := os.WriteFile(source, content, 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	remote := filepath.Join(remoteDir, "mix.flac")
+
+	uploaded, err := client.Upload(ctx, source, remote, &network.TransferOptions{Expected: expected})
+	if err != nil {
+		t.Fatalf("Upload returned error: %v", err)
+	}
+
+	if !uploaded.Equal(expected) {
+		t.Errorf("Upload digest = %s, want %s", uploaded, expected)
+	}
+
+	info, err := os.Stat(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := os.FileMode(0o640) &^ os.FileMode(filesystem.GetUmask()); info.Mode().Perm() != want {
+		t.Errorf("remote permissions = %o, want %o", info.Mode().Perm(), want)
+	}
+
+	assertNoTemp(t, remoteDir)
+
+	back := filepath.Join(localDir, "back.flac")
+
+	downloaded, err := client.Download(ctx, remote, back, nil)
+	if err != nil {
+		t.Fatalf("Download returned error: %v", err)
+	}
+
+	if !downloaded.Equal(expected) {
+		t.Errorf("Download digest = %s, want %s", downloaded, expected)
+	}
+
+	if got, _ := os.ReadFile(back); string(got) != string(content) {
+		t.Errorf("downloaded content = %q", got)
+	}
+
+	assertNoTemp(t, localDir)
+}
+
+func TestSFTPClient_Mismatch(t *testing.T) {
+	t.Parallel()
+
+	client := newSFTPClient(t)
+	ctx := context.Background()
+
+	localDir, remoteDir := t.TempDir(), t.TempDir()
+	wrong := &network.TransferOptions{Expected: digest.FromBytes(digest.SHA256, []byte("other"))}
+
+	source := filepath.Join(localDir, "mix.flac")
+	if err := os.WriteFile(source, []byte("content"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	remote := filepath.Join(remoteDir, "mix.flac")
+
+	if _, err := client.Upload(ctx, source, remote, wrong); !errors.Is(err, fault.ErrHashMismatch) {
+		t.Errorf("Upload: expected ErrHashMismatch, got %v", err)
+	}
+
+	if _, err := os.Stat(remote); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("remote file should not exist after mismatch, got %v", err)
+	}
+
+	assertNoTemp(t, remoteDir)
+
+	_, err := client.Download(ctx, source, filepath.Join(remoteDir, "copy"), wrong)
+	if !errors.Is(err, fault.ErrHashMismatch) {
+		t.Errorf("Download: expected ErrHashMismatch, got %v", err)
+	}
+
+	assertNoTemp(t, remoteDir)
+
+	conflicting := &network.TransferOptions{
+		Algorithm: digest.SHA512,
+		Expected:  digest.FromBytes(digest.SHA256, []byte("content")),
+	}
+
+	if _, err = client.Upload(ctx, source, remote, conflicting); !errors.Is(err, fault.ErrInvalidArgument) {
+		t.Errorf("Upload: expected ErrInvalidArgument for conflicting algorithms, got %v", err)
+	}
+
+	insecure := &network.TransferOptions{Expected: digest.FromBytes(digest.XXH64, []byte("content"))}
+
+	if _, err = client.Upload(ctx, source, remote, insecure); !errors.Is(err, fault.ErrInvalidArgument) {
+		t.Errorf("Upload: expected ErrInvalidArgument for xxh64, got %v", err)
+	}
+
+	_, err = client.Download(ctx, source, filepath.Join(remoteDir, "copy"), insecure)
+	if !errors.Is(err, fault.ErrInvalidArgument) {
+		t.Errorf("Download: expected ErrInvalidArgument for xxh64, got %v", err)
+	}
+
+	assertNoTemp(t, remoteDir)
+
+	_, err = client.Download(ctx, filepath.Join(remoteDir, "missing"), filepath.Join(localDir, "missing"), nil)
+	if !errors.Is(err, fault.ErrNotFound) {
+		t.Errorf("Download: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestSFTPClient_Trees(t *testing.T) {
+	t.Parallel()
+
+	client := newSFTPClient(t)
+	ctx := context.Background()
+
+	source := t.TempDir()
+	files := map[string]string{
+		"a.wav":           "first",
+		"stems/drums.wav": "second",
+		"stems/bass.wav":  "third",
+	}
+
+	for name, content := range files {
+		full := filepath.Join(source, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(full), 0o750); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(full, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	remote := filepath.Join(t.TempDir(), "upload")
+
+	uploaded, err := client.UploadTree(ctx, source, remote, nil)
+	if err != nil {
+		t.Fatalf("UploadTree returned error: %v", err)
+	}
+
+	if len(uploaded.Entries) != len(files) {
+		t.Fatalf("UploadTree manifest has %d entries, want %d", len(uploaded.Entries), len(files))
+	}
+
+	for name, content := range files {
+		entry, ok := uploaded.Get(name)
+		if !ok || !entry.Equal(digest.FromBytes(digest.SHA256, []byte(content))) {
+			t.Errorf("manifest entry for %s = %s, %v", name, entry, ok)
+		}
+	}
+
+	if report, err := digest.VerifyTree(remote, uploaded); err != nil || report.Err() != nil {
+		t.Errorf("uploaded tree does not verify: %v, %v", err, report)
+	}
+
+	local := filepath.Join(t.TempDir(), "download")
+
+	downloaded, err := client.DownloadTree(ctx, remote, local, &network.TransferOptions{Algorithm: digest.SHA512})
+	if err != nil {
+		t.Fatalf("DownloadTree returned error: %v", err)
+	}
+
+	if len(downloaded.Entries) != len(files) {
+		t.Fatalf("DownloadTree manifest has %d entries, want %d", len(downloaded.Entries), len(files))
+	}
+
+	if report, err := digest.VerifyTree(local, downloaded); err != nil || report.Err() != nil {
+		t.Errorf("downloaded tree does not verify: %v, %v", err, report)
+	}
+}
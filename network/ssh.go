@@ -58,6 +58,14 @@ var (
 	// considering the connection dead.
 	DefaultSSHKeepaliveTimeout = 15 * time.Second
 
+	// DefaultKnownHostsFiles defines the known hosts files host keys are verified against.
+	DefaultKnownHostsFiles = []string{
+		"~/.ssh/known_hosts",
+	}
+
+	// DefaultSSHConfigFile is the OpenSSH client configuration consulted by DialSSH.
+	DefaultSSHConfigFile = "~/.ssh/config"
+
 	// DefaultIdentityFiles defines the well-known private key we might consider.
 	DefaultIdentityFiles = []string{
 		// "~/.ssh/id_rsa",
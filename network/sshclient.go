@@ -0,0 +1,518 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/filesystem"
+)
+
+const (
+	defaultSSHPort      = 22
+	maxPort             = 65535
+	sshKeepaliveRequest = "keepalive@openssh.com"
+	sshAuthSockEnv      = "SSH_AUTH_SOCK"
+)
+
+// SSHOptions configures DialSSH. The zero value is usable.
+type SSHOptions struct {
+	// User to log in as, when the target does not specify one. Defaults to the current user.
+	User string
+	// Port to connect to, when the target does not specify one. Defaults to 22.
+	Port int
+	// IdentityFiles are the private keys to try. Defaults to DefaultIdentityFiles. Missing files are skipped.
+	IdentityFiles []string
+	// KnownHostsFiles are the files host keys are verified against. Defaults to DefaultKnownHostsFiles.
+	KnownHostsFiles []string
+	// Passphrase, if set, is called to decrypt passphrase protected identity files.
+	Passphrase func(identityFile string) ([]byte, error)
+	// DisableAgent prevents using the agent listening on SSH_AUTH_SOCK.
+	DisableAgent bool
+	// ProxyJump lists the jump hosts ("[user@]host[:port]") to go through, in order, overriding the ssh_config.
+	// Use an empty, non-nil slice to connect directly.
+	ProxyJump []string
+	// Proxy, if set, routes the connection to the first host (the first jump host, or the destination).
+	Proxy *ProxyConfig
+	// SSHConfig is consulted to resolve targets. Defaults to loading DefaultSSHConfigFile. Use an empty SSHConfig to
+	// ignore the user configuration.
+	SSHConfig *SSHConfig
+}
+
+// DialSSH connects to target ("[user@]host[:port]") with DefaultSSHConfig and DefaultSSHHostKeyAlgorithms.
+//
+// The target is resolved through the ssh_config (see SSHConfig.Resolve). Values set in the target or in opts take
+// precedence over the configuration, which takes precedence over the defaults.
+//
+// If a ProxyJump is configured, each jump host is connected to in turn, through the previous one, and is
+// authenticated and host key verified exactly like the destination. Jump hosts are resolved through the ssh_config too,
+// but their own ProxyJump is ignored. Closing the returned client closes the jump connections. The first connection
+// goes through the proxy opts.Proxy resolves for its host, if any.
+// Authentication uses the SSH agent (SSH_AUTH_SOCK) and the identity files. Host keys are verified strictly against
+// the known hosts files: unknown hosts and mismatching keys fail with fault.ErrAuthenticationFailure.
+// Connecting is bounded by DefaultSSHConnectionTimeout. Once connected, a keepalive is sent every
+// DefaultSSHKeepaliveTimeout, and the connection is closed if the server does not answer within that delay.
+func DialSSH(ctx context.Context, target string, opts *SSHOptions) (*ssh.Client, error) {
+	if opts == nil {
+		opts = &SSHOptions{}
+	}
+
+	host, err := opts.resolve(target)
+	if err != nil {
+		return nil, err
+	}
+
+	jumps := host.ProxyJump
+	if opts.ProxyJump != nil {
+		jumps = opts.ProxyJump
+	}
+
+	// Options specific to the destination do not apply to jump hosts.
+	hopOpts := *opts
+	hopOpts.User, hopOpts.Port = "", 0
+
+	dialer := &net.Dialer{Timeout: DefaultSSHConnectionTimeout}
+	dial := dialer.DialContext
+
+	if opts.Proxy != nil {
+		if err = opts.Proxy.validate(); err != nil {
+			return nil, err
+		}
+
+		dial = opts.Proxy.dialer(dial)
+	}
+
+	hops := make([]*ssh.Client, 0, len(jumps))
+
+	closeHops := func() {
+		for _, hop := range slices.Backward(hops) {
+			_ = hop.Close()
+		}
+	}
+
+	for _, jump := range jumps {
+		jumpHost, err := hopOpts.resolve(jump)
+		if err != nil {
+			closeHops()
+
+			return nil, err
+		}
+
+		hop, err := opts.connect(ctx, dial, jumpHost)
+		if err != nil {
+			closeHops()
+
+			return nil, err
+		}
+
+		hops = append(hops, hop)
+		dial = hop.DialContext
+	}
+
+	client, err := opts.connect(ctx, dial, host)
+	if err != nil {
+		closeHops()
+
+		return nil, err
+	}
+
+	if len(hops) > 0 {
+		go func() {
+			_ = client.Wait()
+
+			closeHops()
+		}()
+	}
+
+	return client, nil
+}
+
+// connect dials host with dial, performs the handshake and starts the keepalive.
+func (opts *SSHOptions) connect(
+	ctx context.Context,
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+	host *SSHHostConfig,
+) (*ssh.Client, error) {
+	address := net.JoinHostPort(host.HostName, strconv.Itoa(host.Port))
+
+	config, closeAuth, err := opts.clientConfig(host)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAuth()
+
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: dialing %s: %w", fault.ErrNetworkError, address, err)
+	}
+
+	client, err := sshHandshake(ctx, conn, address, config)
+	if err != nil {
+		return nil, err
+	}
+
+	go sshKeepalive(client, DefaultSSHKeepaliveTimeout)
+
+	return client, nil
+}
+
+// clientConfig assembles the ssh.ClientConfig. The returned function releases the agent connection, once the
+// handshake is over.
+func (opts *SSHOptions) clientConfig(host *SSHHostConfig) (*ssh.ClientConfig, func(), error) {
+	hostKeyCallback, err := knownHostsCallback(host.KnownHostsFiles)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signers, closeAuth := opts.signers(host.IdentityFiles)
+
+	return &ssh.ClientConfig{
+		Config:            host.Config,
+		User:              host.User,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeysCallback(signers)},
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: host.HostKeyAlgorithms,
+		Timeout:           DefaultSSHConnectionTimeout,
+	}, closeAuth, nil
+}
+
+// signers returns the agent keys followed by the identity files keys.
+func (opts *SSHOptions) signers(identityFiles []string) (func() ([]ssh.Signer, error), func()) {
+	var (
+		agentConn net.Conn
+		keyring   agent.ExtendedAgent
+	)
+
+	if socket := os.Getenv(sshAuthSockEnv); socket != "" && !opts.DisableAgent {
+		conn, err := net.Dial("unix", socket) //nolint:noctx // Local agent socket
+		if err != nil {
+			slog.Debug("ssh agent unavailable", slog.String("socket", socket), slog.Any("error", err))
+		} else {
+			agentConn = conn
+			keyring = agent.NewClient(conn)
+		}
+	}
+
+	callback := func() ([]ssh.Signer, error) {
+		var signers []ssh.Signer
+
+		if keyring != nil {
+			agentSigners, err := keyring.Signers()
+			if err != nil {
+				slog.Debug("ssh agent failed to list keys", slog.Any("error", err))
+			}
+
+			signers = append(signers, agentSigners...)
+		}
+
+		for _, identityFile := range identityFiles {
+			signer, err := loadIdentity(expandHome(identityFile), opts.Passphrase)
+			if err != nil {
+				slog.Debug("skipping ssh identity", slog.String("file", identityFile), slog.Any("error", err))
+
+				continue
+			}
+
+			signers = append(signers, signer)
+		}
+
+		return signers, nil
+	}
+
+	return callback, func() {
+		if agentConn != nil {
+			_ = agentConn.Close()
+		}
+	}
+}
+
+func loadIdentity(path string, passphrase func(string) ([]byte, error)) (ssh.Signer, error) {
+	pem, err := os.ReadFile(path) //nolint:gosec // Identity files are user provided
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(pem)
+
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) && passphrase != nil {
+		secret, passErr := passphrase(path)
+		if passErr != nil {
+			return nil, fmt.Errorf("%w: %w", fault.ErrAuthenticationFailure, passErr)
+		}
+
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, secret)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrInvalidArgument, err)
+	}
+
+	return signer, nil
+}
+
+func knownHostsCallback(files []string) (ssh.HostKeyCallback, error) {
+	expanded := make([]string, 0, len(files))
+	for _, file := range files {
+		expanded = append(expanded, expandHome(file))
+	}
+
+	callback, err := knownhosts.New(expanded...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: loading known hosts: %w", fault.ErrAuthenticationFailure, err)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err := callback(hostname, remote, key); err != nil {
+			var keyErr *knownhosts.KeyError
+			if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+				return fmt.Errorf("%w: host %s is not in known hosts: %w", fault.ErrAuthenticationFailure, hostname, err)
+			}
+
+			return fmt.Errorf("%w: host key verification failed for %s: %w", fault.ErrAuthenticationFailure, hostname, err)
+		}
+
+		return nil
+	}, nil
+}
+
+// sshHandshake performs the ssh handshake over conn, honoring both ctx and DefaultSSHConnectionTimeout.
+// Deadlines are not relied upon, as connections tunneled through a jump host do not support them.
+func sshHandshake(ctx context.Context, conn net.Conn, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	handshakeCtx, cancel := context.WithTimeout(ctx, DefaultSSHConnectionTimeout)
+	defer cancel()
+
+	stop := context.AfterFunc(handshakeCtx, func() {
+		_ = conn.Close()
+	})
+
+	// Authentication starts once the host key is accepted: failures past that point that do not come from the
+	// connection are authentication failures.
+	var authenticating atomic.Bool
+
+	tracked := *config
+	tracked.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err := config.HostKeyCallback(hostname, remote, key); err != nil {
+			return err
+		}
+
+		authenticating.Store(true)
+
+		return nil
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, &tracked)
+
+	stopped := stop()
+
+	if err != nil {
+		_ = conn.Close()
+
+		switch {
+		case !stopped && ctx.Err() != nil:
+			return nil, fmt.Errorf("%w: %w", fault.ErrCancelled, errors.Join(ctx.Err(), err))
+		case !stopped:
+			return nil, fmt.Errorf("%w: ssh handshake with %s: %w", fault.ErrNetworkError, address,
+				errors.Join(fault.ErrTimeout, err))
+		case errors.Is(err, fault.ErrAuthenticationFailure):
+			return nil, err //nolint:wrapcheck // Already wrapped by our host key callback
+		case authenticating.Load() && !connectionError(err):
+			return nil, fmt.Errorf("%w: %w", fault.ErrAuthenticationFailure, err)
+		default:
+			return nil, fmt.Errorf("%w: ssh handshake with %s: %w", fault.ErrNetworkError, address, err)
+		}
+	}
+
+	if !stopped {
+		return nil, errors.Join(fmt.Errorf("%w: %w", fault.ErrCancelled, handshakeCtx.Err()), sshConn.Close())
+	}
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// connectionError tells whether err comes from the underlying connection.
+func connectionError(err error) bool {
+	var netErr net.Error
+
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+// sshKeepalive sends a keepalive request every interval, and closes the client if one goes unanswered for interval.
+// It returns when the client is closed.
+func sshKeepalive(client *ssh.Client, interval time.Duration) {
+	done := make(chan struct{})
+
+	go func() {
+		_ = client.Wait()
+
+		close(done)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		replied := make(chan error, 1)
+
+		go func() {
+			_, _, err := client.SendRequest(sshKeepaliveRequest, true, nil)
+			replied <- err
+		}()
+
+		select {
+		case <-done:
+			return
+		case err := <-replied:
+			if err == nil {
+				continue
+			}
+
+			slog.Debug("ssh keepalive failed, closing connection",
+				slog.String("remote", client.RemoteAddr().String()), slog.Any("error", err))
+		case <-time.After(interval):
+			slog.Debug("ssh keepalive timed out, closing connection",
+				slog.String("remote", client.RemoteAddr().String()))
+		}
+
+		_ = client.Close()
+
+		return
+	}
+}
+
+// resolve parses target ("[user@]host[:port]") and resolves it through the ssh_config, applying options and
+// defaults.
+func (opts *SSHOptions) resolve(target string) (*SSHHostConfig, error) {
+	username, host, port, err := parseSSHTarget(target)
+	if err != nil {
+		return nil, err
+	}
+
+	if username == "" {
+		username = opts.User
+	}
+
+	sshConfig := opts.SSHConfig
+	if sshConfig == nil {
+		if sshConfig, err = LoadSSHConfig(DefaultSSHConfigFile); err != nil {
+			return nil, err
+		}
+	}
+
+	resolved, err := sshConfig.Resolve(host, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if resolved.User == "" {
+		if resolved.User = localUserName(); resolved.User == "" {
+			return nil, fmt.Errorf("%w: cannot determine user for ssh target %q", fault.ErrInvalidArgument, target)
+		}
+	}
+
+	switch {
+	case port != 0:
+		resolved.Port = port
+	case opts.Port != 0:
+		resolved.Port = opts.Port
+	case resolved.Port == 0:
+		resolved.Port = defaultSSHPort
+	}
+
+	resolved.IdentityFiles = firstNonNil(opts.IdentityFiles, resolved.IdentityFiles, DefaultIdentityFiles)
+	resolved.KnownHostsFiles = firstNonNil(opts.KnownHostsFiles, resolved.KnownHostsFiles, DefaultKnownHostsFiles)
+
+	return resolved, nil
+}
+
+// parseSSHTarget splits "[user@]host[:port]". Missing parts are returned empty.
+func parseSSHTarget(target string) (username, host string, port int, err error) {
+	// As OpenSSH does, split on the last "@": user names may contain one.
+	host = target
+	if at := strings.LastIndex(target, "@"); at >= 0 {
+		username, host = target[:at], target[at+1:]
+	}
+
+	if splitHost, splitPort, splitErr := net.SplitHostPort(host); splitErr == nil {
+		var valid bool
+		if port, valid = parsePort(splitPort); !valid {
+			return "", "", 0, fmt.Errorf("%w: invalid port in ssh target %q", fault.ErrInvalidArgument, target)
+		}
+
+		host = splitHost
+	}
+
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" {
+		return "", "", 0, fmt.Errorf("%w: empty host in ssh target %q", fault.ErrInvalidArgument, target)
+	}
+
+	return username, host, port, nil
+}
+
+func parsePort(value string) (int, bool) {
+	port, err := strconv.Atoi(value)
+
+	return port, err == nil && port > 0 && port <= maxPort
+}
+
+func firstNonNil(lists ...[]string) []string {
+	for _, list := range lists {
+		if list != nil {
+			return list
+		}
+	}
+
+	return nil
+}
+
+// expandHome replaces a leading ~ with the home directory of the current user.
+func expandHome(path string) string {
+	if path == "~" {
+		return filesystem.HomeDir()
+	}
+
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		return filepath.Join(filesystem.HomeDir(), rest)
+	}
+
+	return path
+}
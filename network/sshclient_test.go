@@ -0,0 +1,130 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/network"
+	"github.com/mycophonic/primordium/network/networktest"
+)
+
+func TestDialSSH(t *testing.T) {
+	t.Parallel()
+
+	fixture := networktest.NewSSHServer(t)
+
+	client, err := network.DialSSH(context.Background(), "tester@"+fixture.Addr, fixture.Options())
+	if err != nil {
+		t.Fatalf("DialSSH returned error: %v", err)
+	}
+
+	defer client.Close()
+
+	if client.User() != "tester" {
+		t.Errorf("User() = %q, want %q", client.User(), "tester")
+	}
+
+	if _, _, err = client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Errorf("request over established connection failed: %v", err)
+	}
+
+	// As with OpenSSH, the host follows the last "@".
+	scoped, err := network.DialSSH(context.Background(), "tester@corp.example@"+fixture.Addr, fixture.Options())
+	if err != nil {
+		t.Fatalf("DialSSH with a user name containing @ returned error: %v", err)
+	}
+
+	defer scoped.Close()
+
+	if scoped.User() != "tester@corp.example" {
+		t.Errorf("User() = %q, want %q", scoped.User(), "tester@corp.example")
+	}
+}
+
+func TestDialSSH_UnknownHost(t *testing.T) {
+	t.Parallel()
+
+	fixture := networktest.NewSSHServer(t)
+	opts := fixture.Options()
+
+	empty := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.KnownHostsFiles = []string{empty}
+
+	_, err := network.DialSSH(context.Background(), "tester@"+fixture.Addr, opts)
+	if !errors.Is(err, fault.ErrAuthenticationFailure) {
+		t.Errorf("expected ErrAuthenticationFailure, got: %v", err)
+	}
+}
+
+func TestDialSSH_UnauthorizedKey(t *testing.T) {
+	t.Parallel()
+
+	fixture := networktest.NewSSHServer(t)
+	other := networktest.NewSSHServer(t)
+	opts := fixture.Options()
+	opts.IdentityFiles = []string{other.ClientKeyFile}
+
+	_, err := network.DialSSH(context.Background(), "tester@"+fixture.Addr, opts)
+	if !errors.Is(err, fault.ErrAuthenticationFailure) {
+		t.Errorf("expected ErrAuthenticationFailure, got: %v", err)
+	}
+}
+
+//nolint:paralleltest // Modifies DefaultSSHKeepaliveTimeout
+func TestDialSSH_KeepaliveClosesDeadConnection(t *testing.T) {
+	previous := network.DefaultSSHKeepaliveTimeout
+	network.DefaultSSHKeepaliveTimeout = 50 * time.Millisecond
+
+	defer func() {
+		network.DefaultSSHKeepaliveTimeout = previous
+	}()
+
+	fixture := networktest.NewUnstartedSSHServer(t)
+	fixture.Unresponsive = true
+	fixture.Start()
+
+	client, err := network.DialSSH(context.Background(), "tester@"+fixture.Addr, fixture.Options())
+	if err != nil {
+		t.Fatalf("DialSSH returned error: %v", err)
+	}
+
+	closed := make(chan struct{})
+
+	go func() {
+		_ = client.Wait()
+
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		client.Close()
+		t.Fatal("dead connection was not closed by keepalive")
+	}
+}
@@ -0,0 +1,581 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/filesystem"
+)
+
+const (
+	sshConfigMaxIncludeDepth = 16
+	sshConfigNone            = "none"
+)
+
+// SSHConfig is a parsed OpenSSH client configuration (ssh_config(5)).
+//
+// Supported keywords are Host, Match (host, originalhost, user, localuser and all criteria), Include, HostName, Port,
+// User, IdentityFile, ProxyJump, UserKnownHostsFile, KexAlgorithms, Ciphers, MACs and HostKeyAlgorithms. Other keywords
+// are ignored. The zero value is an empty configuration.
+type SSHConfig struct {
+	directives []*sshConfigDirective
+}
+
+// SSHHostConfig is the configuration resolved for a host.
+type SSHHostConfig struct {
+	// HostName is the real host name to connect to.
+	HostName string
+	// Port is zero if not configured.
+	Port int
+	// User is empty if not configured.
+	User string
+	// IdentityFiles lists the configured identity files, if any.
+	IdentityFiles []string
+	// KnownHostsFiles lists the configured known hosts files, if any.
+	KnownHostsFiles []string
+	// ProxyJump lists the jump hosts to go through, in order.
+	ProxyJump []string
+	// Config holds the algorithms, restricted to DefaultSSHConfig.
+	Config ssh.Config
+	// HostKeyAlgorithms is restricted to DefaultSSHHostKeyAlgorithms.
+	HostKeyAlgorithms []string
+}
+
+type sshConfigDirective struct {
+	keyword  string
+	args     []string
+	file     string
+	line     int
+	included []*sshConfigDirective
+}
+
+// LoadSSHConfig parses the configuration file at path, following Include directives.
+// A missing file yields an empty configuration.
+func LoadSSHConfig(path string) (*SSHConfig, error) {
+	directives, err := parseSSHConfigFile(expandHome(path), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SSHConfig{directives: directives}, nil
+}
+
+// ParseSSHConfig parses a configuration from reader. Relative Include paths are resolved against ~/.ssh.
+func ParseSSHConfig(reader io.Reader) (*SSHConfig, error) {
+	directives, err := parseSSHConfig(reader, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SSHConfig{directives: directives}, nil
+}
+
+// Resolve computes the configuration for host, as named on the command line, for the given remote user (which may be
+// empty).
+//
+// As with OpenSSH, the first value obtained for each keyword wins, except for identity files which accumulate.
+// Algorithm lists are merged with DefaultSSHConfig and DefaultSSHHostKeyAlgorithms, supporting the +, - and ^
+// modifiers, but algorithms outside of these secure lists are dropped: configuration can never downgrade security.
+func (c *SSHConfig) Resolve(host, remoteUser string) (*SSHHostConfig, error) {
+	resolver := &sshConfigResolver{
+		original: host,
+		user:     remoteUser,
+		values:   map[string][]string{},
+	}
+
+	if c != nil {
+		if err := resolver.apply(c.directives); err != nil {
+			return nil, err
+		}
+	}
+
+	return resolver.result()
+}
+
+type sshConfigResolver struct {
+	original string
+	user     string
+	values   map[string][]string
+	identity []string
+}
+
+func (r *sshConfigResolver) apply(directives []*sshConfigDirective) error {
+	active := true
+
+	for _, directive := range directives {
+		switch directive.keyword {
+		case "host":
+			active = r.matchHost(directive.args)
+		case "match":
+			matched, err := r.match(directive)
+			if err != nil {
+				return err
+			}
+
+			active = matched
+		case "include":
+			if !active {
+				continue
+			}
+
+			if err := r.apply(directive.included); err != nil {
+				return err
+			}
+		case "identityfile":
+			if active {
+				r.identity = append(r.identity, directive.args...)
+			}
+		default:
+			if _, seen := r.values[directive.keyword]; active && !seen {
+				r.values[directive.keyword] = directive.args
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *sshConfigResolver) hostName() string {
+	if hostName := r.first("hostname"); hostName != "" {
+		return r.expandTokens(hostName)
+	}
+
+	return r.original
+}
+
+func (r *sshConfigResolver) matchHost(patterns []string) bool {
+	return matchPatternList(r.original, patterns)
+}
+
+func (r *sshConfigResolver) match(directive *sshConfigDirective) (bool, error) {
+	args := directive.args
+
+	for len(args) > 0 {
+		criterion := strings.ToLower(args[0])
+
+		negate := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+
+		if criterion == "all" {
+			args = args[1:]
+
+			if negate {
+				return false, nil
+			}
+
+			continue
+		}
+
+		if len(args) < 2 { //nolint:mnd // criterion and its argument
+			return false, fmt.Errorf("%w: %s:%d: Match %s requires an argument",
+				fault.ErrInvalidArgument, directive.file, directive.line, criterion)
+		}
+
+		patterns := strings.Split(args[1], ",")
+		args = args[2:]
+
+		var matched bool
+
+		switch criterion {
+		case "host":
+			matched = matchPatternList(r.hostName(), patterns)
+		case "originalhost":
+			matched = matchPatternList(r.original, patterns)
+		case "user":
+			matched = matchPatternList(r.remoteUser(), patterns)
+		case "localuser":
+			matched = matchPatternList(localUserName(), patterns)
+		default:
+			// exec, canonical, final and the like are not supported: the block never applies.
+			slog.Debug("unsupported ssh_config Match criterion, ignoring block",
+				slog.String("criterion", criterion),
+				slog.String("file", directive.file),
+				slog.Int("line", directive.line))
+
+			return false, nil
+		}
+
+		if matched == negate {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (r *sshConfigResolver) result() (*SSHHostConfig, error) {
+	resolved := &SSHHostConfig{
+		HostName: r.hostName(),
+		User:     r.user,
+	}
+
+	if resolved.User == "" {
+		resolved.User = r.first("user")
+	}
+
+	if port := r.first("port"); port != "" {
+		parsed, valid := parsePort(port)
+		if !valid {
+			return nil, fmt.Errorf("%w: invalid port %q for host %s", fault.ErrInvalidArgument, port, r.original)
+		}
+
+		resolved.Port = parsed
+	}
+
+	for _, identity := range r.identity {
+		resolved.IdentityFiles = append(resolved.IdentityFiles, r.expandTokens(identity))
+	}
+
+	if files := r.values["userknownhostsfile"]; len(files) > 0 && !strings.EqualFold(files[0], sshConfigNone) {
+		for _, file := range files {
+			resolved.KnownHostsFiles = append(resolved.KnownHostsFiles, r.expandTokens(file))
+		}
+	}
+
+	if jump := r.first("proxyjump"); jump != "" && !strings.EqualFold(jump, sshConfigNone) {
+		resolved.ProxyJump = strings.Split(jump, ",")
+	}
+
+	var err error
+
+	resolved.Config = DefaultSSHConfig
+
+	if resolved.Config.KeyExchanges, err = r.algorithms("kexalgorithms", DefaultSSHConfig.KeyExchanges); err != nil {
+		return nil, err
+	}
+
+	if resolved.Config.Ciphers, err = r.algorithms("ciphers", DefaultSSHConfig.Ciphers); err != nil {
+		return nil, err
+	}
+
+	if resolved.Config.MACs, err = r.algorithms("macs", DefaultSSHConfig.MACs); err != nil {
+		return nil, err
+	}
+
+	if resolved.HostKeyAlgorithms, err = r.algorithms("hostkeyalgorithms", DefaultSSHHostKeyAlgorithms); err != nil {
+		return nil, err
+	}
+
+	return resolved, nil
+}
+
+// algorithms merges a configured algorithm list with the secure defaults, never allowing anything outside of them.
+func (r *sshConfigResolver) algorithms(keyword string, secure []string) ([]string, error) {
+	value := r.first(keyword)
+	if value == "" {
+		return secure, nil
+	}
+
+	var requested []string
+
+	switch value[0] {
+	case '+':
+		requested = append(slices.Clone(secure), strings.Split(value[1:], ",")...)
+	case '^':
+		requested = append(strings.Split(value[1:], ","), secure...)
+	case '-':
+		removed := strings.Split(value[1:], ",")
+		requested = slices.DeleteFunc(slices.Clone(secure), func(alg string) bool {
+			return matchPatternList(alg, removed)
+		})
+	default:
+		requested = strings.Split(value, ",")
+	}
+
+	var allowed []string
+
+	for _, alg := range requested {
+		switch {
+		case !slices.Contains(secure, alg):
+			slog.Debug("refusing insecure ssh algorithm from ssh_config",
+				slog.String("keyword", keyword), slog.String("algorithm", alg))
+		case !slices.Contains(allowed, alg):
+			allowed = append(allowed, alg)
+		}
+	}
+
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("%w: %s for host %s leaves no secure algorithm", fault.ErrInvalidArgument, keyword,
+			r.original)
+	}
+
+	return allowed, nil
+}
+
+func (r *sshConfigResolver) first(keyword string) string {
+	if args := r.values[keyword]; len(args) > 0 {
+		return args[0]
+	}
+
+	return ""
+}
+
+func (r *sshConfigResolver) remoteUser() string {
+	if r.user != "" {
+		return r.user
+	}
+
+	if configured := r.first("user"); configured != "" {
+		return configured
+	}
+
+	return localUserName()
+}
+
+// expandTokens expands the subset of ssh_config(5) tokens that make sense here.
+func (r *sshConfigResolver) expandTokens(value string) string {
+	if !strings.Contains(value, "%") {
+		return expandHome(value)
+	}
+
+	host := r.original
+	if hostName := r.first("hostname"); hostName != "" && !strings.Contains(hostName, "%") {
+		host = hostName
+	}
+
+	port := r.first("port")
+	if port == "" {
+		port = strconv.Itoa(defaultSSHPort)
+	}
+
+	return expandHome(strings.NewReplacer(
+		"%%", "%",
+		"%h", host,
+		"%n", r.original,
+		"%p", port,
+		"%r", r.remoteUser(),
+		"%u", localUserName(),
+		"%d", filesystem.HomeDir(),
+	).Replace(value))
+}
+
+func parseSSHConfigFile(path string, depth int) ([]*sshConfigDirective, error) {
+	file, err := os.Open(path) //nolint:gosec // Configuration files are user provided
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+	}
+
+	defer func() {
+		_ = file.Close()
+	}()
+
+	return parseSSHConfig(file, path, depth)
+}
+
+func parseSSHConfig(reader io.Reader, name string, depth int) ([]*sshConfigDirective, error) {
+	var directives []*sshConfigDirective
+
+	scanner := bufio.NewScanner(reader)
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		fields, err := splitSSHConfigLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s:%d: %w", fault.ErrInvalidArgument, name, lineNumber, err)
+		}
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		directive := &sshConfigDirective{
+			keyword: strings.ToLower(fields[0]),
+			args:    fields[1:],
+			file:    name,
+			line:    lineNumber,
+		}
+
+		if len(directive.args) == 0 {
+			return nil, fmt.Errorf("%w: %s:%d: %s has no argument", fault.ErrInvalidArgument, name, lineNumber,
+				fields[0])
+		}
+
+		if directive.keyword == "include" {
+			if directive.included, err = parseSSHConfigInclude(directive, depth); err != nil {
+				return nil, err
+			}
+		}
+
+		directives = append(directives, directive)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+	}
+
+	return directives, nil
+}
+
+func parseSSHConfigInclude(directive *sshConfigDirective, depth int) ([]*sshConfigDirective, error) {
+	if depth >= sshConfigMaxIncludeDepth {
+		return nil, fmt.Errorf("%w: %s:%d: too many nested includes", fault.ErrInvalidArgument, directive.file,
+			directive.line)
+	}
+
+	var included []*sshConfigDirective
+
+	for _, pattern := range directive.args {
+		pattern = expandHome(pattern)
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filesystem.HomeDir(), ".ssh", pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s:%d: %w", fault.ErrInvalidArgument, directive.file, directive.line, err)
+		}
+
+		for _, match := range matches {
+			directives, err := parseSSHConfigFile(match, depth+1)
+			if err != nil {
+				return nil, err
+			}
+
+			included = append(included, directives...)
+		}
+	}
+
+	return included, nil
+}
+
+// splitSSHConfigLine splits a line into keyword and arguments, handling comments, "=" separators and double quotes.
+func splitSSHConfigLine(line string) ([]string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	keyword, rest := line, ""
+	if index := strings.IndexAny(line, " \t="); index >= 0 {
+		keyword = line[:index]
+		rest = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line[index:]), "="))
+	}
+
+	fields := []string{keyword}
+
+	var (
+		current strings.Builder
+		quoted  bool
+		pending bool
+	)
+
+	for _, char := range rest {
+		switch {
+		case char == '"':
+			quoted = !quoted
+			pending = true
+		case !quoted && (char == ' ' || char == '\t'):
+			if pending {
+				fields = append(fields, current.String())
+				current.Reset()
+
+				pending = false
+			}
+		case !quoted && char == '#' && !pending:
+			return fields, nil
+		default:
+			current.WriteRune(char)
+
+			pending = true
+		}
+	}
+
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+
+	if pending {
+		fields = append(fields, current.String())
+	}
+
+	return fields, nil
+}
+
+// matchPatternList reports whether value matches at least one of the patterns, and none of the negated ones.
+func matchPatternList(value string, patterns []string) bool {
+	matched := false
+
+	for _, pattern := range patterns {
+		if negated, ok := strings.CutPrefix(pattern, "!"); ok {
+			if matchPattern(strings.ToLower(value), strings.ToLower(negated)) {
+				return false
+			}
+
+			continue
+		}
+
+		if matchPattern(strings.ToLower(value), strings.ToLower(pattern)) {
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+// matchPattern implements ssh_config(5) patterns, where * matches any sequence of characters and ? exactly one.
+func matchPattern(value, pattern string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for index := len(value); index >= 0; index-- {
+				if matchPattern(value[index:], pattern[1:]) {
+					return true
+				}
+			}
+
+			return false
+		case '?':
+			if value == "" {
+				return false
+			}
+		default:
+			if value == "" || value[0] != pattern[0] {
+				return false
+			}
+		}
+
+		value, pattern = value[1:], pattern[1:]
+	}
+
+	return value == ""
+}
+
+func localUserName() string {
+	current, err := user.Current()
+	if err != nil {
+		return ""
+	}
+
+	return current.Username
+}
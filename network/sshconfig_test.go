@@ -0,0 +1,284 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/network"
+	"github.com/mycophonic/primordium/network/networktest"
+)
+
+func parseSSHConfig(t *testing.T, content string) *network.SSHConfig {
+	t.Helper()
+
+	config, err := network.ParseSSHConfig(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("ParseSSHConfig returned error: %v", err)
+	}
+
+	return config
+}
+
+func TestSSHConfig_Resolve(t *testing.T) {
+	t.Parallel()
+
+	config := parseSSHConfig(t, `
+# Comment
+Host build-* !build-legacy
+    HostName %h.example.com
+    Port=2222
+    IdentityFile /keys/build
+
+Host "build-01" other
+    User builder
+    Port 22
+    IdentityFile /keys/extra
+
+Host *
+    User nobody
+    ProxyJump none
+`)
+
+	resolved, err := config.Resolve("build-01", "")
+	if err != nil {
+		t.Fatalf("Resolve returned error: %v", err)
+	}
+
+	if resolved.HostName != "build-01.example.com" {
+		t.Errorf("HostName = %q", resolved.HostName)
+	}
+
+	if resolved.Port != 2222 {
+		t.Errorf("Port = %d, want first obtained value 2222", resolved.Port)
+	}
+
+	if resolved.User != "builder" {
+		t.Errorf("User = %q, want builder", resolved.User)
+	}
+
+	if !slices.Equal(resolved.IdentityFiles, []string{"/keys/build", "/keys/extra"}) {
+		t.Errorf("IdentityFiles = %v, want both accumulated", resolved.IdentityFiles)
+	}
+
+	if resolved.ProxyJump != nil {
+		t.Errorf("ProxyJump = %v, want none", resolved.ProxyJump)
+	}
+
+	legacy, err := config.Resolve("build-legacy", "admin")
+	if err != nil {
+		t.Fatalf("Resolve returned error: %v", err)
+	}
+
+	if legacy.HostName != "build-legacy" || legacy.Port != 0 || legacy.User != "admin" {
+		t.Errorf("negated pattern applied: %+v", legacy)
+	}
+}
+
+func TestSSHConfig_Match(t *testing.T) {
+	t.Parallel()
+
+	config := parseSSHConfig(t, `
+Host db
+    HostName db.internal
+
+Match host *.internal user deploy
+    ProxyJump bastion,jump2:2200
+
+Match exec "true"
+    Port 1
+
+Match !originalhost db all
+    Port 2000
+`)
+
+	resolved, err := config.Resolve("db", "deploy")
+	if err != nil {
+		t.Fatalf("Resolve returned error: %v", err)
+	}
+
+	if !slices.Equal(resolved.ProxyJump, []string{"bastion", "jump2:2200"}) {
+		t.Errorf("ProxyJump = %v", resolved.ProxyJump)
+	}
+
+	if resolved.Port != 0 {
+		t.Errorf("Port = %d, want unset (exec unsupported, originalhost negated)", resolved.Port)
+	}
+
+	other, err := config.Resolve("web", "deploy")
+	if err != nil {
+		t.Fatalf("Resolve returned error: %v", err)
+	}
+
+	if other.ProxyJump != nil || other.Port != 2000 {
+		t.Errorf("unexpected resolution for web: %+v", other)
+	}
+}
+
+func TestSSHConfig_Include(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "10-work.conf"), []byte("Host work\n  HostName work.example.com\n"),
+		0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "20-home.conf"), []byte("Host home\n  User me\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	main := filepath.Join(dir, "config")
+	content := fmt.Sprintf("Include %s\n\nHost nothing\n  Include %s\n", filepath.Join(dir, "*.conf"),
+		filepath.Join(dir, "missing-*"))
+
+	if err := os.WriteFile(main, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := network.LoadSSHConfig(main)
+	if err != nil {
+		t.Fatalf("LoadSSHConfig returned error: %v", err)
+	}
+
+	work, err := config.Resolve("work", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if work.HostName != "work.example.com" {
+		t.Errorf("HostName = %q, want work.example.com", work.HostName)
+	}
+
+	home, err := config.Resolve("home", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if home.User != "me" {
+		t.Errorf("User = %q, want me", home.User)
+	}
+
+	missing, err := network.LoadSSHConfig(filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatalf("missing file should yield an empty config, got %v", err)
+	}
+
+	if resolved, _ := missing.Resolve("host", ""); resolved.HostName != "host" {
+		t.Errorf("HostName = %q, want host", resolved.HostName)
+	}
+}
+
+func TestSSHConfig_RefusesDowngrade(t *testing.T) {
+	t.Parallel()
+
+	config := parseSSHConfig(t, `
+Host legacy
+    KexAlgorithms +diffie-hellman-group1-sha1
+    Ciphers aes128-cbc,aes128-gcm@openssh.com
+    MACs -hmac-sha2-512*
+    HostKeyAlgorithms ^ssh-rsa
+
+Host broken
+    Ciphers 3des-cbc
+`)
+
+	resolved, err := config.Resolve("legacy", "")
+	if err != nil {
+		t.Fatalf("Resolve returned error: %v", err)
+	}
+
+	if !slices.Equal(resolved.Config.KeyExchanges, network.DefaultSSHConfig.KeyExchanges) {
+		t.Errorf("KeyExchanges = %v, want defaults only", resolved.Config.KeyExchanges)
+	}
+
+	if !slices.Equal(resolved.Config.Ciphers, []string{"aes128-gcm@openssh.com"}) {
+		t.Errorf("Ciphers = %v", resolved.Config.Ciphers)
+	}
+
+	if !slices.Equal(resolved.Config.MACs, []string{"hmac-sha2-256-etm@openssh.com"}) {
+		t.Errorf("MACs = %v", resolved.Config.MACs)
+	}
+
+	if !slices.Equal(resolved.HostKeyAlgorithms, []string{ssh.KeyAlgoED25519}) {
+		t.Errorf("HostKeyAlgorithms = %v", resolved.HostKeyAlgorithms)
+	}
+
+	if _, err = config.Resolve("broken", ""); !errors.Is(err, fault.ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument when no secure cipher remains, got %v", err)
+	}
+}
+
+func TestParseSSHConfig_Invalid(t *testing.T) {
+	t.Parallel()
+
+	for _, content := range []string{
+		"Host\n",
+		"Host \"unterminated\n",
+		"Match host\n",
+	} {
+		config, err := network.ParseSSHConfig(strings.NewReader(content))
+		if err == nil {
+			_, err = config.Resolve("host", "")
+		}
+
+		if !errors.Is(err, fault.ErrInvalidArgument) {
+			t.Errorf("%q: expected ErrInvalidArgument, got %v", content, err)
+		}
+	}
+}
+
+func TestDialSSH_SSHConfig(t *testing.T) {
+	t.Parallel()
+
+	fixture := networktest.NewSSHServer(t)
+
+	host, port, _ := strings.Cut(fixture.Addr, ":")
+	config := parseSSHConfig(t, fmt.Sprintf(`
+Host fixture
+    HostName %s
+    Port %s
+    User configured
+    IdentityFile %s
+    UserKnownHostsFile %s
+`, host, port, fixture.ClientKeyFile, fixture.KnownHostsFile))
+
+	client, err := network.DialSSH(context.Background(), "fixture", &network.SSHOptions{
+		DisableAgent: true,
+		SSHConfig:    config,
+	})
+	if err != nil {
+		t.Fatalf("DialSSH returned error: %v", err)
+	}
+
+	defer client.Close()
+
+	if client.User() != "configured" {
+		t.Errorf("User() = %q, want configured", client.User())
+	}
+}
@@ -0,0 +1,115 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mycophonic/primordium/fault"
+)
+
+// SSHDialer opens connections tunneled through an ssh connection (possibly multi-hop, see DialSSH).
+// Its DialContext method can back http.Transport.DialContext.
+//
+// The ssh connection is established on first use, shared by all tunneled connections, and re-established if lost.
+type SSHDialer struct {
+	target string
+	opts   *SSHOptions
+
+	mu     sync.Mutex
+	client *ssh.Client
+	closed bool
+}
+
+// NewSSHDialer returns a dialer tunneling through target ("[user@]host[:port]"), connected to with DialSSH and opts.
+func NewSSHDialer(target string, opts *SSHOptions) *SSHDialer {
+	return &SSHDialer{target: target, opts: opts}
+}
+
+// DialContext connects to address, from the ssh server. Only tcp networks are supported.
+func (d *SSHDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	client, err := d.sshClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.DialContext(ctx, network, address)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%w: %w", fault.ErrCancelled, err)
+		}
+
+		return nil, fmt.Errorf("%w: dialing %s through %s: %w", fault.ErrNetworkError, address, d.target, err)
+	}
+
+	return conn, nil
+}
+
+// Close closes the ssh connection, and with it all tunneled connections. The dialer cannot be used afterwards.
+func (d *SSHDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+
+	if d.client == nil {
+		return nil
+	}
+
+	client := d.client
+	d.client = nil
+
+	return client.Close() //nolint:wrapcheck // Passthrough
+}
+
+func (d *SSHDialer) sshClient(ctx context.Context) (*ssh.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil, fmt.Errorf("%w: ssh dialer for %s: %w", fault.ErrNetworkError, d.target, net.ErrClosed)
+	}
+
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	client, err := DialSSH(ctx, d.target, d.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	d.client = client
+
+	go func() {
+		_ = client.Wait()
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		if d.client == client {
+			d.client = nil
+		}
+	}()
+
+	return client, nil
+}
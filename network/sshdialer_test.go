@@ -0,0 +1,150 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/network"
+	"github.com/mycophonic/primordium/network/networktest"
+)
+
+// jumpOptions returns options reaching destination through bastion, trusting both.
+func jumpOptions(bastion, destination *networktest.SSHServer) *network.SSHOptions {
+	return &network.SSHOptions{
+		IdentityFiles:   []string{bastion.ClientKeyFile, destination.ClientKeyFile},
+		KnownHostsFiles: []string{bastion.KnownHostsFile, destination.KnownHostsFile},
+		ProxyJump:       []string{"jumper@" + bastion.Addr},
+		DisableAgent:    true,
+		SSHConfig:       &network.SSHConfig{},
+	}
+}
+
+func TestDialSSH_ProxyJump(t *testing.T) {
+	t.Parallel()
+
+	first := networktest.NewSSHServer(t)
+	second := networktest.NewSSHServer(t)
+	destination := networktest.NewSSHServer(t)
+
+	opts := &network.SSHOptions{
+		IdentityFiles:   []string{first.ClientKeyFile, second.ClientKeyFile, destination.ClientKeyFile},
+		KnownHostsFiles: []string{first.KnownHostsFile, second.KnownHostsFile, destination.KnownHostsFile},
+		ProxyJump:       []string{first.Addr, second.Addr},
+		DisableAgent:    true,
+		SSHConfig:       &network.SSHConfig{},
+	}
+
+	client, err := network.DialSSH(context.Background(), "tester@"+destination.Addr, opts)
+	if err != nil {
+		t.Fatalf("DialSSH returned error: %v", err)
+	}
+
+	defer client.Close()
+
+	if client.User() != "tester" {
+		t.Errorf("User() = %q, want tester", client.User())
+	}
+
+	if _, _, err = client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Errorf("request over multi-hop connection failed: %v", err)
+	}
+}
+
+func TestDialSSH_ProxyJumpUnknownHop(t *testing.T) {
+	t.Parallel()
+
+	bastion := networktest.NewSSHServer(t)
+	destination := networktest.NewSSHServer(t)
+
+	opts := jumpOptions(bastion, destination)
+	opts.KnownHostsFiles = []string{destination.KnownHostsFile}
+
+	_, err := network.DialSSH(context.Background(), "tester@"+destination.Addr, opts)
+	if !errors.Is(err, fault.ErrAuthenticationFailure) {
+		t.Errorf("expected ErrAuthenticationFailure for unverified jump host, got: %v", err)
+	}
+}
+
+func TestDialSSH_ProxyJumpFromConfig(t *testing.T) {
+	t.Parallel()
+
+	bastion := networktest.NewSSHServer(t)
+	destination := networktest.NewSSHServer(t)
+
+	opts := jumpOptions(bastion, destination)
+	opts.ProxyJump = nil
+	// The bastion matches too, but the ProxyJump of jump hosts is ignored.
+	opts.SSHConfig = parseSSHConfig(t, "Host 127.0.0.1\n  ProxyJump "+bastion.Addr+"\n")
+
+	client, err := network.DialSSH(context.Background(), "tester@"+destination.Addr, opts)
+	if err != nil {
+		t.Fatalf("DialSSH returned error: %v", err)
+	}
+
+	client.Close()
+}
+
+func TestSSHDialer_HTTPTransport(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "tunneled")
+	}))
+	t.Cleanup(server.Close)
+
+	bastion := networktest.NewSSHServer(t)
+	destination := networktest.NewSSHServer(t)
+
+	dialer := network.NewSSHDialer("tester@"+destination.Addr, jumpOptions(bastion, destination))
+	t.Cleanup(func() { _ = dialer.Close() })
+
+	client := &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+
+	for range 2 {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request through ssh dialer failed: %v", err)
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if err != nil || string(body) != "tunneled" {
+			t.Errorf("body = %q, err = %v", body, err)
+		}
+	}
+
+	if err := dialer.Close(); err != nil {
+		t.Errorf("Close returned error: %v", err)
+	}
+
+	if _, err := dialer.DialContext(context.Background(), "tcp", server.Listener.Addr().String()); err == nil {
+		t.Error("expected an error dialing through a closed dialer")
+	}
+}
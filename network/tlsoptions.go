@@ -0,0 +1,293 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mycophonic/primordium/fault"
+)
+
+const pinPrefix = "sha256/"
+
+// TransportOption configures a RoundTripper created by NewTransportWithOptions or Config.Build.
+type TransportOption func(*RoundTripper) error
+
+// WithCABundles adds the certificates found in the PEM files, or in the files of the directories, to the trusted
+// roots. The system roots stay trusted, unless WithRootCAs was applied before.
+// Files in directories that hold no certificate are skipped, while explicitly named files must hold one.
+func WithCABundles(paths ...string) TransportOption {
+	return func(rt *RoundTripper) error {
+		pool := rt.TLSClientConfig.RootCAs
+		if pool == nil {
+			system, err := x509.SystemCertPool()
+			if err != nil {
+				slog.Debug("system certificate pool unavailable", slog.Any("error", err))
+
+				system = x509.NewCertPool()
+			}
+
+			pool = system
+		}
+
+		for _, path := range paths {
+			if err := appendCABundle(pool, path); err != nil {
+				return err
+			}
+		}
+
+		rt.TLSClientConfig.RootCAs = pool
+
+		return nil
+	}
+}
+
+// WithRootCAs replaces the trusted roots, including the system ones, with pool.
+func WithRootCAs(pool *x509.CertPool) TransportOption {
+	return func(rt *RoundTripper) error {
+		if pool == nil {
+			return fmt.Errorf("%w: nil certificate pool", fault.ErrInvalidArgument)
+		}
+
+		rt.TLSClientConfig.RootCAs = pool
+
+		return nil
+	}
+}
+
+// WithClientCertificate adds a client certificate for mutual TLS, from PEM encoded certificate and key files.
+// Encrypted PKCS#8 keys ("ENCRYPTED PRIVATE KEY", PBES2 with PBKDF2 and AES-CBC) are decrypted with passphrase, which
+// may be nil otherwise. Legacy OpenSSL encrypted keys are not supported, as their encryption is broken.
+func WithClientCertificate(certFile, keyFile string, passphrase []byte) TransportOption {
+	return func(rt *RoundTripper) error {
+		certPEM, err := os.ReadFile(certFile) //nolint:gosec // Caller provided path
+		if err != nil {
+			return fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+		}
+
+		keyPEM, err := os.ReadFile(keyFile) //nolint:gosec // Caller provided path
+		if err != nil {
+			return fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+		}
+
+		if keyPEM, err = decryptKeyPEM(keyPEM, passphrase); err != nil {
+			return err
+		}
+
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("%w: loading client certificate %s: %w", fault.ErrInvalidArgument, certFile, err)
+		}
+
+		rt.TLSClientConfig.Certificates = append(rt.TLSClientConfig.Certificates, cert)
+
+		return nil
+	}
+}
+
+// WithPinnedKeys requires servers matching host to present, in their verified chain, a certificate whose public key
+// (SubjectPublicKeyInfo) SHA-256 hash is one of pins. Host is a name or an ssh_config style pattern ("*.example.com").
+// Pins are base64 encoded, optionally prefixed with "sha256/". Mismatches fail with fault.ErrAuthenticationFailure.
+// The option can be applied several times for different hosts.
+func WithPinnedKeys(host string, pins ...string) TransportOption {
+	return func(rt *RoundTripper) error {
+		if len(pins) == 0 {
+			return fmt.Errorf("%w: no pin for host %s", fault.ErrInvalidArgument, host)
+		}
+
+		hashes := make([][]byte, 0, len(pins))
+
+		for _, pin := range pins {
+			hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, pinPrefix))
+			if err != nil || len(hash) != sha256.Size {
+				return fmt.Errorf("%w: invalid SPKI SHA-256 pin %q", fault.ErrInvalidArgument, pin)
+			}
+
+			hashes = append(hashes, hash)
+		}
+
+		previous := rt.TLSClientConfig.VerifyConnection
+		rt.TLSClientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if previous != nil {
+				if err := previous(state); err != nil {
+					return err
+				}
+			}
+
+			if !pinnedHost(state, host) {
+				return nil
+			}
+
+			return verifyPins(state, hashes)
+		}
+
+		return nil
+	}
+}
+
+// SPKIPin returns the pin of a certificate, as expected by WithPinnedKeys.
+func SPKIPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	return pinPrefix + base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// pinnedHost reports whether the connection is to host. IP literals are not sent as server names: the IP addresses the
+// verified certificate is valid for are matched instead.
+func pinnedHost(state tls.ConnectionState, host string) bool {
+	if state.ServerName != "" {
+		return matchPatternList(state.ServerName, []string{host})
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return false
+	}
+
+	for _, ip := range state.PeerCertificates[0].IPAddresses {
+		if matchPatternList(ip.String(), []string{host}) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func verifyPins(state tls.ConnectionState, pins [][]byte) error {
+	// Only the verified chains are trusted: anyone can append certificates to the presented ones. Without
+	// verification, only the leaf, whose key the handshake proved, can be.
+	var certs []*x509.Certificate
+	for _, chain := range state.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+
+	if len(state.VerifiedChains) == 0 && len(state.PeerCertificates) > 0 {
+		certs = state.PeerCertificates[:1]
+	}
+
+	for _, cert := range certs {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+		for _, pin := range pins {
+			if subtle.ConstantTimeCompare(hash[:], pin) == 1 {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("%w: no certificate of %s matches the pinned keys", fault.ErrAuthenticationFailure,
+		state.ServerName)
+}
+
+func appendCABundle(pool *x509.CertPool, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+	}
+
+	if !info.IsDir() {
+		bundle, err := os.ReadFile(path) //nolint:gosec // Caller provided path
+		if err != nil {
+			return fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+		}
+
+		if !pool.AppendCertsFromPEM(bundle) {
+			return fmt.Errorf("%w: no certificate found in %s", fault.ErrInvalidArgument, path)
+		}
+
+		return nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+	}
+
+	for _, entry := range entries {
+		file := filepath.Join(path, entry.Name())
+
+		// Stat follows symlinks, as found in hashed certificate directories.
+		if info, err = os.Stat(file); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		bundle, err := os.ReadFile(file) //nolint:gosec // Caller provided path
+		if err != nil {
+			return fmt.Errorf("%w: %w", fault.ErrReadFailure, err)
+		}
+
+		if !pool.AppendCertsFromPEM(bundle) {
+			slog.Debug("no certificate found in CA bundle, skipping", slog.String("file", file))
+		}
+	}
+
+	return nil
+}
+
+// decryptKeyPEM returns keyPEM, with its private key decrypted if it is an encrypted PKCS#8 one.
+func decryptKeyPEM(keyPEM, passphrase []byte) ([]byte, error) {
+	var decrypted []byte
+
+	for rest := keyPEM; ; {
+		var block *pem.Block
+
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		//nolint:staticcheck // Only detecting the deprecated format, to reject it
+		if x509.IsEncryptedPEMBlock(block) {
+			return nil, fmt.Errorf("%w: legacy PEM encryption is not supported, convert the key to PKCS#8",
+				fault.ErrInvalidArgument)
+		}
+
+		if block.Type != pemEncryptedPrivateKey {
+			decrypted = append(decrypted, pem.EncodeToMemory(block)...)
+
+			continue
+		}
+
+		if passphrase == nil {
+			return nil, fmt.Errorf("%w: private key is encrypted and no passphrase was provided",
+				fault.ErrInvalidArgument)
+		}
+
+		der, err := decryptPKCS8(block.Bytes, passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		decrypted = append(decrypted, pem.EncodeToMemory(&pem.Block{Type: pemPrivateKey, Bytes: der})...)
+	}
+
+	if decrypted == nil {
+		return nil, errors.Join(fault.ErrInvalidArgument, errNoPEMBlock)
+	}
+
+	return decrypted, nil
+}
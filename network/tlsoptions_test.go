@@ -0,0 +1,290 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network_test
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/network"
+	"github.com/mycophonic/primordium/network/networktest"
+)
+
+// newTransport returns a RoundTripper with opts applied, failing the test if an option cannot be applied.
+func newTransport(t *testing.T, opts ...network.TransportOption) *network.RoundTripper {
+	t.Helper()
+
+	rt, err := network.NewTransportWithOptions(opts...)
+	if err != nil {
+		t.Fatalf("NewTransportWithOptions returned error: %v", err)
+	}
+
+	return rt
+}
+
+// encryptPKCS8 encrypts a PKCS#8 key the way "openssl pkcs8 -topk8 -v2 aes-256-cbc -v2prf hmacWithSHA256" does.
+func encryptPKCS8(t *testing.T, der, passphrase []byte) []byte {
+	t.Helper()
+
+	salt, iv := make([]byte, 16), make([]byte, aes.BlockSize)
+	_, _ = rand.Read(salt)
+	_, _ = rand.Read(iv)
+
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), salt, 2048, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	for range padding {
+		der = append(der, byte(padding))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted := make([]byte, len(der))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, der)
+
+	mustMarshal := func(value any) asn1.RawValue {
+		raw, err := asn1.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return asn1.RawValue{FullBytes: raw}
+	}
+
+	kdf := struct {
+		Salt           []byte
+		IterationCount int
+		PRF            pkix.AlgorithmIdentifier
+	}{salt, 2048, pkix.AlgorithmIdentifier{
+		Algorithm:  asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9},
+		Parameters: asn1.NullRawValue,
+	}}
+
+	params := struct {
+		KeyDerivationFunc pkix.AlgorithmIdentifier
+		EncryptionScheme  pkix.AlgorithmIdentifier
+	}{
+		pkix.AlgorithmIdentifier{
+			Algorithm:  asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12},
+			Parameters: mustMarshal(kdf),
+		},
+		pkix.AlgorithmIdentifier{
+			Algorithm:  asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42},
+			Parameters: mustMarshal(iv),
+		},
+	}
+
+	info := struct {
+		Algorithm     pkix.AlgorithmIdentifier
+		EncryptedData []byte
+	}{
+		pkix.AlgorithmIdentifier{
+			Algorithm:  asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13},
+			Parameters: mustMarshal(params),
+		},
+		encrypted,
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: mustMarshal(info).FullBytes})
+}
+
+// writeClientCertificate issues a client certificate from ca, and writes it with its key, encrypted if passphrase is
+// not nil.
+func writeClientCertificate(t *testing.T, ca *networktest.CA, passphrase []byte) (certFile, keyFile string) {
+	t.Helper()
+
+	cert, err := ca.Issue("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if passphrase != nil {
+		keyPEM = encryptPKCS8(t, der, passphrase)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err = os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func fetch(t *testing.T, rt http.RoundTripper, url string) (string, error) {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := (&http.Client{Transport: rt}).Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+
+	return string(body), err
+}
+
+func TestWithCABundles(t *testing.T) {
+	t.Parallel()
+
+	server := networktest.NewTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "trusted")
+	}))
+
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "ca.pem")
+
+	if err := os.WriteFile(bundle, server.CA.PEM(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "README"), []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{bundle, dir} {
+		if body, err := fetch(t, newTransport(t, network.WithCABundles(path)), server.URL); err != nil ||
+			body != "trusted" {
+			t.Errorf("WithCABundles(%s): body = %q, err = %v", path, body, err)
+		}
+	}
+
+	if _, err := network.NewTransportWithOptions(network.WithCABundles(filepath.Join(dir, "README"))); !errors.Is(
+		err, fault.ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument for a file without certificates, got %v", err)
+	}
+
+	if _, err := network.NewTransportWithOptions(network.WithCABundles(filepath.Join(dir, "missing"))); !errors.Is(
+		err, fault.ErrReadFailure) {
+		t.Errorf("expected ErrReadFailure for a missing bundle, got %v", err)
+	}
+}
+
+func TestWithClientCertificate(t *testing.T) {
+	t.Parallel()
+
+	server := networktest.NewUnstartedTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	server.TLS.ClientCAs = server.CA.Pool()
+	server.StartTLS()
+
+	passphrase := []byte("correct horse")
+
+	for name, secret := range map[string][]byte{"plain": nil, "encrypted": passphrase} {
+		certFile, keyFile := writeClientCertificate(t, server.CA, secret)
+
+		rt := server.RoundTripper(network.WithClientCertificate(certFile, keyFile, secret))
+		if body, err := fetch(t, rt, server.URL); err != nil || body != "client" {
+			t.Errorf("%s key: body = %q, err = %v", name, body, err)
+		}
+	}
+
+	certFile, keyFile := writeClientCertificate(t, server.CA, passphrase)
+
+	for _, wrong := range [][]byte{nil, []byte("wrong")} {
+		_, err := network.NewTransportWithOptions(network.WithClientCertificate(certFile, keyFile, wrong))
+		if !errors.Is(err, fault.ErrInvalidArgument) {
+			t.Errorf("passphrase %q: expected ErrInvalidArgument, got %v", wrong, err)
+		}
+	}
+
+	if _, err := fetch(t, server.RoundTripper(), server.URL); err == nil {
+		t.Error("expected the server to reject a client without certificate")
+	}
+}
+
+func TestWithPinnedKeys(t *testing.T) {
+	t.Parallel()
+
+	server := networktest.NewTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "pinned")
+	}))
+
+	pin := network.SPKIPin(server.Certificate())
+	caPin := network.SPKIPin(server.CA.Certificate())
+
+	other, err := networktest.NewCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherPin := network.SPKIPin(other.Certificate())
+
+	for _, pins := range [][]string{{pin}, {otherPin, caPin}} {
+		if body, err := fetch(t, server.RoundTripper(network.WithPinnedKeys("127.0.0.1", pins...)), server.URL); err != nil ||
+			body != "pinned" {
+			t.Errorf("pins %v: body = %q, err = %v", pins, body, err)
+		}
+	}
+
+	_, err = fetch(t, server.RoundTripper(network.WithPinnedKeys("127.0.0.*", otherPin)), server.URL)
+	if !errors.Is(err, fault.ErrAuthenticationFailure) {
+		t.Errorf("expected ErrAuthenticationFailure on pin mismatch, got %v", err)
+	}
+
+	if _, err = fetch(t, server.RoundTripper(network.WithPinnedKeys("example.com", otherPin)), server.URL); err != nil {
+		t.Errorf("pins for another host should not apply, got %v", err)
+	}
+
+	if _, err = network.NewTransportWithOptions(network.WithPinnedKeys("example.com", "not base64!")); !errors.Is(
+		err, fault.ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument for an invalid pin, got %v", err)
+	}
+}
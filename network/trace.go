@@ -0,0 +1,292 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// MetricsObserver receives the metrics of HTTP attempts, typically to feed them into a metrics system.
+type MetricsObserver interface {
+	ObserveHTTP(ctx context.Context, metrics *RequestMetrics)
+}
+
+// MetricsObserverFunc adapts a function to MetricsObserver.
+type MetricsObserverFunc func(ctx context.Context, metrics *RequestMetrics)
+
+// ObserveHTTP calls f.
+func (f MetricsObserverFunc) ObserveHTTP(ctx context.Context, metrics *RequestMetrics) {
+	f(ctx, metrics)
+}
+
+// Instrumentation traces every attempt of a RoundTripper with httptrace, and reports its metrics once the response
+// body is closed or read to EOF, or as soon as the attempt fails.
+type Instrumentation struct {
+	// Logger, if set, logs the metrics of every attempt at Level.
+	Logger *slog.Logger
+	Level  slog.Level
+	// Observer, if set, receives the metrics of every attempt.
+	Observer MetricsObserver
+}
+
+// RequestMetrics describes a single HTTP attempt. Durations are zero for the phases that did not happen, such as DNS,
+// Connect and TLSHandshake on a reused connection.
+type RequestMetrics struct {
+	Method string
+	// URL is redacted.
+	URL    string
+	Status int
+	// Err is the transport error, or the error that interrupted reading the response body.
+	Err error
+
+	DNS          time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	// TTFB is the time from the start of the attempt to the first response byte.
+	TTFB time.Duration
+	// Total is the time from the start of the attempt to the end of the response body.
+	Total time.Duration
+
+	ConnReused bool
+	// BytesSent and BytesReceived count request and response body bytes.
+	BytesSent     int64
+	BytesReceived int64
+
+	// TLSVersion, TLSCurve and Protocol (ALPN) are set if a TLS handshake happened during the attempt.
+	TLSVersion uint16
+	TLSCurve   tls.CurveID
+	Protocol   string
+}
+
+// PostQuantum tells whether the TLS handshake of the attempt used the X25519MLKEM768 hybrid key exchange.
+func (m *RequestMetrics) PostQuantum() bool {
+	return m.TLSCurve == tls.X25519MLKEM768
+}
+
+// LogValue implements slog.LogValuer.
+func (m *RequestMetrics) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("method", m.Method),
+		slog.String("url", m.URL),
+		slog.Int("status", m.Status),
+		slog.Duration("dns", m.DNS),
+		slog.Duration("connect", m.Connect),
+		slog.Duration("tls_handshake", m.TLSHandshake),
+		slog.Duration("ttfb", m.TTFB),
+		slog.Duration("total", m.Total),
+		slog.Bool("conn_reused", m.ConnReused),
+		slog.Int64("bytes_sent", m.BytesSent),
+		slog.Int64("bytes_received", m.BytesReceived),
+	}
+
+	if m.TLSVersion != 0 {
+		attrs = append(attrs,
+			slog.String("tls_version", tls.VersionName(m.TLSVersion)),
+			slog.String("tls_curve", m.TLSCurve.String()),
+			slog.String("protocol", m.Protocol))
+	}
+
+	if m.Err != nil {
+		attrs = append(attrs, slog.Any("error", m.Err))
+	}
+
+	return slog.GroupValue(attrs...)
+}
+
+// roundTrip sends req with send, tracing the attempt.
+func (in *Instrumentation) roundTrip(
+	req *http.Request,
+	send func(*http.Request) (*http.Response, error),
+) (*http.Response, error) {
+	tracer := &attemptTracer{
+		instrumentation: in,
+		ctx:             req.Context(),
+		start:           time.Now(),
+		metrics:         RequestMetrics{Method: req.Method, URL: req.URL.Redacted()},
+	}
+
+	traced := req.WithContext(httptrace.WithClientTrace(req.Context(), tracer.clientTrace()))
+
+	if req.Body != nil && req.Body != http.NoBody {
+		traced.Body = &countingBody{ReadCloser: req.Body, count: tracer.sent}
+	}
+
+	resp, err := send(traced)
+	if err != nil {
+		tracer.finish(err)
+
+		return resp, err
+	}
+
+	tracer.metrics.Status = resp.StatusCode
+	resp.Body = &tracedBody{ReadCloser: resp.Body, tracer: tracer}
+
+	return resp, nil
+}
+
+// attemptTracer collects the metrics of one attempt. httptrace hooks may be called concurrently.
+type attemptTracer struct {
+	instrumentation *Instrumentation
+	ctx             context.Context //nolint:containedctx // Reported with the metrics once the body is done.
+	start           time.Time
+
+	mu           sync.Mutex
+	metrics      RequestMetrics
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	done         bool
+}
+
+func (at *attemptTracer) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			at.locked(func() { at.dnsStart = time.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			at.locked(func() { at.metrics.DNS = time.Since(at.dnsStart) })
+		},
+		ConnectStart: func(string, string) {
+			at.locked(func() {
+				if at.connectStart.IsZero() {
+					at.connectStart = time.Now()
+				}
+			})
+		},
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				at.locked(func() { at.metrics.Connect = time.Since(at.connectStart) })
+			}
+		},
+		TLSHandshakeStart: func() {
+			at.locked(func() { at.tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+
+			at.locked(func() {
+				at.metrics.TLSHandshake = time.Since(at.tlsStart)
+				at.metrics.TLSVersion = state.Version
+				at.metrics.TLSCurve = state.CurveID
+				at.metrics.Protocol = state.NegotiatedProtocol
+			})
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			at.locked(func() { at.metrics.ConnReused = info.Reused })
+		},
+		GotFirstResponseByte: func() {
+			at.locked(func() { at.metrics.TTFB = time.Since(at.start) })
+		},
+	}
+}
+
+func (at *attemptTracer) locked(function func()) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	function()
+}
+
+func (at *attemptTracer) sent(n int) {
+	at.locked(func() { at.metrics.BytesSent += int64(n) })
+}
+
+func (at *attemptTracer) received(n int) {
+	at.locked(func() { at.metrics.BytesReceived += int64(n) })
+}
+
+// finish reports the metrics, once.
+func (at *attemptTracer) finish(err error) {
+	at.mu.Lock()
+
+	if at.done {
+		at.mu.Unlock()
+
+		return
+	}
+
+	at.done = true
+	at.metrics.Total = time.Since(at.start)
+	at.metrics.Err = err
+
+	metrics := at.metrics
+
+	at.mu.Unlock()
+
+	if logger := at.instrumentation.Logger; logger != nil {
+		logger.LogAttrs(at.ctx, at.instrumentation.Level, "HTTP request", slog.Any("http", &metrics))
+	}
+
+	if observer := at.instrumentation.Observer; observer != nil {
+		observer.ObserveHTTP(at.ctx, &metrics)
+	}
+}
+
+// countingBody reports the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+
+	count func(int)
+}
+
+//nolint:wrapcheck // I/O wrapper must return unwrapped errors
+func (cb *countingBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+	cb.count(n)
+
+	return n, err
+}
+
+// tracedBody counts the bytes of a response body, and finishes the attempt on EOF, error or Close.
+type tracedBody struct {
+	io.ReadCloser
+
+	tracer *attemptTracer
+}
+
+//nolint:wrapcheck // I/O wrapper must return unwrapped errors
+func (tb *tracedBody) Read(p []byte) (int, error) {
+	n, err := tb.ReadCloser.Read(p)
+	tb.tracer.received(n)
+
+	switch {
+	case errors.Is(err, io.EOF):
+		tb.tracer.finish(nil)
+	case err != nil:
+		tb.tracer.finish(err)
+	}
+
+	return n, err
+}
+
+//nolint:wrapcheck // passthrough to response body
+func (tb *tracedBody) Close() error {
+	err := tb.ReadCloser.Close()
+	tb.tracer.finish(nil)
+
+	return err
+}
@@ -0,0 +1,132 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mycophonic/primordium/network"
+	"github.com/mycophonic/primordium/network/networktest"
+)
+
+func TestInstrumentation(t *testing.T) {
+	t.Parallel()
+
+	server := networktest.NewTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = io.WriteString(w, "pong!")
+	}))
+
+	var (
+		mu       sync.Mutex
+		observed []*network.RequestMetrics
+		logs     bytes.Buffer
+	)
+
+	rt := server.RoundTripper()
+	rt.Instrumentation = &network.Instrumentation{
+		Logger: slog.New(slog.NewJSONHandler(&logs, nil)),
+		Level:  slog.LevelInfo,
+		Observer: network.MetricsObserverFunc(func(_ context.Context, metrics *network.RequestMetrics) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			observed = append(observed, metrics)
+		}),
+	}
+
+	client := &http.Client{Transport: rt}
+
+	for range 2 {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, server.URL, strings.NewReader("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(observed) != 2 {
+		t.Fatalf("observed %d attempts, want 2", len(observed))
+	}
+
+	first, second := observed[0], observed[1]
+
+	if first.Status != http.StatusOK || first.BytesSent != 4 || first.BytesReceived != 5 {
+		t.Errorf("first attempt: status %d, sent %d, received %d", first.Status, first.BytesSent, first.BytesReceived)
+	}
+
+	if first.TLSVersion != tls.VersionTLS13 || !first.PostQuantum() {
+		t.Errorf("first attempt negotiated %s with %s", tls.VersionName(first.TLSVersion), first.TLSCurve)
+	}
+
+	if first.Connect <= 0 || first.TLSHandshake <= 0 || first.TTFB <= 0 || first.Total < first.TTFB {
+		t.Errorf("unexpected timings: %+v", first)
+	}
+
+	if first.ConnReused || !second.ConnReused || second.TLSHandshake != 0 {
+		t.Errorf("second attempt should reuse the connection: %+v", second)
+	}
+
+	if !strings.Contains(logs.String(), `"tls_curve":"X25519MLKEM768"`) {
+		t.Errorf("log does not report the curve: %s", logs.String())
+	}
+}
+
+func TestInstrumentation_ReportsErrors(t *testing.T) {
+	t.Parallel()
+
+	var observed *network.RequestMetrics
+
+	rt := newTransport(t)
+	rt.Instrumentation = &network.Instrumentation{
+		Observer: network.MetricsObserverFunc(func(_ context.Context, metrics *network.RequestMetrics) {
+			observed = metrics
+		}),
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://127.0.0.1:1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = (&http.Client{Transport: rt}).Do(req); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if observed == nil || observed.Err == nil || errors.Is(observed.Err, io.EOF) {
+		t.Errorf("error was not reported: %+v", observed)
+	}
+}
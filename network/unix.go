@@ -0,0 +1,197 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/filesystem"
+)
+
+const (
+	unixLockSuffix = ".lock"
+	unixTempPrefix = ".tmp-"
+	// unixTempSocket is the name of the socket in its temporary directory, kept short for the path length limit.
+	unixTempSocket = "s"
+)
+
+// ErrSocketInUse is returned when listening on a Unix socket owned by a live process.
+var ErrSocketInUse = errors.New("socket is in use")
+
+// ListenUnix listens on the Unix socket name under filesystem.RuntimeDir.
+//
+// Ownership of the socket is tracked with a lock file next to it, held until the listener is closed: if another live
+// process holds it, ListenUnix fails with ErrSocketInUse; otherwise a leftover socket from a dead process is removed.
+// The socket is only accessible to the current user. Names that are not a single valid path component, and paths
+// exceeding the platform limit, fail with fault.ErrInvalidArgument.
+func ListenUnix(name string) (net.Listener, error) {
+	if err := filesystem.ValidatePathComponent(name); err != nil {
+		return nil, fmt.Errorf("%w: socket name %q: %w", fault.ErrInvalidArgument, name, err)
+	}
+
+	dir, err := filesystem.RuntimeDir()
+	if err != nil {
+		return nil, err //nolint:wrapcheck // filesystem errors are wrapped already
+	}
+
+	return listenUnix(filepath.Join(dir, name))
+}
+
+// NewUnixTransport returns a RoundTripper sending every request to the Unix socket at path, whatever the URL host.
+// Requests should use the http scheme, with any host ("http://daemon/status").
+func NewUnixTransport(path string, opts ...TransportOption) (*RoundTripper, error) {
+	if err := filesystem.ValidateSocketPath(path); err != nil {
+		return nil, err //nolint:wrapcheck // fault error already
+	}
+
+	rt, err := NewTransportWithOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: dialTimeout}
+
+	rt.Proxy = nil
+	rt.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", path)
+	}
+
+	return rt, nil
+}
+
+// listenUnix listens on the Unix socket at path, see ListenUnix.
+func listenUnix(path string) (net.Listener, error) {
+	if err := filesystem.ValidateSocketPath(path); err != nil {
+		return nil, err //nolint:wrapcheck // fault error already
+	}
+
+	lockPath := path + unixLockSuffix
+
+	// The lock file is never removed: removing it while locked would let two processes lock different files.
+	//nolint:gosec // Lock path is derived from the socket path
+	lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDONLY, filesystem.FilePermissionsPrivate)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	_ = lockFile.Close()
+
+	lock, err := filesystem.TryLock(lockPath)
+	if err != nil {
+		if errors.Is(err, filesystem.ErrLockWouldBlock) {
+			return nil, fmt.Errorf("%w: %w: %s", fault.ErrNetworkError, ErrSocketInUse, path)
+		}
+
+		return nil, fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	listener, err := bindUnix(path)
+	if err != nil {
+		return nil, errors.Join(err, filesystem.Unlock(lock))
+	}
+
+	return &unixListener{UnixListener: listener, path: path, lock: lock}, nil
+}
+
+// bindUnix removes a stale socket at path and binds a new one, accessible to the current user only.
+// Must be called with the socket lock held.
+//
+// The socket is bound in a private temporary directory next to path, restricted to the current user, and renamed into
+// place: it is never reachable by other users before its permissions are restricted.
+func bindUnix(path string) (*net.UnixListener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%w: %s exists and is not a socket", fault.ErrInvalidArgument, path)
+		}
+
+		if err = os.Remove(path); err != nil {
+			return nil, fmt.Errorf("%w: removing stale socket: %w", fault.ErrFilesystemFailure, err)
+		}
+	}
+
+	// MkdirTemp creates the directory with 0700 permissions.
+	tempDir, err := os.MkdirTemp(filepath.Dir(path), unixTempPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err)
+	}
+
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+
+	tempPath := filepath.Join(tempDir, unixTempSocket)
+
+	if err = filesystem.ValidateSocketPath(tempPath); err != nil {
+		return nil, err //nolint:wrapcheck // fault error already
+	}
+
+	listener, err := (&net.ListenConfig{}).Listen(context.Background(), "unix", tempPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", fault.ErrNetworkError, err)
+	}
+
+	unixListener, ok := listener.(*net.UnixListener)
+	if !ok {
+		return nil, errors.Join(fmt.Errorf("%w: unexpected listener %T", fault.ErrSystemFailure, listener),
+			listener.Close())
+	}
+
+	// The listener would unlink the temporary path: unixListener removes the socket at path instead.
+	unixListener.SetUnlinkOnClose(false)
+
+	if err = os.Chmod(tempPath, filesystem.FilePermissionsPrivate); err != nil {
+		return nil, errors.Join(fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err), listener.Close())
+	}
+
+	if err = os.Rename(tempPath, path); err != nil {
+		return nil, errors.Join(fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, err), listener.Close())
+	}
+
+	return unixListener, nil
+}
+
+// unixListener removes the socket and releases the socket lock once closed.
+type unixListener struct {
+	*net.UnixListener
+
+	path string
+	lock *os.File
+	once sync.Once
+}
+
+// Close closes the listener, removes the socket, and releases the lock.
+func (ul *unixListener) Close() error {
+	err := ul.UnixListener.Close()
+
+	// Only once: the socket may belong to another listener by now.
+	ul.once.Do(func() {
+		if rmErr := os.Remove(ul.path); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) {
+			err = errors.Join(err, fmt.Errorf("%w: %w", fault.ErrFilesystemFailure, rmErr))
+		}
+
+		err = errors.Join(err, filesystem.Unlock(ul.lock))
+	})
+
+	return err //nolint:wrapcheck // pass through
+}
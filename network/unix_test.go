@@ -0,0 +1,161 @@
+/*
+   Copyright Mycophonic.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package network_test
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mycophonic/primordium/fault"
+	"github.com/mycophonic/primordium/filesystem"
+	"github.com/mycophonic/primordium/network"
+)
+
+func TestListenUnix(t *testing.T) {
+	t.Parallel()
+
+	name := "test-" + strings.ToLower(rand.Text()[:8]) + ".sock"
+
+	listener, err := network.ListenUnix(name)
+	if err != nil {
+		t.Fatalf("ListenUnix returned error: %v", err)
+	}
+
+	dir, err := filesystem.RuntimeDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+
+	t.Cleanup(func() {
+		_ = os.Remove(path + ".lock")
+	})
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("socket permissions = %o, want 600", info.Mode().Perm())
+	}
+
+	if _, err = network.ListenUnix(name); !errors.Is(err, network.ErrSocketInUse) {
+		t.Errorf("expected ErrSocketInUse while the socket is owned, got %v", err)
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		}),
+		ReadHeaderTimeout: time.Second,
+	}
+
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	transport, err := network.NewUnixTransport(path)
+	if err != nil {
+		t.Fatalf("NewUnixTransport returned error: %v", err)
+	}
+
+	resp, err := getResponse(t, &http.Client{Transport: transport}, "http://daemon/status", nil)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("status = %d, want 202", resp.StatusCode)
+	}
+
+	if err = server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket still exists after close: %v", err)
+	}
+
+	if listener, err = network.ListenUnix(name); err != nil {
+		t.Fatalf("ListenUnix after close returned error: %v", err)
+	}
+
+	_ = listener.Close()
+}
+
+func TestListenUnix_RemovesStaleSocket(t *testing.T) {
+	t.Parallel()
+
+	socket := filepath.Join(t.TempDir(), "stale.sock")
+
+	// A process that died without cleaning up leaves its socket behind.
+	stale, err := (&net.ListenConfig{}).Listen(context.Background(), "unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	server, err := network.NewServer(http.NotFoundHandler(), &network.ServerOptions{UnixSocket: socket})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := server.Listen()
+	if err != nil {
+		t.Fatalf("Listen over a stale socket returned error: %v", err)
+	}
+
+	_ = listener.Close()
+
+	regular := filepath.Join(t.TempDir(), "regular")
+	if err = os.WriteFile(regular, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err = network.NewServer(http.NotFoundHandler(), &network.ServerOptions{UnixSocket: regular})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = server.Listen(); !errors.Is(err, fault.ErrInvalidArgument) {
+		t.Errorf("expected ErrInvalidArgument over a regular file, got %v", err)
+	}
+}
+
+func TestListenUnix_InvalidName(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{"", "../escape.sock", "sub/dir.sock", strings.Repeat("s", 200)} {
+		if _, err := network.ListenUnix(name); !errors.Is(err, fault.ErrInvalidArgument) {
+			t.Errorf("ListenUnix(%q): expected ErrInvalidArgument, got %v", name, err)
+		}
+	}
+}